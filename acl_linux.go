@@ -0,0 +1,48 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// POSIX ACLs live in an extended attribute on Linux. The raw value is
+// stored as-is so no ACL parsing (or cgo) is needed.
+const aclXattr = "system.posix_acl_access"
+
+func readACL(path string) ([]byte, error) {
+	return readXattr(path, aclXattr)
+}
+
+// readXattr returns the value of the extended attribute name, or nil if the
+// file does not have it or the filesystem does not support it.
+func readXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if errors.Is(err, syscall.ENODATA) || errors.Is(err, syscall.ENOTSUP) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(path, name, buf)
+		if errors.Is(err, syscall.ERANGE) {
+			// The value grew between the two calls
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func applyACL(path string, acl []byte) error {
+	return syscall.Setxattr(path, aclXattr, acl, 0)
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// testACL encodes user::rw-, user:1000:r--, group::r--, mask::r--, other::r--
+// in the kernel's posix_acl_xattr format.
+func testACL() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(2))
+	for _, e := range []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{0x01, 6, 0xffffffff},
+		{0x02, 4, 1000},
+		{0x04, 4, 0xffffffff},
+		{0x10, 4, 0xffffffff},
+		{0x20, 4, 0xffffffff},
+	} {
+		binary.Write(&buf, binary.LittleEndian, e)
+	}
+	return buf.Bytes()
+}
+
+func TestBackupRestore_PreservesACL(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	source := filepath.Join(tmpWatch, "shared.txt")
+	if err := os.WriteFile(source, []byte("shared"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := applyACL(source, testACL())
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skip("filesystem does not support POSIX ACLs")
+	}
+	if err != nil {
+		t.Fatalf("applyACL() error = %v", err)
+	}
+	want, err := readACL(source)
+	if err != nil || len(want) == 0 {
+		t.Fatalf("readACL() = %v, %v", want, err)
+	}
+
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readACL(filepath.Join(tmpRestore, "shared.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ACL not preserved:\nwant %x\ngot  %x", want, got)
+	}
+}
+
+func TestReadACL_NoACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plain.txt")
+	if err := os.WriteFile(path, []byte("plain"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	acl, err := readACL(path)
+	if err != nil {
+		t.Fatalf("readACL() error = %v", err)
+	}
+	if acl != nil {
+		t.Errorf("expected no ACL, got %x", acl)
+	}
+}
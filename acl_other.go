@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func readACL(path string) ([]byte, error) {
+	return nil, nil
+}
+
+func applyACL(path string, acl []byte) error {
+	return errors.New("ACLs are not supported on this platform")
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
-	"encoding/gob"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,52 +23,531 @@ type FileEntry struct {
 	Size    int64
 	Content []byte
 	Deleted bool
+	// ACL is the raw POSIX access ACL, if the file has one.
+	ACL []byte
+	// Capability is the raw security.capability attribute of a binary
+	// given file capabilities with setcap, if it has one.
+	Capability []byte
+	// BirthTime is the file's creation time on platforms that record it,
+	// and zero elsewhere.
+	BirthTime time.Time
+	// Files larger than a chunk are stored as Parts consecutive entries,
+	// each holding one slice of the content. Part is the 0-based index.
+	// Parts is 0 for files stored whole.
+	Part  int
+	Parts int
+	// ContentHash is the SHA-256 of the full content. A file whose content
+	// was already stored earlier in the same run carries no Content and
+	// names the stored copy by ContentRef instead.
+	ContentHash string
+	ContentRef  string
+	// MetadataOnly marks a file backed up by --backup-metadata-only: Size
+	// and ContentHash describe it, but its content was not stored.
+	MetadataOnly bool
+}
+
+// heldSize is how much of the memory budget entry holds until it is
+// written to a chunk.
+func (e *FileEntry) heldSize() int64 {
+	if e.MetadataOnly {
+		return 0
+	}
+	return e.Size
 }
 
 type Chunk struct {
 	Entries []*FileEntry
+	// Full marks a run that captured the whole tree rather than just changes;
+	// Final marks the last chunk of a run.
+	Full  bool
+	Final bool
+	// Source labels the tree the run backed up, the absolute watch path
+	// unless --source-label names it, so restore can check it is restoring
+	// the backup it expects. Every chunk of a run carries it.
+	Source string
+
+	// format is how the chunk is serialized. It lives in the file header,
+	// not the payload.
+	format chunkFormat
 }
 
 const chunkSize = 5 * 1024 * 1024
 
-func createBackup(backupPath string, entries []*FileEntry) error {
-	timestamp := time.Now().Unix()
+// maxEntryOverhead is the room a part of a split file leaves in its chunk
+// for the entry's metadata.
+const maxEntryOverhead = 1024
+
+// maxPartSize is the most content a single entry carries, so any entry fits
+// in one chunk.
+const maxPartSize = chunkSize - maxEntryOverhead
+
+// Chunk files start with chunkMagic followed by a format version byte.
+// Files without the magic predate the header and are read as version 0.
+// From version 2 the payload is followed by its SHA-256, and from version 3
+// the version byte is followed by a chunkFormat byte; earlier versions are
+// always gob.
+const (
+	chunkMagic   = "AKBK"
+	chunkVersion = 3
+)
+
+var ErrUnsupportedChunkVersion = errors.New("unsupported chunk format version")
+
+var ErrChunkChecksum = errors.New("chunk checksum mismatch")
+
+var ErrChunkLimitExceeded = errors.New("backup run exceeds the chunk limit")
+
+type backupOptions struct {
+	full bool
+	// budget bounds the file content held in memory between the scan and
+	// the chunk writer. nil means unbounded.
+	budget *byteBudget
+	// commit is called once the entry stream is exhausted, before the final
+	// chunk is written. An error aborts the run and removes its chunks.
+	commit func() error
+	// maxChunks aborts a run that would write more chunks than this, guarding
+	// against a misconfigured watch path filling the disk. 0 is unlimited.
+	maxChunks int
+	format    chunkFormat
+	// contentAddressed stores chunks as objects named by their hash, with
+	// an index giving the run's order, so identical chunks are stored once.
+	contentAddressed bool
+	// replicas are further directories every chunk is also written to;
+	// policy decides how many of them, with backupPath, must succeed.
+	replicas []string
+	policy   writePolicy
+	fsync    fsyncMode
+	// maxEntries flushes a chunk once it holds this many entries, even if
+	// it is not full, for consumers that process chunks as units. 0 is
+	// unlimited.
+	maxEntries int
+	// source is recorded as the Source of every chunk.
+	source string
+	// lagging maps a destination to the runs it missed, oldest first. They
+	// are copied to it before this run is written, and lagging is updated
+	// to what is still missing once the run succeeds.
+	lagging map[string][]int64
+}
+
+// createBackup writes entries sorted by path, so identical input produces
+// identical chunks. Entries for the same path keep their relative order.
+func createBackup(backupPath string, entries []*FileEntry, opts backupOptions) error {
+	// The entries are already in memory, so there is nothing to bound
+	opts.budget = nil
+
+	entries = slices.Clone(entries)
+	slices.SortStableFunc(entries, func(a, b *FileEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	stream := make(chan *FileEntry)
+	go func() {
+		defer close(stream)
+		for _, entry := range entries {
+			stream <- entry
+		}
+	}()
+
+	_, err := createBackupStream(backupPath, stream, opts)
+	return err
+}
+
+// createBackupStream packs entries into chunks as they arrive and returns
+// the run timestamp, or 0 if nothing was written. The entries channel is
+// always drained, even on error, so the producer never blocks.
+func createBackupStream(backupPath string, entries <-chan *FileEntry, opts backupOptions) (int64, error) {
+	dests := newDestinations(backupPath, opts.replicas, opts.policy)
+	dests.catchUp(opts.lagging, opts.fsync)
+	timestamp := dests.timestamp()
 	chunkNum := 0
-	var currentChunk Chunk
+	currentChunk := Chunk{Full: opts.full, Source: opts.source, format: opts.format}
 	currentSize := 0
+	var held int64
+	var objects []string
+	stored := make(map[string]bool)
+
+	flush := func() error {
+		if opts.maxChunks > 0 && chunkNum >= opts.maxChunks {
+			return fmt.Errorf("%w of %d", ErrChunkLimitExceeded, opts.maxChunks)
+		}
+		var hash string
+		err := dests.each(func(backupPath string) (string, error) {
+			if opts.contentAddressed {
+				// A destination that fails must not clear the hash the
+				// others stored the chunk under
+				objectHash, filename, err := writeObject(backupPath, currentChunk, opts.fsync)
+				if err == nil {
+					hash = objectHash
+				}
+				return filename, err
+			}
+			return writeChunkFile(backupPath, timestamp, chunkNum, currentChunk, opts.fsync)
+		})
+		if err != nil {
+			return err
+		}
+		if opts.contentAddressed {
+			objects = append(objects, hash)
+		}
+		opts.budget.release(held)
+		chunkNum++
+		currentChunk = Chunk{Full: opts.full, Source: opts.source, format: opts.format}
+		currentSize = 0
+		held = 0
+		return nil
+	}
 
-	for _, entry := range entries {
-		entrySize := len(entry.Content) + 1024
+	fail := func(err error) (int64, error) {
+		opts.budget.release(held)
+		for entry := range entries {
+			opts.budget.release(entry.heldSize())
+		}
+		dests.removeAll()
+		return 0, err
+	}
+	if err := dests.check(); err != nil {
+		return fail(err)
+	}
 
-		if currentSize+entrySize > chunkSize && len(currentChunk.Entries) > 0 {
-			if err := writeChunk(backupPath, timestamp, chunkNum, currentChunk); err != nil {
-				return err
+	for {
+		var entry *FileEntry
+		var ok bool
+		select {
+		case entry, ok = <-entries:
+		case <-opts.budget.starved():
+			// The producer is waiting on memory we hold; write what we have
+			if len(currentChunk.Entries) > 0 {
+				if err := flush(); err != nil {
+					return fail(err)
+				}
 			}
-			chunkNum++
-			currentChunk = Chunk{}
-			currentSize = 0
+			continue
+		}
+		if !ok {
+			break
+		}
+
+		if !entry.Deleted && len(entry.Content) > 0 {
+			entry = dedupEntry(entry, stored)
 		}
 
-		currentChunk.Entries = append(currentChunk.Entries, entry)
-		currentSize += entrySize
+		// The budget was acquired for entry.Size, so the parts of a split
+		// file account for exactly that between them
+		remaining := entry.heldSize()
+		parts := splitEntry(entry, opts.format)
+		for i, part := range parts {
+			partHeld := min(int64(len(part.Content)), remaining)
+			if i == len(parts)-1 {
+				partHeld = remaining
+			}
+			remaining -= partHeld
+
+			entrySize := encodedEntrySize(part, opts.format)
+			full := currentSize+entrySize > chunkSize ||
+				opts.maxEntries > 0 && len(currentChunk.Entries) >= opts.maxEntries
+			if full && len(currentChunk.Entries) > 0 {
+				if err := flush(); err != nil {
+					held += remaining + partHeld
+					return fail(err)
+				}
+			}
+
+			currentChunk.Entries = append(currentChunk.Entries, part)
+			currentSize += entrySize
+			held += partHeld
+		}
 	}
 
-	if len(currentChunk.Entries) > 0 {
-		if err := writeChunk(backupPath, timestamp, chunkNum, currentChunk); err != nil {
-			return err
+	if opts.commit != nil {
+		if err := opts.commit(); err != nil {
+			return fail(err)
+		}
+	}
+
+	// A full run of an empty tree still needs a chunk to anchor restore,
+	// and an earlier flush may have left nothing to carry the Final mark.
+	if len(currentChunk.Entries) > 0 || chunkNum > 0 || opts.full {
+		currentChunk.Final = true
+		if err := flush(); err != nil {
+			return fail(err)
+		}
+	}
+
+	if chunkNum == 0 {
+		if opts.lagging != nil {
+			dests.record(opts.lagging, 0)
+		}
+		return 0, nil
+	}
+	if opts.contentAddressed {
+		err := dests.each(func(backupPath string) (string, error) {
+			return "", writeRunIndex(backupPath, timestamp, objects, opts.fsync)
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if opts.lagging != nil {
+		dests.record(opts.lagging, timestamp)
+	}
+	return timestamp, nil
+}
+
+// clock is swapped out by tests to simulate the system clock jumping.
+var clock = time.Now
+
+// runTimestamp returns the timestamp for a new run in backupPath. If the
+// clock reads at or before the latest existing run, as after a backward
+// NTP correction or a second run within the same second, it returns one
+// past that run instead, so runs always replay in the order they were made.
+func runTimestamp(backupPath string) int64 {
+	now := clock().Unix()
+	latest := int64(0)
+	files, _ := chunkFiles(backupPath)
+	for _, file := range files {
+		if ts, _, ok := parseChunkName(filepath.Base(file)); ok && ts > latest {
+			latest = ts
 		}
 	}
+	if latest < now {
+		return now
+	}
+	if latest > now {
+		log.Printf("Warning: clock is %ds behind the latest run in %s; stamping this run %d", latest-now, backupPath, latest+1)
+	}
+	return latest + 1
+}
+
+// dedupEntry returns a copy of entry with its ContentHash set, or, if the
+// same content is already in stored, a reference to it without content.
+func dedupEntry(entry *FileEntry, stored map[string]bool) *FileEntry {
+	e := *entry
+	if e.ContentHash == "" {
+		e.ContentHash = hashContent(e.Content)
+	}
+	if stored[e.ContentHash] {
+		e.ContentRef, e.ContentHash = e.ContentHash, ""
+		e.Content = nil
+		return &e
+	}
+	stored[e.ContentHash] = true
+	return &e
+}
+
+// splitEntry breaks an entry whose content does not fit in one chunk into
+// ordered parts. Other entries are returned as they are.
+func splitEntry(entry *FileEntry, format chunkFormat) []*FileEntry {
+	partSize := maxPartSize
+	if format == formatJSON {
+		// base64 stores every 3 bytes of content as 4
+		partSize = maxPartSize / 4 * 3
+	}
+	if len(entry.Content) <= partSize {
+		return []*FileEntry{entry}
+	}
+
+	n := (len(entry.Content) + partSize - 1) / partSize
+	parts := make([]*FileEntry, n)
+	for i := range parts {
+		part := *entry
+		part.Content = entry.Content[i*partSize : min((i+1)*partSize, len(entry.Content))]
+		part.Part = i
+		part.Parts = n
+		parts[i] = &part
+	}
+	return parts
+}
 
-	return nil
+// byteBudget is a counting semaphore over bytes. A single acquisition larger
+// than the limit is allowed when nothing else is held, so oversized files
+// still make progress.
+type byteBudget struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int64
+	used    int64
+	peak    int64
+	waiting chan struct{}
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	b := &byteBudget{limit: limit, waiting: make(chan struct{}, 1)}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *byteBudget) acquire(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.used > 0 && b.used+n > b.limit {
+		select {
+		case b.waiting <- struct{}{}:
+		default:
+		}
+		b.cond.Wait()
+	}
+	b.used += n
+	b.peak = max(b.peak, b.used)
+}
+
+func (b *byteBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// starved signals when an acquire is blocked waiting for memory.
+func (b *byteBudget) starved() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.waiting
+}
+
+// fsyncMode controls how chunk writes are flushed to stable storage.
+type fsyncMode int
+
+const (
+	// fsyncAlways syncs each chunk file and then its directory, so a chunk
+	// survives a power failure once written.
+	fsyncAlways fsyncMode = iota
+	// fsyncDir only syncs the directory: a chunk's name is durable, but its
+	// content may be lost and is then caught by its checksum.
+	fsyncDir
+	fsyncNone
+)
+
+var fsyncModeNames = map[string]fsyncMode{
+	"always": fsyncAlways,
+	"dir":    fsyncDir,
+	"none":   fsyncNone,
+}
+
+func parseFsyncMode(name string) (fsyncMode, error) {
+	mode, ok := fsyncModeNames[name]
+	if !ok {
+		names := make([]string, 0, len(fsyncModeNames))
+		for name := range fsyncModeNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("unsupported fsync mode %q (want one of %v)", name, names)
+	}
+	return mode, nil
+}
+
+// syncFile is swapped out by tests to record which files are synced.
+var syncFile = (*os.File).Sync
+
+// syncContent flushes file, just written, if the mode calls for it.
+func (m fsyncMode) syncContent(file *os.File) error {
+	if m != fsyncAlways {
+		return nil
+	}
+	return syncFile(file)
+}
+
+// syncDir flushes dir, so files just created or renamed in it keep their
+// names after a crash. Windows cannot sync a directory, and does not need
+// to for the name to persist.
+func (m fsyncMode) syncDir(dir string) error {
+	if m == fsyncNone || runtime.GOOS == "windows" {
+		return nil
+	}
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = syncFile(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeSynced creates path holding data, synced as mode requires. Its
+// directory is left to the caller, which usually renames it first.
+func writeSynced(path string, data []byte, mode fsyncMode) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = mode.syncContent(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func writeChunk(backupPath string, timestamp int64, num int, chunk Chunk) error {
+	_, err := writeChunkFile(backupPath, timestamp, num, chunk, fsyncAlways)
+	return err
+}
+
+func writeChunkFile(backupPath string, timestamp int64, num int, chunk Chunk, mode fsyncMode) (string, error) {
 	filename := filepath.Join(backupPath, fmt.Sprintf("chunk_%d_%03d.dat", timestamp, num))
 	file, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+
+	err = encodeChunk(file, chunk)
+	if err == nil {
+		err = mode.syncContent(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = mode.syncDir(backupPath)
+	}
+	return filename, err
+}
+
+func encodeChunk(w io.Writer, chunk Chunk) error {
+	codec, err := codecFor(chunk.format)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append([]byte(chunkMagic), chunkVersion, byte(chunk.format))); err != nil {
+		return err
+	}
+	sum := sha256.New()
+	if err := codec.encode(io.MultiWriter(w, sum), chunk); err != nil {
+		return err
+	}
+	_, err = w.Write(sum.Sum(nil))
+	return err
+}
+
+// rewriteChunk atomically replaces an existing chunk file, keeping the
+// format it was read in.
+func rewriteChunk(filename string, chunk Chunk) error {
+	tmp := filename + ".tmp"
+	file, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	return gob.NewEncoder(file).Encode(chunk)
+	if err := encodeChunk(file, chunk); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
@@ -1,18 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 )
 
+// distinctContent returns size bytes that differ for each seed, so entries
+// are not deduplicated against each other.
+func distinctContent(seed, size int) []byte {
+	content := make([]byte, size)
+	binary.LittleEndian.PutUint64(content, uint64(seed)+1)
+	return content
+}
+
 func TestCreateBackup_EmptyEntryList(t *testing.T) {
 	tmpDir := t.TempDir()
 	var entries []*FileEntry
 
-	err := createBackup(tmpDir, entries)
+	err := createBackup(tmpDir, entries, backupOptions{})
 	if err != nil {
 		t.Fatalf("createBackup() error = %v", err)
 	}
@@ -38,7 +55,7 @@ func TestCreateBackup_SingleSmallFile(t *testing.T) {
 		},
 	}
 
-	err := createBackup(tmpDir, entries)
+	err := createBackup(tmpDir, entries, backupOptions{})
 	if err != nil {
 		t.Fatalf("createBackup() error = %v", err)
 	}
@@ -83,7 +100,7 @@ func TestCreateBackup_MultipleFilesInOneChunk(t *testing.T) {
 		},
 	}
 
-	err := createBackup(tmpDir, entries)
+	err := createBackup(tmpDir, entries, backupOptions{})
 	if err != nil {
 		t.Fatalf("createBackup() error = %v", err)
 	}
@@ -111,23 +128,23 @@ func TestCreateBackup_FilesSpanMultipleChunks(t *testing.T) {
 	entries := []*FileEntry{
 		{
 			Path:    "file1.dat",
-			Content: make([]byte, 3*1024*1024), // 3MB
+			Content: distinctContent(1, 3*1024*1024), // 3MB
 		},
 		{
 			Path:    "file2.dat",
-			Content: make([]byte, 3*1024*1024), // 3MB
+			Content: distinctContent(2, 3*1024*1024), // 3MB
 		},
 		{
 			Path:    "file3.dat",
-			Content: make([]byte, 3*1024*1024), // 3MB
+			Content: distinctContent(3, 3*1024*1024), // 3MB
 		},
 		{
 			Path:    "file4.dat",
-			Content: make([]byte, 3*1024*1024), // 3MB
+			Content: distinctContent(4, 3*1024*1024), // 3MB
 		},
 	}
 
-	err := createBackup(tmpDir, entries)
+	err := createBackup(tmpDir, entries, backupOptions{})
 	if err != nil {
 		t.Fatalf("createBackup() error = %v", err)
 	}
@@ -154,40 +171,95 @@ func TestCreateBackup_FilesSpanMultipleChunks(t *testing.T) {
 	}
 }
 
-func TestCreateBackup_LargeFileSingleChunk(t *testing.T) {
+func TestCreateBackup_LargeFileSplitIntoParts(t *testing.T) {
 	tmpDir := t.TempDir()
 
-	// Single file larger than 5MB
+	// Single file larger than 5MB, with content that shows misordering
+	content := make([]byte, 12*1024*1024)
+	for i := range content {
+		content[i] = byte(i / 4096)
+	}
 	entries := []*FileEntry{
 		{
 			Path:    "large.dat",
-			Content: make([]byte, 10*1024*1024), // 10MB
+			Mode:    0644,
+			Size:    int64(len(content)),
+			Content: content,
 		},
 	}
 
-	err := createBackup(tmpDir, entries)
+	err := createBackup(tmpDir, entries, backupOptions{})
 	if err != nil {
 		t.Fatalf("createBackup() error = %v", err)
 	}
 
 	files, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
 
-	// Should create one chunk (soft limit behavior)
-	if len(files) != 1 {
-		t.Fatalf("expected 1 chunk for large file, got %d", len(files))
+	// Each part fills its own chunk
+	if len(files) != 3 {
+		t.Fatalf("expected 3 chunks for a 12MB file, got %d", len(files))
 	}
 
-	chunk, err := readChunk(files[0])
+	for i, file := range files {
+		chunk, err := readChunk(file)
+		if err != nil {
+			t.Fatalf("readChunk() error = %v", err)
+		}
+		if len(chunk.Entries) != 1 {
+			t.Fatalf("expected 1 entry per chunk, got %d", len(chunk.Entries))
+		}
+		part := chunk.Entries[0]
+		if part.Part != i || part.Parts != 3 {
+			t.Errorf("chunk %d holds part %d of %d", i, part.Part, part.Parts)
+		}
+		if len(part.Content) > maxPartSize {
+			t.Errorf("part %d has %d bytes, more than %d", i, len(part.Content), maxPartSize)
+		}
+	}
+
+	tmpRestore := t.TempDir()
+	if err := restore(tmpDir, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	restored, err := os.ReadFile(filepath.Join(tmpRestore, "large.dat"))
 	if err != nil {
-		t.Fatalf("readChunk() error = %v", err)
+		t.Fatal(err)
 	}
+	if !bytes.Equal(restored, content) {
+		t.Error("reassembled file does not match the original")
+	}
+}
 
-	if len(chunk.Entries) != 1 {
-		t.Errorf("expected 1 entry, got %d", len(chunk.Entries))
+func TestRestore_SplitFileMissingPartKeepsEarlierVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	if err := writeChunk(tmpDir, 1000, 0, Chunk{
+		Entries: []*FileEntry{{Path: "large.dat", Mode: 0644, Content: []byte("old")}},
+		Final:   true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*maxPartSize)
+	if err := createBackup(tmpDir, []*FileEntry{{Path: "large.dat", Mode: 0644, Content: content}}, backupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
+	if len(files) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(files))
+	}
+	if err := os.Remove(files[2]); err != nil {
+		t.Fatal(err)
 	}
 
-	if len(chunk.Entries[0].Content) != 10*1024*1024 {
-		t.Errorf("content size mismatch")
+	tmpRestore := t.TempDir()
+	var partial *partialError
+	if err := restore(tmpDir, tmpRestore, restoreOptions{}); !errors.As(err, &partial) {
+		t.Fatalf("expected the incomplete file to make the restore partial, got %v", err)
+	}
+	restored, _ := os.ReadFile(filepath.Join(tmpRestore, "large.dat"))
+	if string(restored) != "old" {
+		t.Errorf("expected the earlier complete version, got %d bytes", len(restored))
 	}
 }
 
@@ -206,7 +278,7 @@ func TestCreateBackup_DeletedEntries(t *testing.T) {
 		},
 	}
 
-	err := createBackup(tmpDir, entries)
+	err := createBackup(tmpDir, entries, backupOptions{})
 	if err != nil {
 		t.Fatalf("createBackup() error = %v", err)
 	}
@@ -301,12 +373,12 @@ func TestCreateBackup_ChunkNumbering(t *testing.T) {
 
 	// Create entries that will span multiple chunks
 	entries := []*FileEntry{
-		{Path: "1.dat", Content: make([]byte, 4*1024*1024)},
-		{Path: "2.dat", Content: make([]byte, 4*1024*1024)},
-		{Path: "3.dat", Content: make([]byte, 4*1024*1024)},
+		{Path: "1.dat", Content: distinctContent(1, 4*1024*1024)},
+		{Path: "2.dat", Content: distinctContent(2, 4*1024*1024)},
+		{Path: "3.dat", Content: distinctContent(3, 4*1024*1024)},
 	}
 
-	err := createBackup(tmpDir, entries)
+	err := createBackup(tmpDir, entries, backupOptions{})
 	if err != nil {
 		t.Fatalf("createBackup() error = %v", err)
 	}
@@ -330,6 +402,73 @@ func TestCreateBackup_ChunkNumbering(t *testing.T) {
 	}
 }
 
+func TestCreateBackup_SortsEntriesByPath(t *testing.T) {
+	var entries []*FileEntry
+	for i := range 50 {
+		entries = append(entries, &FileEntry{Path: fmt.Sprintf("dir%d/file%02d.txt", i%3, i), Content: []byte{byte(i)}})
+	}
+	entries = append(entries, &FileEntry{Path: "removed.txt", Deleted: true})
+	rand.New(rand.NewSource(1)).Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+
+	var runs [][]byte
+	for range 2 {
+		tmpDir := t.TempDir()
+		if err := createBackup(tmpDir, entries, backupOptions{}); err != nil {
+			t.Fatalf("createBackup() error = %v", err)
+		}
+		files, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
+		if len(files) != 1 {
+			t.Fatalf("expected 1 chunk, got %d", len(files))
+		}
+		chunk, err := readChunk(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.IsSortedFunc(chunk.Entries, func(a, b *FileEntry) int { return strings.Compare(a.Path, b.Path) }) {
+			t.Error("expected chunk entries sorted by path")
+		}
+		data, _ := os.ReadFile(files[0])
+		runs = append(runs, data)
+	}
+	if !bytes.Equal(runs[0], runs[1]) {
+		t.Error("expected identical input to produce identical chunks")
+	}
+}
+
+func TestCreateBackup_ChunksFillCloseToTarget(t *testing.T) {
+	var entries []*FileEntry
+	for i := range 30000 {
+		// Path lengths vary from a few bytes to a few hundred
+		path := fmt.Sprintf("%s/file%05d.txt", strings.Repeat("d", i%300), i)
+		entries = append(entries, &FileEntry{Path: path, Mode: 0644, ModTime: time.Now(), Content: distinctContent(i, 200)})
+	}
+
+	for name, format := range chunkFormatNames {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := createBackup(tmpDir, entries, backupOptions{format: format}); err != nil {
+				t.Fatal(err)
+			}
+			files, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
+			if len(files) < 2 {
+				t.Fatalf("expected several chunks, got %d", len(files))
+			}
+			// Every chunk but the last should be full to within a few percent
+			for _, file := range files[:len(files)-1] {
+				info, err := os.Stat(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fill := float64(info.Size()) / chunkSize; fill < 0.95 || fill > 1.01 {
+					t.Errorf("%s is %d bytes, %.0f%% of the target", filepath.Base(file), info.Size(), fill*100)
+				}
+			}
+		})
+	}
+}
+
 func TestCreateBackup_ManySmallFiles(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -342,7 +481,7 @@ func TestCreateBackup_ManySmallFiles(t *testing.T) {
 		})
 	}
 
-	err := createBackup(tmpDir, entries)
+	err := createBackup(tmpDir, entries, backupOptions{})
 	if err != nil {
 		t.Fatalf("createBackup() error = %v", err)
 	}
@@ -374,7 +513,7 @@ func TestCreateBackup_MixedSizes(t *testing.T) {
 		{Path: "another.txt", Content: []byte("more")},           // tiny
 	}
 
-	err := createBackup(tmpDir, entries)
+	err := createBackup(tmpDir, entries, backupOptions{})
 	if err != nil {
 		t.Fatalf("createBackup() error = %v", err)
 	}
@@ -388,6 +527,7 @@ func TestCreateBackup_MixedSizes(t *testing.T) {
 
 	// Verify all entries are preserved
 	totalEntries := 0
+	largeBytes := 0
 	foundLarge := false
 	for _, file := range files {
 		chunk, err := readChunk(file)
@@ -399,15 +539,17 @@ func TestCreateBackup_MixedSizes(t *testing.T) {
 		for _, entry := range chunk.Entries {
 			if entry.Path == "large.dat" {
 				foundLarge = true
-				if len(entry.Content) != 8*1024*1024 {
-					t.Error("large file content size mismatch")
-				}
+				largeBytes += len(entry.Content)
 			}
 		}
 	}
 
-	if totalEntries != 4 {
-		t.Errorf("expected 4 total entries, got %d", totalEntries)
+	// The large file is split into two parts
+	if totalEntries != 5 {
+		t.Errorf("expected 5 total entries, got %d", totalEntries)
+	}
+	if largeBytes != 8*1024*1024 {
+		t.Errorf("large file content size mismatch: %d", largeBytes)
 	}
 	if !foundLarge {
 		t.Error("large file not found in chunks")
@@ -447,3 +589,594 @@ func TestReadChunk_CorruptedFile(t *testing.T) {
 		t.Error("expected error reading corrupted file, got nil")
 	}
 }
+
+func TestWriteChunk_WritesVersionHeader(t *testing.T) {
+	tmpDir := t.TempDir()
+	chunk := Chunk{Entries: []*FileEntry{{Path: "a.txt", Content: []byte("a")}}}
+
+	if err := writeChunk(tmpDir, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tmpDir, "chunk_1000_000.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), chunkMagic) || data[len(chunkMagic)] != chunkVersion {
+		t.Errorf("chunk does not start with the version header: %q", data[:len(chunkMagic)+1])
+	}
+}
+
+func TestReadChunk_UnsupportedVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "chunk_1000_000.dat")
+
+	data := append([]byte(chunkMagic), chunkVersion+1)
+	data = append(data, []byte("future payload")...)
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := readChunk(file)
+	if !errors.Is(err, ErrUnsupportedChunkVersion) {
+		t.Errorf("expected ErrUnsupportedChunkVersion, got %v", err)
+	}
+}
+
+func TestReadChunk_LegacyChunkWithoutHeader(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "chunk_1000_000.dat")
+
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := Chunk{Entries: []*FileEntry{{Path: "old.txt", Content: []byte("old")}}}
+	if err := gob.NewEncoder(f).Encode(chunk); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	got, err := readChunk(file)
+	if err != nil {
+		t.Fatalf("readChunk() error = %v", err)
+	}
+	if len(got.Entries) != 1 || got.Entries[0].Path != "old.txt" {
+		t.Errorf("legacy chunk not decoded correctly: %+v", got)
+	}
+}
+
+func TestCreateBackupStream_BoundsInFlightBytes(t *testing.T) {
+	tmpDir := t.TempDir()
+	const (
+		fileSize = 1024 * 1024
+		files    = 40
+		limit    = 4 * fileSize
+	)
+	budget := newByteBudget(limit)
+
+	// Content is only allocated once budget has been acquired, mirroring
+	// how the scan reads files
+	entries := make(chan *FileEntry)
+	go func() {
+		defer close(entries)
+		for i := range files {
+			budget.acquire(fileSize)
+			entries <- &FileEntry{
+				Path:    fmt.Sprintf("file_%02d.dat", i),
+				Size:    fileSize,
+				Content: distinctContent(i, fileSize),
+			}
+		}
+	}()
+
+	timestamp, err := createBackupStream(tmpDir, entries, backupOptions{budget: budget})
+	if err != nil {
+		t.Fatalf("createBackupStream() error = %v", err)
+	}
+	if timestamp == 0 {
+		t.Fatal("expected a run timestamp")
+	}
+
+	if budget.peak > limit {
+		t.Errorf("peak in-flight bytes %d exceeded budget %d", budget.peak, limit)
+	}
+	if budget.used != 0 {
+		t.Errorf("expected all budget released, %d bytes still held", budget.used)
+	}
+
+	chunks, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
+	totalEntries := 0
+	for i, file := range chunks {
+		chunk, err := readChunk(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		totalEntries += len(chunk.Entries)
+		if chunk.Final != (i == len(chunks)-1) {
+			t.Errorf("chunk %d: Final = %v", i, chunk.Final)
+		}
+	}
+	if totalEntries != files {
+		t.Errorf("expected %d entries, got %d", files, totalEntries)
+	}
+}
+
+func TestCreateBackupStream_CommitErrorRemovesRun(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	entries := make(chan *FileEntry)
+	go func() {
+		defer close(entries)
+		for i := range 3 {
+			entries <- &FileEntry{Path: fmt.Sprintf("%d.dat", i), Content: distinctContent(i, 4*1024*1024)}
+		}
+	}()
+
+	scanErr := errors.New("walk failed")
+	_, err := createBackupStream(tmpDir, entries, backupOptions{commit: func() error { return scanErr }})
+	if !errors.Is(err, scanErr) {
+		t.Fatalf("expected commit error, got %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
+	if len(files) != 0 {
+		t.Errorf("expected aborted run to leave no chunks, got %d", len(files))
+	}
+}
+
+func TestCreateBackup_MaxChunksAbortsRun(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var entries []*FileEntry
+	for i := range 3 {
+		entries = append(entries, &FileEntry{Path: fmt.Sprintf("%d.dat", i), Content: distinctContent(i, 4*1024*1024)})
+	}
+
+	err := createBackup(tmpDir, entries, backupOptions{maxChunks: 2})
+	if !errors.Is(err, ErrChunkLimitExceeded) {
+		t.Fatalf("expected ErrChunkLimitExceeded, got %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
+	if len(files) != 0 {
+		t.Errorf("expected aborted run to leave no chunks, got %d", len(files))
+	}
+}
+
+func TestCreateBackup_MaxChunksAllowsRunAtLimit(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var entries []*FileEntry
+	for i := range 3 {
+		entries = append(entries, &FileEntry{Path: fmt.Sprintf("%d.dat", i), Content: distinctContent(i, 4*1024*1024)})
+	}
+
+	if err := createBackup(tmpDir, entries, backupOptions{maxChunks: 3}); err != nil {
+		t.Fatalf("createBackup() error = %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
+	if len(files) != 3 {
+		t.Errorf("expected 3 chunks, got %d", len(files))
+	}
+}
+
+func TestReadChunk_ChecksumMismatch(t *testing.T) {
+	tmpDir := t.TempDir()
+	chunk := Chunk{Entries: []*FileEntry{{Path: "a.txt", Content: []byte("original content")}}}
+	if err := writeChunk(tmpDir, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(tmpDir, "chunk_1000_000.dat")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte of the file content, which gob alone would not notice
+	i := strings.Index(string(data), "original")
+	data[i] = 'O'
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readChunk(file); !errors.Is(err, ErrChunkChecksum) {
+		t.Errorf("expected ErrChunkChecksum, got %v", err)
+	}
+}
+
+func TestReadChunk_Version1WithoutChecksum(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "chunk_1000_000.dat")
+
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(append([]byte(chunkMagic), 1))
+	chunk := Chunk{Entries: []*FileEntry{{Path: "v1.txt", Content: []byte("v1")}}}
+	if err := gob.NewEncoder(f).Encode(chunk); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	got, err := readChunk(file)
+	if err != nil {
+		t.Fatalf("readChunk() error = %v", err)
+	}
+	if len(got.Entries) != 1 || got.Entries[0].Path != "v1.txt" {
+		t.Errorf("version 1 chunk not decoded correctly: %+v", got)
+	}
+}
+
+func TestBackupOnce_StoresContentHash(t *testing.T) {
+	for name, format := range chunkFormatNames {
+		t.Run(name, func(t *testing.T) {
+			tmpWatch := t.TempDir()
+			tmpBackup := t.TempDir()
+			content := map[string]string{"a.txt": "alpha", "sub/b.txt": "beta", "copy.txt": "alpha"}
+			for path, data := range content {
+				full := filepath.Join(tmpWatch, path)
+				if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(full, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, format: format}); err != nil {
+				t.Fatal(err)
+			}
+
+			files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+			hashed := 0
+			for _, file := range files {
+				chunk, err := readChunk(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, entry := range chunk.Entries {
+					data, ok := content[entry.Path]
+					if !ok {
+						continue
+					}
+					// A duplicate names the stored copy's hash instead
+					hash := cmp.Or(entry.ContentHash, entry.ContentRef)
+					if want := hashContent([]byte(data)); hash != want {
+						t.Errorf("%s: stored hash %q, want %q", entry.Path, hash, want)
+					}
+					if entry.ContentHash != "" && entry.ContentHash != hashContent(entry.Content) {
+						t.Errorf("%s: stored hash does not match the stored content", entry.Path)
+					}
+					hashed++
+				}
+			}
+			if hashed != len(content) {
+				t.Errorf("expected %d hashed entries, got %d", len(content), hashed)
+			}
+		})
+	}
+}
+
+func TestRestore_ChunkWithoutContentHash(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "legacy.txt", Mode: 0644, Content: []byte("old format")},
+	}})
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(tmpRestore, "legacy.txt")); string(got) != "old format" {
+		t.Errorf("expected legacy.txt restored, got %q", got)
+	}
+}
+
+func TestCreateBackup_DeduplicatesIdenticalContent(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := bytes.Repeat([]byte("fixture"), 1000)
+
+	entries := []*FileEntry{
+		{Path: "a/fixture.bin", Mode: 0644, Content: content},
+		{Path: "b/fixture.bin", Mode: 0644, Content: bytes.Clone(content)},
+		{Path: "unique.txt", Mode: 0644, Content: []byte("unique")},
+		{Path: "c/fixture.bin", Mode: 0600, Content: bytes.Clone(content)},
+	}
+	if err := createBackup(tmpDir, entries, backupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 chunk, got %d", len(files))
+	}
+	chunk, err := readChunk(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, refs := 0, 0
+	for _, entry := range chunk.Entries {
+		if bytes.Equal(entry.Content, content) {
+			stored++
+		}
+		if entry.ContentRef != "" {
+			refs++
+			if entry.Content != nil {
+				t.Errorf("%s references shared content but also stores it", entry.Path)
+			}
+		}
+	}
+	if stored != 1 || refs != 2 {
+		t.Errorf("expected the content stored once with 2 references, got %d stored and %d references", stored, refs)
+	}
+
+	data, _ := os.ReadFile(files[0])
+	if n := bytes.Count(data, content); n != 1 {
+		t.Errorf("expected the content to appear once in the chunk file, found %d copies", n)
+	}
+
+	tmpRestore := t.TempDir()
+	if err := restore(tmpDir, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/fixture.bin", "b/fixture.bin", "c/fixture.bin"} {
+		restored, err := os.ReadFile(filepath.Join(tmpRestore, filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(restored, content) {
+			t.Errorf("%s not restored from the shared content (%v)", name, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(tmpRestore, "c", "fixture.bin")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("duplicate should keep its own metadata, got %v (%v)", info.Mode(), err)
+	}
+}
+
+func TestCreateBackup_ClockGoingBackward(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	originalClock := clock
+	defer func() { clock = originalClock }()
+
+	runs := []struct {
+		at      int64
+		content string
+	}{
+		{5000, "first"},
+		{3000, "second"}, // clock stepped back
+		{3000, "third"},  // and still behind, in the same second
+	}
+	for _, run := range runs {
+		clock = func() time.Time { return time.Unix(run.at, 0) }
+		entries := []*FileEntry{{Path: "file.txt", Mode: 0644, Content: []byte(run.content)}}
+		if err := createBackup(tmpBackup, entries, backupOptions{}); err != nil {
+			t.Fatalf("createBackup() error = %v", err)
+		}
+	}
+
+	files, err := listChunks(tmpBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timestamps []int64
+	for _, file := range files {
+		ts, _, _ := parseChunkName(filepath.Base(file))
+		timestamps = append(timestamps, ts)
+	}
+	if want := []int64{5000, 5001, 5002}; !slices.Equal(timestamps, want) {
+		t.Errorf("run timestamps = %v, want %v", timestamps, want)
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(tmpRestore, "file.txt")); string(got) != "third" {
+		t.Errorf("restored %q, want the last run's content %q", got, "third")
+	}
+}
+
+func objectNames(t *testing.T, backupPath string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(backupPath, objectsDir, "*.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+	return names
+}
+
+func TestCreateBackup_ContentAddressed(t *testing.T) {
+	originalClock := clock
+	defer func() { clock = originalClock }()
+
+	entries := []*FileEntry{
+		{Path: "a.txt", Mode: 0644, Content: []byte("alpha"), ModTime: time.Unix(100, 0)},
+		{Path: "big.bin", Mode: 0644, Content: distinctContent(1, maxPartSize+1000), ModTime: time.Unix(100, 0)},
+	}
+	opts := backupOptions{contentAddressed: true}
+
+	backupA := t.TempDir()
+	backupB := t.TempDir()
+	clock = func() time.Time { return time.Unix(1000, 0) }
+	if err := createBackup(backupA, entries, opts); err != nil {
+		t.Fatalf("createBackup() error = %v", err)
+	}
+	clock = func() time.Time { return time.Unix(2000, 0) }
+	if err := createBackup(backupB, entries, opts); err != nil {
+		t.Fatalf("createBackup() error = %v", err)
+	}
+
+	namesA, namesB := objectNames(t, backupA), objectNames(t, backupB)
+	if len(namesA) < 2 || !slices.Equal(namesA, namesB) {
+		t.Errorf("expected identical backups to produce the same objects, got %v and %v", namesA, namesB)
+	}
+	if files, _ := filepath.Glob(filepath.Join(backupA, "chunk_*.dat")); len(files) != 0 {
+		t.Errorf("expected no timestamp-named chunks, got %v", files)
+	}
+
+	// Repeating the run in the same backup stores nothing new
+	clock = func() time.Time { return time.Unix(3000, 0) }
+	if err := createBackup(backupA, entries, opts); err != nil {
+		t.Fatalf("createBackup() error = %v", err)
+	}
+	if names := objectNames(t, backupA); !slices.Equal(names, namesA) {
+		t.Errorf("expected the repeated run to reuse its objects, got %v", names)
+	}
+	if indexes, _ := filepath.Glob(filepath.Join(backupA, indexPrefix+"*")); len(indexes) != 2 {
+		t.Errorf("expected an index per run, got %v", indexes)
+	}
+
+	tmpRestore := t.TempDir()
+	if err := restore(backupA, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	for _, entry := range entries {
+		got, err := os.ReadFile(filepath.Join(tmpRestore, entry.Path))
+		if err != nil || !bytes.Equal(got, entry.Content) {
+			t.Errorf("%s: restored %d bytes (%v), want %d", entry.Path, len(got), err, len(entry.Content))
+		}
+	}
+}
+
+func TestCreateBackup_ContentAddressedRunOrder(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	originalClock := clock
+	defer func() { clock = originalClock }()
+
+	// The first and last runs have identical chunks, so replay order has
+	// to come from the index rather than the objects
+	runs := []string{"v1", "v2", "v1"}
+	for i, content := range runs {
+		clock = func() time.Time { return time.Unix(int64(1000*(i+1)), 0) }
+		entries := []*FileEntry{{Path: "file.txt", Mode: 0644, Content: []byte(content), ModTime: time.Unix(100, 0)}}
+		if err := createBackup(tmpBackup, entries, backupOptions{contentAddressed: true}); err != nil {
+			t.Fatalf("createBackup() error = %v", err)
+		}
+	}
+	if names := objectNames(t, tmpBackup); len(names) != 2 {
+		t.Errorf("expected 2 distinct objects, got %v", names)
+	}
+
+	files, err := listChunks(tmpBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, file := range files {
+		got = append(got, filepath.Base(file))
+	}
+	want := []string{"chunk_1000_000.dat", "chunk_2000_000.dat", "chunk_3000_000.dat"}
+	if !slices.Equal(got, want) {
+		t.Errorf("listChunks() = %v, want %v", got, want)
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(tmpRestore, "file.txt")); string(content) != "v1" {
+		t.Errorf("restored %q, want the last run's %q", content, "v1")
+	}
+}
+
+func TestCreateBackup_ChunkFsync(t *testing.T) {
+	tests := []struct {
+		mode     fsyncMode
+		wantFile bool
+		wantDir  bool
+	}{
+		{fsyncAlways, true, true},
+		{fsyncDir, false, true},
+		{fsyncNone, false, false},
+	}
+	t.Cleanup(func() { syncFile = (*os.File).Sync })
+
+	for _, tt := range tests {
+		for _, contentAddressed := range []bool{false, true} {
+			tmpDir := t.TempDir()
+			var synced []string
+			syncFile = func(f *os.File) error {
+				synced = append(synced, f.Name())
+				return nil
+			}
+
+			entries := []*FileEntry{{Path: "a.txt", Mode: 0644, Content: []byte("a")}}
+			if err := createBackup(tmpDir, entries, backupOptions{fsync: tt.mode, contentAddressed: contentAddressed}); err != nil {
+				t.Fatalf("createBackup() error = %v", err)
+			}
+
+			var files, dirs int
+			for _, name := range synced {
+				if info, err := os.Stat(name); err == nil && info.IsDir() {
+					dirs++
+				} else {
+					files++
+				}
+			}
+			if got := files > 0; got != tt.wantFile {
+				t.Errorf("mode %v, content-addressed %v: synced files %v, want file synced = %v", tt.mode, contentAddressed, synced, tt.wantFile)
+			}
+			if got := dirs > 0; runtime.GOOS != "windows" && got != tt.wantDir {
+				t.Errorf("mode %v, content-addressed %v: synced %v, want directory synced = %v", tt.mode, contentAddressed, synced, tt.wantDir)
+			}
+		}
+	}
+}
+
+func TestParseFsyncMode(t *testing.T) {
+	for name, want := range fsyncModeNames {
+		if got, err := parseFsyncMode(name); err != nil || got != want {
+			t.Errorf("parseFsyncMode(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := parseFsyncMode("sometimes"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
+
+func TestCreateBackup_EntriesPerChunk(t *testing.T) {
+	tmpBackup := t.TempDir()
+	var entries []*FileEntry
+	for i := range 95 {
+		entries = append(entries, &FileEntry{Path: fmt.Sprintf("f%03d.txt", i), Mode: 0644, Content: []byte{byte(i)}})
+	}
+	if err := createBackup(tmpBackup, entries, backupOptions{maxEntries: 10}); err != nil {
+		t.Fatalf("createBackup() error = %v", err)
+	}
+
+	files, err := chunkFiles(tmpBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 10 {
+		t.Fatalf("expected 95 entries to split into 10 chunks, got %d", len(files))
+	}
+	for i, file := range files {
+		chunk, err := readChunk(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 10
+		if i == len(files)-1 {
+			want = 5
+		}
+		if len(chunk.Entries) != want {
+			t.Errorf("chunk %d holds %d entries, want %d", i, len(chunk.Entries), want)
+		}
+	}
+
+	tmpRestore := t.TempDir()
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := os.ReadDir(tmpRestore)
+	if len(restored) != len(entries) {
+		t.Errorf("restored %d files, want %d", len(restored), len(entries))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+type scanBench struct {
+	files int
+	dirs  int
+	bytes int64
+	// chunks is how many chunks a full backup of the tree would write.
+	chunks int
+	// scan is the time the walk took, reading and hashing every file;
+	// encode is the time spent serializing the chunks, measured without
+	// writing them anywhere.
+	scan   time.Duration
+	encode time.Duration
+}
+
+// benchScan walks watchPath the way the first backup would, timing the
+// scan and the chunk encoding but writing nothing, to estimate what an
+// initial backup of the tree costs.
+func benchScan(watchPath string, opts scanOptions, format chunkFormat) (scanBench, error) {
+	var bench scanBench
+	opts.captureDirs = true
+	entries := make(chan *FileEntry)
+	var scanErr error
+	start := clock()
+	go func() {
+		_, scanErr = scanTree(watchPath, newFileSnapshot(nil), opts, entries)
+		bench.scan = clock().Sub(start)
+		close(entries)
+	}()
+
+	chunk := Chunk{Full: true, format: format}
+	size := 0
+	var encodeErr error
+	flush := func() {
+		encodeStart := clock()
+		if err := encodeChunk(io.Discard, chunk); err != nil && encodeErr == nil {
+			encodeErr = err
+		}
+		bench.encode += clock().Sub(encodeStart)
+		bench.chunks++
+		chunk = Chunk{Full: true, format: format}
+		size = 0
+	}
+	for entry := range entries {
+		if entry.Mode.IsDir() {
+			bench.dirs++
+		} else {
+			bench.files++
+			bench.bytes += entry.Size
+		}
+		for _, part := range splitEntry(entry, format) {
+			entrySize := encodedEntrySize(part, format)
+			if size+entrySize > chunkSize && len(chunk.Entries) > 0 {
+				flush()
+			}
+			chunk.Entries = append(chunk.Entries, part)
+			size += entrySize
+		}
+	}
+	if scanErr != nil {
+		return scanBench{}, scanErr
+	}
+	// Like a real full run, an empty tree still writes one chunk
+	flush()
+	if encodeErr != nil {
+		return scanBench{}, encodeErr
+	}
+	return bench, nil
+}
+
+func printScanBench(w io.Writer, bench scanBench) {
+	fmt.Fprintf(w, "Files:        %d (%d bytes)\n", bench.files, bench.bytes)
+	fmt.Fprintf(w, "Directories:  %d\n", bench.dirs)
+	fmt.Fprintf(w, "Scan:         %s", bench.scan.Round(time.Millisecond))
+	if seconds := bench.scan.Seconds(); seconds > 0 {
+		fmt.Fprintf(w, " (%d bytes/s read and hashed)", int64(float64(bench.bytes)/seconds))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Estimate:     %d chunks, %s for the initial backup before the chunks are written to storage\n",
+		bench.chunks, (bench.scan + bench.encode).Round(time.Millisecond))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBenchScan_CountsTree(t *testing.T) {
+	tmpWatch := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpWatch, "sub", "deeper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]int{
+		"a.txt":                 10,
+		"sub/b.bin":             chunkSize + 100,
+		"sub/deeper/c.txt":      16,
+		"sub/deeper/.hidden.db": 2048,
+	}
+	var want int64
+	for i, name := range []string{"a.txt", "sub/b.bin", "sub/deeper/c.txt", "sub/deeper/.hidden.db"} {
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), distinctContent(i, files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want += int64(files[name])
+	}
+
+	bench, err := benchScan(tmpWatch, scanOptions{}, formatGob)
+	if err != nil {
+		t.Fatalf("benchScan() error = %v", err)
+	}
+	if bench.files != len(files) || bench.bytes != want {
+		t.Errorf("got %d files of %d bytes, want %d files of %d bytes", bench.files, bench.bytes, len(files), want)
+	}
+	if bench.dirs != 2 {
+		t.Errorf("got %d directories, want 2", bench.dirs)
+	}
+
+	// The estimate matches what a full backup of the tree really writes
+	tmpBackup := t.TempDir()
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, fullEvery: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if written, _ := chunkFiles(tmpBackup); bench.chunks != len(written) {
+		t.Errorf("estimated %d chunks, a full backup wrote %d", bench.chunks, len(written))
+	}
+}
+
+func TestRun_DryScanWritesNothing(t *testing.T) {
+	tmpWatch := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadDir(tmpWatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if code := run([]string{"scan-bench", "--watch", tmpWatch}, &out); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	if !strings.Contains(out.String(), "Files:        1 (5 bytes)") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if after, _ := os.ReadDir(tmpWatch); len(after) != len(before) {
+		t.Errorf("dry scan changed the watched tree: %d entries, want %d", len(after), len(before))
+	}
+	if code := run([]string{"--dry-scan"}, io.Discard); code != exitUsage {
+		t.Errorf("--dry-scan without --watch: exit code %d, want %d", code, exitUsage)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func fileBirthTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Birthtimespec.Unix())
+	}
+	return time.Time{}
+}
+
+// applyBirthTime relies on macOS moving a file's birth time back whenever
+// its modtime is set earlier than it. Restore sets the real modtime
+// afterwards, so a file modified before it was created (e.g. copied with
+// its modtime kept) ends up born at its modtime instead.
+func applyBirthTime(path string, birth time.Time) error {
+	return os.Chtimes(path, birth, birth)
+}
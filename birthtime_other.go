@@ -0,0 +1,18 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Creation time is not portably available elsewhere, so it is left out of
+// backups and ignored on restore.
+func fileBirthTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
+
+func applyBirthTime(path string, birth time.Time) error {
+	return nil
+}
@@ -0,0 +1,56 @@
+//go:build darwin || windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRestore_PreservesBirthTime(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	source := filepath.Join(tmpWatch, "report.txt")
+	if err := os.WriteFile(source, []byte("quarterly"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The modtime is set later than the creation time, as if the file was
+	// edited after it was created
+	born := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := applyBirthTime(source, born); err != nil {
+		t.Fatalf("applyBirthTime() error = %v", err)
+	}
+	modified := born.Add(48 * time.Hour)
+	if err := os.Chtimes(source, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fileBirthTime(info); !got.Equal(born) {
+		t.Skipf("filesystem does not keep creation times: set %v, got %v", born, got)
+	}
+
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err = os.Stat(filepath.Join(tmpRestore, "report.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fileBirthTime(info); !got.Equal(born) {
+		t.Errorf("expected creation time %v, got %v", born, got)
+	}
+	if !info.ModTime().Equal(modified) {
+		t.Errorf("expected modtime %v, got %v", modified, info.ModTime())
+	}
+}
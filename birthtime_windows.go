@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func fileBirthTime(info os.FileInfo) time.Time {
+	if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, data.CreationTime.Nanoseconds())
+	}
+	return time.Time{}
+}
+
+// applyBirthTime sets only the creation time, leaving the access and write
+// times to Chtimes.
+func applyBirthTime(path string, birth time.Time) error {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	handle, err := syscall.CreateFile(name, syscall.FILE_WRITE_ATTRIBUTES,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+	created := syscall.NsecToFiletime(birth.UnixNano())
+	return syscall.SetFileTime(handle, &created, nil, nil)
+}
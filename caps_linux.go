@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// File capabilities (setcap) are stored in an extended attribute, kept raw
+// like ACLs.
+const capabilityXattr = "security.capability"
+
+// setxattr is swapped out by tests to simulate running without privilege.
+var setxattr = syscall.Setxattr
+
+func readCapability(path string) ([]byte, error) {
+	return readXattr(path, capabilityXattr)
+}
+
+func applyCapability(path string, capability []byte) error {
+	err := setxattr(path, capabilityXattr, capability, 0)
+	if errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("%w: restoring file capabilities requires CAP_SETFCAP, e.g. running as root", err)
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// testCapability encodes cap_net_raw+ep in the kernel's vfs_cap_data
+// revision 2 format.
+func testCapability() []byte {
+	const capNetRaw = 13
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint32{
+		0x02000000 | 1,    // revision 2, effective
+		1 << capNetRaw, 0, // permitted, inheritable (low 32 capabilities)
+		0, 0, // high 32 capabilities
+	})
+	return buf.Bytes()
+}
+
+func TestBackupRestore_PreservesCapability(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	source := filepath.Join(tmpWatch, "ping")
+	if err := os.WriteFile(source, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := applyCapability(source, testCapability())
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skip("filesystem does not support file capabilities")
+	}
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting file capabilities requires CAP_SETFCAP")
+	}
+	if err != nil {
+		t.Fatalf("applyCapability() error = %v", err)
+	}
+	want, err := readCapability(source)
+	if err != nil || len(want) == 0 {
+		t.Fatalf("readCapability() = %x, %v", want, err)
+	}
+
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readCapability(filepath.Join(tmpRestore, "ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("capability not preserved:\nwant %x\ngot  %x", want, got)
+	}
+}
+
+func TestRestore_CapabilityWithoutPrivilegeWarns(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "ping", Mode: 0755, Content: []byte("#!/bin/sh\n"), Capability: testCapability()},
+	}})
+
+	original := setxattr
+	setxattr = func(string, string, []byte, int) error { return syscall.EPERM }
+	defer func() { setxattr = original }()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(tmpRestore, "ping")); string(got) != "#!/bin/sh\n" {
+		t.Errorf("expected the file restored without its capability, got %q", got)
+	}
+	if !strings.Contains(logs.String(), "could not restore file capabilities for ping") ||
+		!strings.Contains(logs.String(), "CAP_SETFCAP") {
+		t.Errorf("expected a warning naming CAP_SETFCAP:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func readCapability(path string) ([]byte, error) {
+	return nil, nil
+}
+
+func applyCapability(path string, capability []byte) error {
+	return errors.New("file capabilities are not supported on this platform")
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// command is a subcommand of the CLI. Each one selects a mode of the
+// single flag set run parses: it accepts only the flags that mode uses,
+// checks the ones it needs, and sets the mode flags it stands for.
+type command struct {
+	name    string
+	summary string
+	usage   string
+	// flags lists the flags the command accepts, besides commonFlags.
+	flags []string
+	// required lists flags that must be set; a group of several is
+	// satisfied by any one of them.
+	required [][]string
+	// implies sets mode flags, by name, before the mode is dispatched.
+	implies map[string]string
+}
+
+// commonFlags are accepted by every command.
+var commonFlags = []string{"cpuprofile", "trace", "pid-file"}
+
+var scanFlags = []string{
+	"watch", "dereference-root", "exclude", "exclude-from", "ignore-case-glob",
+	"exclude-older-than", "exclude-newer-than", "fail-on-skip", "max-scan-duration",
+	"fast-scan", "growing-files", "backup-metadata-only", "hash-cache",
+	"no-delete", "max-delete-ratio", "confirm-mass-delete", "parallel-walk",
+	"hash-buffer-size",
+}
+
+var writeFlags = []string{
+	"backup", "write-policy", "snapshot-file", "full-every", "max-chunks-per-run",
+	"pre-backup-hook", "post-backup-hook", "hook-timeout", "inflight-budget",
+	"backup-if-idle", "verify-snapshot", "checksum-manifest", "deletion-log",
+	"format", "content-addressed", "chunk-fsync", "entries-per-chunk", "source-label",
+}
+
+var commands = []command{
+	{
+		name:     "backup",
+		summary:  "Back up --watch once and exit.",
+		usage:    "backup --watch <path> --backup <path> [--snapshot-file <path>]",
+		flags:    slices.Concat(scanFlags, writeFlags),
+		required: [][]string{{"watch"}, {"backup"}},
+		implies:  map[string]string{"backup-now": "true"},
+	},
+	{
+		name:    "watch",
+		summary: "Back up --watch every --refresh interval until interrupted.",
+		usage:   "watch --watch <path> --backup <path> [--refresh <seconds>]",
+		flags: slices.Concat(scanFlags, writeFlags, []string{
+			"refresh", "interval-jitter", "max-error-backoff", "health-addr", "health-max-age",
+			"verify-sample", "mirror",
+		}),
+		required: [][]string{{"watch"}, {"backup"}},
+	},
+	{
+		name:     "scan-bench",
+		summary:  "Walk and hash --watch without writing anything, estimating an initial backup.",
+		usage:    "scan-bench --watch <path>",
+		flags:    slices.Concat(scanFlags, []string{"format"}),
+		required: [][]string{{"watch"}},
+		implies:  map[string]string{"dry-scan": "true"},
+	},
+	{
+		name:    "restore",
+		summary: "Restore the latest state of --backup into --restore, or onto --base.",
+		usage:   "restore --restore <path> --backup <path> [--strip-prefix <prefix>] [--add-prefix <prefix>]",
+		flags: []string{
+			"backup", "restore", "base", "remove-extras", "strip-prefix", "add-prefix",
+			"modified-after", "simulate-restore", "force-overwrite", "exec-bit-only", "temp-dir",
+			"trace-path", "backup-empty-content-as-delete", "restore-exclude", "preserve-target-newer",
+			"ignore-case-glob", "transform", "transform-match", "hook-timeout", "expect-source",
+		},
+		required: [][]string{{"restore", "base"}, {"backup"}},
+	},
+	{
+		name:     "list",
+		summary:  "List the runs in --backup, or with --list-versions every version of one path.",
+		usage:    "list --backup <path> [--filter-deleted] [--follow] [--list-versions <path> [--json]]",
+		flags:    []string{"backup", "filter-deleted", "follow", "list-versions", "json"},
+		required: [][]string{{"backup"}},
+		implies:  map[string]string{"list": "true"},
+	},
+	{
+		name:     "verify",
+		summary:  "Check every chunk in --backup against its checksum.",
+		usage:    "verify --backup <path> [--mirror <path>]",
+		flags:    []string{"backup", "mirror"},
+		required: [][]string{{"backup"}},
+		implies:  map[string]string{"verify": "true"},
+	},
+	{
+		name:     "prune",
+		summary:  "Drop the oldest runs of --backup beyond --max-total-size, or tombstones past their retention.",
+		usage:    "prune --backup <path> (--max-total-size <size> [--prune-dry-run] | --purge-tombstones [--tombstone-retention <duration>])",
+		flags:    []string{"backup", "max-total-size", "prune-dry-run", "purge-tombstones", "tombstone-retention"},
+		required: [][]string{{"backup"}, {"max-total-size", "purge-tombstones"}},
+	},
+}
+
+func findCommand(name string) (*command, bool) {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i], true
+		}
+	}
+	return nil, false
+}
+
+func commandNames() []string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+	return names
+}
+
+func (c *command) accepts(name string) bool {
+	return slices.Contains(c.flags, name) || slices.Contains(commonFlags, name)
+}
+
+// apply checks the flags parsed into fs against the command and sets the
+// mode flags it implies.
+func (c *command) apply(fs *flag.FlagSet) error {
+	var invalid []string
+	fs.Visit(func(f *flag.Flag) {
+		if !c.accepts(f.Name) {
+			invalid = append(invalid, "--"+f.Name)
+		}
+	})
+	if len(invalid) > 0 {
+		return fmt.Errorf("%s cannot be used with %s", strings.Join(invalid, ", "), c.name)
+	}
+
+	for _, group := range c.required {
+		set := slices.ContainsFunc(group, func(name string) bool {
+			f := fs.Lookup(name)
+			return f.Value.String() != "" && f.Value.String() != "false"
+		})
+		if !set {
+			return fmt.Errorf("%s requires --%s", c.name, strings.Join(group, " or --"))
+		}
+	}
+
+	for name, value := range c.implies {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printUsage describes the command and the flags it accepts.
+func (c *command) printUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "%s\n\nUsage:\n  ./app %s\n\nFlags:\n", c.summary, c.usage)
+	accepted := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	accepted.SetOutput(w)
+	fs.VisitAll(func(f *flag.Flag) {
+		if c.accepts(f.Name) {
+			accepted.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	accepted.PrintDefaults()
+}
+
+// printCommands lists the commands, for the top-level usage.
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "Usage:\n  ./app <command> [flags]\n\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w, "\nRun ./app <command> -h for the flags of a command. Other modes are still selected by flags:")
+}
+
+// legacyCommand returns the command a flags-only invocation corresponds
+// to, following the order run dispatches modes in, or "" for modes that
+// have no command yet.
+func legacyCommand(fs *flag.FlagSet) string {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	switch {
+	case set["observe"]:
+		return ""
+	case set["dry-scan"]:
+		return "scan-bench"
+	case set["import-tar"], set["files-from"]:
+		return ""
+	case set["backup-now"]:
+		return "backup"
+	case set["watch"]:
+		return "watch"
+	case set["list-versions"]:
+		return "list"
+	case set["restore-file"]:
+		return ""
+	case set["restore"], set["base"]:
+		return "restore"
+	case set["compare"]:
+		return ""
+	case set["verify"]:
+		return "verify"
+	case set["max-total-size"], set["purge-tombstones"]:
+		return "prune"
+	case set["snapshot-only"]:
+		return ""
+	case set["list"]:
+		return "list"
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommands_HelpListsEveryFlag(t *testing.T) {
+	for _, c := range commands {
+		var out bytes.Buffer
+		if code := run([]string{c.name, "-h"}, &out); code != exitOK {
+			t.Fatalf("%s -h: exit code %d", c.name, code)
+		}
+		// A flag missing from the help is a typo in the command's lists
+		for _, name := range append(append([]string{}, c.flags...), commonFlags...) {
+			if !strings.Contains(out.String(), "  -"+name+" ") && !strings.Contains(out.String(), "  -"+name+"\n") {
+				t.Errorf("%s -h does not list --%s", c.name, name)
+			}
+		}
+		if strings.Contains(out.String(), "  -observe") {
+			t.Errorf("%s -h lists --observe, which it does not accept", c.name)
+		}
+	}
+}
+
+func TestCommands_Dispatch(t *testing.T) {
+	watchPath, backupPath := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(watchPath, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := run([]string{"backup", "--watch", watchPath, "--backup", backupPath}, io.Discard); code != exitOK {
+		t.Fatalf("backup: exit code %d", code)
+	}
+	if files, _ := chunkFiles(backupPath); len(files) != 1 {
+		t.Fatalf("expected backup to write one chunk, got %d", len(files))
+	}
+
+	var out bytes.Buffer
+	if code := run([]string{"list", "--backup", backupPath}, &out); code != exitOK {
+		t.Errorf("list: exit code %d", code)
+	}
+	if !strings.Contains(out.String(), "files=1") {
+		t.Errorf("expected list to show the run, got %q", out.String())
+	}
+
+	restorePath := t.TempDir()
+	if code := run([]string{"restore", "--restore", restorePath, "--backup", backupPath}, io.Discard); code != exitOK {
+		t.Errorf("restore: exit code %d", code)
+	}
+	if data, err := os.ReadFile(filepath.Join(restorePath, "a.txt")); err != nil || string(data) != "a" {
+		t.Errorf("expected restore to write a.txt, got %q, %v", data, err)
+	}
+
+	if code := run([]string{"verify", "--backup", backupPath}, io.Discard); code != exitOK {
+		t.Errorf("verify: exit code %d", code)
+	}
+	if code := run([]string{"prune", "--backup", backupPath, "--max-total-size", "1G"}, io.Discard); code != exitOK {
+		t.Errorf("prune: exit code %d", code)
+	}
+}
+
+func TestCommands_Errors(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"snapshot", "--backup", "/tmp"}, `unknown command "snapshot"`},
+		{[]string{"list", "--backup", "/tmp", "--watch", "/tmp"}, "--watch cannot be used with list"},
+		{[]string{"restore", "--backup", "/tmp", "--observe"}, "--observe cannot be used with restore"},
+		{[]string{"backup", "--watch", "/tmp"}, "backup requires --backup"},
+		{[]string{"restore", "--backup", "/tmp"}, "restore requires --restore or --base"},
+		{[]string{"prune", "--backup", "/tmp"}, "prune requires --max-total-size or --purge-tombstones"},
+	}
+	for _, tt := range tests {
+		logs := captureLog(t)
+		if code := run(tt.args, io.Discard); code != exitUsage {
+			t.Errorf("run(%v) exit code %d, want %d", tt.args, code, exitUsage)
+		}
+		if !strings.Contains(logs.String(), tt.want) {
+			t.Errorf("run(%v) logged %q, want %q", tt.args, logs.String(), tt.want)
+		}
+	}
+}
+
+func TestCommands_LegacyFlagsWarn(t *testing.T) {
+	logs := captureLog(t)
+	if code := run([]string{"--backup-now", "--watch", t.TempDir(), "--backup", t.TempDir()}, io.Discard); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	if !strings.Contains(logs.String(), "use ./app backup instead") {
+		t.Errorf("expected a deprecation warning naming the backup command, got %q", logs.String())
+	}
+}
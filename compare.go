@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type treeDiff struct {
+	// Relative to the backup: added exists only in the live tree, removed
+	// only in the backup, and modified in both with different content.
+	added    []string
+	removed  []string
+	modified []string
+}
+
+// compareBackup diffs the final state of a backup against a fresh scan of
+// livePath by content hash. Neither side is written to.
+func compareBackup(backupPath, livePath string, scan scanOptions) (treeDiff, error) {
+	state, err := resolveBackup(backupPath)
+	if err != nil {
+		return treeDiff{}, err
+	}
+
+	backed := make(map[string]string, len(state.files))
+	for path, entry := range state.files {
+		if entry.MetadataOnly {
+			backed[path] = entry.ContentHash
+		} else {
+			backed[path] = hashContent(entry.Content)
+		}
+	}
+
+	// Scanning the live tree against the backup's hashes reports exactly the
+	// differences; the scan only updates its own copy of them. Each change
+	// is classified as it arrives, so its content is dropped once hashed.
+	var diff treeDiff
+	entries := make(chan *FileEntry)
+	done := make(chan struct{})
+	go func() {
+		for entry := range entries {
+			switch {
+			case entry.Deleted:
+				diff.removed = append(diff.removed, entry.Path)
+			case state.files[entry.Path] != nil:
+				diff.modified = append(diff.modified, entry.Path)
+			default:
+				diff.added = append(diff.added, entry.Path)
+			}
+		}
+		close(done)
+	}()
+
+	_, err = scanChanges(livePath, newFileSnapshot(backed), scanOptions{exclude: scan.exclude}, entries)
+	close(entries)
+	<-done
+	if err != nil {
+		return treeDiff{}, err
+	}
+
+	sort.Strings(diff.added)
+	sort.Strings(diff.removed)
+	sort.Strings(diff.modified)
+	return diff, nil
+}
+
+func printDiff(w io.Writer, diff treeDiff) {
+	for _, path := range diff.added {
+		fmt.Fprintf(w, "added     %s\n", path)
+	}
+	for _, path := range diff.removed {
+		fmt.Fprintf(w, "removed   %s\n", path)
+	}
+	for _, path := range diff.modified {
+		fmt.Fprintf(w, "modified  %s\n", path)
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d modified\n",
+		len(diff.added), len(diff.removed), len(diff.modified))
+}
+
+// restorePlan classifies each file a restore would write by what is in the
+// target now.
+type restorePlan struct {
+	// create is absent from the target, identical already holds the same
+	// content, and conflicting holds something else that restore would
+	// replace. readOnly marks conflicts restore skips without
+	// --force-overwrite.
+	create      []string
+	identical   []string
+	conflicting []string
+	readOnly    map[string]bool
+}
+
+// simulateRestore works out what restore(backupPath, restorePath, opts)
+// would do to each file, comparing by content hash, without writing
+// anything.
+func simulateRestore(backupPath, restorePath string, opts restoreOptions) (restorePlan, error) {
+	state, err := resolveBackupWith(append([]string{backupPath}, opts.mergeFrom...), opts.resolveOptions())
+	if err != nil {
+		return restorePlan{}, err
+	}
+	if err := state.checkSource(opts.expectSource); err != nil {
+		return restorePlan{}, err
+	}
+
+	plan := restorePlan{readOnly: make(map[string]bool)}
+	hashBuf := make([]byte, defaultHashBufferSize)
+	for _, entry := range state.files {
+		relPath, ok := remapPath(entry.Path, opts)
+		if !ok {
+			continue
+		}
+		if !opts.modifiedAfter.IsZero() && !entry.ModTime.After(opts.modifiedAfter) {
+			continue
+		}
+		targetPath, err := safeJoin(restorePath, relPath)
+		if err != nil || protected(restorePath, relPath, false, opts) {
+			continue
+		}
+		displayPath := filepath.ToSlash(relPath)
+
+		info, err := os.Lstat(longPath(targetPath))
+		if errors.Is(err, fs.ErrNotExist) {
+			plan.create = append(plan.create, displayPath)
+			continue
+		}
+		if err != nil {
+			return restorePlan{}, err
+		}
+
+		// Compare against what restore would write, which for a file
+		// backed up without content is an empty placeholder
+		want := entry.ContentHash
+		if want == "" || entry.MetadataOnly {
+			want = hashContent(entry.Content)
+		}
+		same, err := holdsContent(longPath(targetPath), info, len(entry.Content), want, hashBuf)
+		if err != nil {
+			return restorePlan{}, err
+		}
+		if same {
+			plan.identical = append(plan.identical, displayPath)
+			continue
+		}
+		plan.conflicting = append(plan.conflicting, displayPath)
+		if _, readOnly := readOnlyTarget(targetPath); readOnly {
+			plan.readOnly[displayPath] = true
+		}
+	}
+	sort.Strings(plan.create)
+	sort.Strings(plan.identical)
+	sort.Strings(plan.conflicting)
+	return plan, nil
+}
+
+// holdsContent reports whether path, a file described by info, holds size
+// bytes hashing to hash. The size is checked first, so most differing files
+// are never read.
+func holdsContent(path string, info fs.FileInfo, size int, hash string, buf []byte) (bool, error) {
+	if !info.Mode().IsRegular() || info.Size() != int64(size) {
+		return false, nil
+	}
+	got, err := hashFileBuffer(path, buf)
+	if err != nil {
+		return false, err
+	}
+	return got == hash, nil
+}
+
+func printRestorePlan(w io.Writer, plan restorePlan) {
+	for _, path := range plan.create {
+		fmt.Fprintf(w, "new        %s\n", path)
+	}
+	for _, path := range plan.identical {
+		fmt.Fprintf(w, "identical  %s\n", path)
+	}
+	for _, path := range plan.conflicting {
+		if plan.readOnly[path] {
+			fmt.Fprintf(w, "conflict   %s (read-only, skipped without --force-overwrite)\n", path)
+		} else {
+			fmt.Fprintf(w, "conflict   %s\n", path)
+		}
+	}
+	fmt.Fprintf(w, "%d new, %d identical, %d conflicting\n",
+		len(plan.create), len(plan.identical), len(plan.conflicting))
+}
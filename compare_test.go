@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompareBackup_ReportsDifferences(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpLive := t.TempDir()
+
+	chunk := Chunk{
+		Entries: []*FileEntry{
+			{Path: "same.txt", Mode: 0644, Content: []byte("same")},
+			{Path: "changed.txt", Mode: 0644, Content: []byte("old")},
+			{Path: "missing.txt", Mode: 0644, Content: []byte("missing")},
+			{Path: "dir/nested.txt", Mode: 0644, Content: []byte("nested")},
+		},
+		Final: true,
+	}
+	if err := writeChunk(tmpBackup, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(tmpLive, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"same.txt":       "same",
+		"changed.txt":    "new",
+		"extra.txt":      "extra",
+		"dir/nested.txt": "nested",
+	} {
+		if err := os.WriteFile(filepath.Join(tmpLive, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diff, err := compareBackup(tmpBackup, tmpLive, scanOptions{})
+	if err != nil {
+		t.Fatalf("compareBackup() error = %v", err)
+	}
+
+	want := treeDiff{
+		added:    []string{"extra.txt"},
+		removed:  []string{"missing.txt"},
+		modified: []string{"changed.txt"},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("compareBackup() = %+v, want %+v", diff, want)
+	}
+
+	var out bytes.Buffer
+	printDiff(&out, diff)
+	if !strings.Contains(out.String(), "1 added, 1 removed, 1 modified") {
+		t.Errorf("unexpected summary:\n%s", out.String())
+	}
+}
+
+func TestCompareBackup_UsesFinalState(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpLive := t.TempDir()
+
+	runs := []Chunk{
+		{Entries: []*FileEntry{{Path: "a.txt", Mode: 0644, Content: []byte("v1")}}, Final: true},
+		{Entries: []*FileEntry{{Path: "a.txt", Mode: 0644, Content: []byte("v2")}}, Final: true},
+	}
+	for i, chunk := range runs {
+		if err := writeChunk(tmpBackup, int64(1000*(i+1)), 0, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tmpLive, "a.txt"), []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := compareBackup(tmpBackup, tmpLive, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.added)+len(diff.removed)+len(diff.modified) != 0 {
+		t.Errorf("expected no differences against the latest state, got %+v", diff)
+	}
+}
+
+func TestSimulateRestore_ClassifiesTargetFiles(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpTarget := t.TempDir()
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "same.txt", Mode: 0644, Content: []byte("same")},
+		{Path: "differs.txt", Mode: 0644, Content: []byte("backed up")},
+		{Path: "locked.txt", Mode: 0644, Content: []byte("backed up")},
+		{Path: "sub/absent.txt", Mode: 0644, Content: []byte("new")},
+		{Path: "was-dir", Mode: 0644, Content: []byte("file")},
+	}})
+	target := map[string]string{
+		"same.txt":    "same",
+		"differs.txt": "local edit",
+		"locked.txt":  "local edit",
+		"extra.txt":   "not in the backup",
+	}
+	for name, content := range target {
+		if err := os.WriteFile(filepath.Join(tmpTarget, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(tmpTarget, "was-dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(tmpTarget, "locked.txt"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(filepath.Join(tmpTarget, "locked.txt"), 0644) })
+
+	plan, err := simulateRestore(tmpBackup, tmpTarget, restoreOptions{})
+	if err != nil {
+		t.Fatalf("simulateRestore() error = %v", err)
+	}
+	if !slices.Equal(plan.create, []string{"sub/absent.txt"}) {
+		t.Errorf("new: got %v", plan.create)
+	}
+	if !slices.Equal(plan.identical, []string{"same.txt"}) {
+		t.Errorf("identical: got %v", plan.identical)
+	}
+	if !slices.Equal(plan.conflicting, []string{"differs.txt", "locked.txt", "was-dir"}) {
+		t.Errorf("conflicting: got %v", plan.conflicting)
+	}
+
+	var out bytes.Buffer
+	printRestorePlan(&out, plan)
+	if !strings.Contains(out.String(), "conflict   locked.txt (read-only") ||
+		!strings.HasSuffix(out.String(), "1 new, 1 identical, 3 conflicting\n") {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+
+	// Nothing was written
+	if _, err := os.Stat(filepath.Join(tmpTarget, "sub")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected no directories created, got %v", err)
+	}
+	for name, content := range target {
+		if got, _ := os.ReadFile(filepath.Join(tmpTarget, name)); string(got) != content {
+			t.Errorf("%s was modified: %q", name, got)
+		}
+	}
+}
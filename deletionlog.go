@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// deletionPath returns how entry appears in the deletion log, or false if
+// it is not a deletion. Deleted directories carry a trailing slash.
+func deletionPath(entry *FileEntry) (string, bool) {
+	if !entry.Deleted {
+		return "", false
+	}
+	if entry.Mode.IsDir() {
+		return entry.Path + "/", true
+	}
+	return entry.Path, true
+}
+
+// appendDeletionLog appends a line per deleted path of the run stamped
+// timestamp to the log at path, creating it if needed:
+//
+//	<run time, RFC 3339 UTC>  <run timestamp>  <path>
+//
+// Each run's lines go out in a single write.
+func appendDeletionLog(path string, timestamp int64, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	runTime := time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+	var b strings.Builder
+	for _, p := range paths {
+		fmt.Fprintf(&b, "%s  %d  %s\n", runTime, timestamp, p)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(b.String()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupOnce_DeletionLog(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	logPath := filepath.Join(t.TempDir(), "deletions.log")
+	if err := os.Mkdir(filepath.Join(tmpWatch, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt", "keep.txt", "dir/c.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, deletionLog: logPath}
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("first backupOnce() error = %v", err)
+	}
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("expected no deletion log before anything was deleted, got %v", err)
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.Remove(filepath.Join(tmpWatch, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(tmpWatch, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("second backupOnce() error = %v", err)
+	}
+
+	files, err := chunkFiles(tmpBackup)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected 2 runs, got %d (%v)", len(files), err)
+	}
+	runID, _, _ := parseChunkName(filepath.Base(files[1]))
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := []string{"a.txt", "b.txt", "dir/", "dir/c.txt"}
+	if len(lines) != len(want) {
+		t.Fatalf("expected %d lines, got:\n%s", len(want), data)
+	}
+	for i, line := range lines {
+		fields := strings.Split(line, "  ")
+		if len(fields) != 3 {
+			t.Fatalf("expected time, run, and path in %q", line)
+		}
+		when, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil || when.Unix() != runID {
+			t.Errorf("line %q: time %q does not match run %d (%v)", line, fields[0], runID, err)
+		}
+		if id, err := strconv.ParseInt(fields[1], 10, 64); err != nil || id != runID {
+			t.Errorf("line %q: run id %q, want %d", line, fields[1], runID)
+		}
+		if fields[2] != want[i] {
+			t.Errorf("line %d path = %q, want %q", i, fields[2], want[i])
+		}
+	}
+}
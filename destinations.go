@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+)
+
+// writePolicy decides how many of a run's destinations must store every
+// chunk for the run to succeed.
+type writePolicy int
+
+const (
+	writeAll writePolicy = iota
+	// writeQuorum needs a majority of the destinations.
+	writeQuorum
+	writeAny
+)
+
+var writePolicyNames = map[string]writePolicy{
+	"all":    writeAll,
+	"quorum": writeQuorum,
+	"any":    writeAny,
+}
+
+var ErrUnsupportedWritePolicy = errors.New("unsupported write policy")
+
+var ErrTooFewDestinations = errors.New("too few backup destinations written")
+
+func parseWritePolicy(name string) (writePolicy, error) {
+	policy, ok := writePolicyNames[name]
+	if !ok {
+		names := make([]string, 0, len(writePolicyNames))
+		for name := range writePolicyNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("%w %q (want one of %v)", ErrUnsupportedWritePolicy, name, names)
+	}
+	return policy, nil
+}
+
+func (p writePolicy) String() string {
+	for name, policy := range writePolicyNames {
+		if policy == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("writePolicy(%d)", int(p))
+}
+
+// required returns how many of n destinations must succeed.
+func (p writePolicy) required(n int) int {
+	switch p {
+	case writeQuorum:
+		return n/2 + 1
+	case writeAny:
+		return 1
+	default:
+		return n
+	}
+}
+
+// destinations are the directories a run writes each chunk to: the
+// --backup directory and any replicas. A destination whose write fails is
+// dropped for the rest of the run and the chunks it already got are
+// removed, so it never holds half a run; the run carries on while the
+// policy still holds.
+type destinations struct {
+	paths   []string
+	policy  writePolicy
+	written map[string][]string
+	failed  map[string]error
+}
+
+func newDestinations(backupPath string, replicas []string, policy writePolicy) *destinations {
+	return &destinations{
+		paths:   append([]string{backupPath}, replicas...),
+		policy:  policy,
+		written: make(map[string][]string),
+		failed:  make(map[string]error),
+	}
+}
+
+// catchUp copies into each destination the runs lagging records it missed,
+// taken from a destination that has them, so no destination stores this
+// run on top of a gap. A destination that cannot be caught up is dropped
+// from the run.
+func (d *destinations) catchUp(lagging map[string][]int64, mode fsyncMode) {
+	for _, path := range d.paths {
+		for _, timestamp := range lagging[path] {
+			source := d.holder(timestamp, lagging)
+			if source == "" {
+				d.drop(path, fmt.Errorf("no destination holds run %d, which it missed", timestamp))
+				break
+			}
+			copied, err := copyRun(source, path, timestamp, mode)
+			d.written[path] = append(d.written[path], copied...)
+			if err != nil {
+				d.drop(path, fmt.Errorf("copying run %d, which it missed, from %s: %w", timestamp, source, err))
+				break
+			}
+			log.Printf("Copied run %d, which %s missed, from %s", timestamp, path, source)
+		}
+	}
+}
+
+// holder returns a destination still in the run that did not miss the run
+// at timestamp, or "" if there is none.
+func (d *destinations) holder(timestamp int64, lagging map[string][]int64) string {
+	for _, path := range d.paths {
+		if d.failed[path] != nil || slices.Contains(lagging[path], timestamp) {
+			continue
+		}
+		if hasRun(path, timestamp) {
+			return path
+		}
+	}
+	return ""
+}
+
+// record replaces lagging with the runs each destination dropped from this
+// run is missing: those it already missed and, if one was written, the
+// run at timestamp. Destinations that took the run are caught up.
+func (d *destinations) record(lagging map[string][]int64, timestamp int64) {
+	missed := make(map[string][]int64)
+	for _, path := range d.paths {
+		if d.failed[path] == nil {
+			continue
+		}
+		runs := lagging[path]
+		if timestamp != 0 {
+			runs = append(slices.Clone(runs), timestamp)
+			log.Printf("Warning: backup destination %s missed run %d; the next run copies it there first", path, timestamp)
+		}
+		if len(runs) > 0 {
+			missed[path] = runs
+		}
+	}
+	clear(lagging)
+	maps.Copy(lagging, missed)
+}
+
+// timestamp returns a run timestamp past the latest run in every
+// destination, so replicas replay in the same order.
+func (d *destinations) timestamp() int64 {
+	var timestamp int64
+	for _, path := range d.paths {
+		timestamp = max(timestamp, runTimestamp(path))
+	}
+	return timestamp
+}
+
+// each calls write for every destination still in the run. write returns
+// the file it created, if any, so it can be removed if the run fails.
+func (d *destinations) each(write func(backupPath string) (string, error)) error {
+	for _, path := range d.paths {
+		if d.failed[path] != nil {
+			continue
+		}
+		filename, err := write(path)
+		if filename != "" {
+			d.written[path] = append(d.written[path], filename)
+		}
+		if err != nil {
+			d.drop(path, err)
+		}
+	}
+	return d.check()
+}
+
+func (d *destinations) drop(path string, err error) {
+	d.failed[path] = err
+	for _, filename := range d.written[path] {
+		os.Remove(filename)
+	}
+	delete(d.written, path)
+	if len(d.paths) > 1 {
+		log.Printf("Warning: dropping backup destination %s from this run: %v", path, err)
+	}
+}
+
+// check reports an error once too few destinations are left for the
+// policy. With a single destination that is its own error.
+func (d *destinations) check() error {
+	if len(d.failed) == 0 {
+		return nil
+	}
+	if len(d.paths) == 1 {
+		return d.failed[d.paths[0]]
+	}
+	left, required := len(d.paths)-len(d.failed), d.policy.required(len(d.paths))
+	if left >= required {
+		return nil
+	}
+	var errs []error
+	for _, path := range d.paths {
+		if err := d.failed[path]; err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	return fmt.Errorf("%w: %d of %d left, policy %s needs %d: %w",
+		ErrTooFewDestinations, left, len(d.paths), d.policy, required, errors.Join(errs...))
+}
+
+// removeAll removes every file the run wrote, in all destinations.
+func (d *destinations) removeAll() {
+	for _, files := range d.written {
+		for _, filename := range files {
+			os.Remove(filename)
+		}
+	}
+}
+
+func hasRun(backupPath string, timestamp int64) bool {
+	if files, _ := filepath.Glob(filepath.Join(backupPath, fmt.Sprintf("chunk_%d_*.dat", timestamp))); len(files) > 0 {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(backupPath, fmt.Sprintf("%s%d%s", indexPrefix, timestamp, indexSuffix)))
+	return err == nil
+}
+
+// copyRun copies the run at timestamp from source to dest: its chunk files,
+// or for a content-addressed run the objects dest lacks and then its index,
+// so the run only becomes visible once complete. It returns the files it
+// created, including on error.
+func copyRun(source, dest string, timestamp int64, mode fsyncMode) ([]string, error) {
+	var created []string
+	files, err := filepath.Glob(filepath.Join(source, fmt.Sprintf("chunk_%d_*.dat", timestamp)))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		target := filepath.Join(dest, filepath.Base(file))
+		if err := copyFileSynced(file, target, mode); err != nil {
+			return created, err
+		}
+		created = append(created, target)
+	}
+
+	index := filepath.Join(source, fmt.Sprintf("%s%d%s", indexPrefix, timestamp, indexSuffix))
+	hashes, err := readRunIndex(index)
+	if errors.Is(err, fs.ErrNotExist) {
+		return created, mode.syncDir(dest)
+	}
+	if err != nil {
+		return created, err
+	}
+	dir := filepath.Join(dest, objectsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return created, err
+	}
+	for _, hash := range hashes {
+		target := filepath.Join(dir, hash+".dat")
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		if err := copyFileSynced(filepath.Join(source, objectsDir, hash+".dat"), target, mode); err != nil {
+			return created, err
+		}
+		created = append(created, target)
+	}
+	if err := mode.syncDir(dir); err != nil {
+		return created, err
+	}
+	target := filepath.Join(dest, filepath.Base(index))
+	if err := copyFileSynced(index, target, mode); err != nil {
+		return created, err
+	}
+	return append(created, target), mode.syncDir(dest)
+}
+
+// copyFileSynced copies src to dst through a temporary file, so dst is
+// either absent or complete.
+func copyFileSynced(src, dst string, mode fsyncMode) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err := writeSynced(tmp, data, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// brokenDestination returns a backup path that every write fails under,
+// since a regular file stands where its directory should be.
+func brokenDestination(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "unavailable")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCreateBackup_WritePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  writePolicy
+		working int
+		broken  int
+		wantErr bool
+	}{
+		{name: "all with every destination working", policy: writeAll, working: 2},
+		{name: "all with one broken", policy: writeAll, working: 1, broken: 1, wantErr: true},
+		{name: "any with one broken", policy: writeAny, working: 1, broken: 1},
+		{name: "any with all broken", policy: writeAny, broken: 2, wantErr: true},
+		{name: "quorum with one of three broken", policy: writeQuorum, working: 2, broken: 1},
+		{name: "quorum with one of two broken", policy: writeQuorum, working: 1, broken: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var working, paths []string
+			for range tt.working {
+				working = append(working, t.TempDir())
+			}
+			for range tt.broken {
+				paths = append(paths, brokenDestination(t))
+			}
+			// The broken destinations come first, so the run has already
+			// lost them when it reaches the working ones
+			paths = append(paths, working...)
+
+			var entries []*FileEntry
+			for i := range 3 {
+				entries = append(entries, &FileEntry{Path: fmt.Sprintf("%d.dat", i), Mode: 0644, Content: distinctContent(i, 3*1024*1024)})
+			}
+			err := createBackup(paths[0], entries, backupOptions{full: true, replicas: paths[1:], policy: tt.policy})
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrTooFewDestinations) {
+					t.Fatalf("expected ErrTooFewDestinations, got %v", err)
+				}
+				for _, path := range working {
+					if files, _ := chunkFiles(path); len(files) != 0 {
+						t.Errorf("expected failed run to leave no chunks in %s, got %d", path, len(files))
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createBackup() error = %v", err)
+			}
+
+			for _, path := range working {
+				restorePath := t.TempDir()
+				if err := restore(path, restorePath, restoreOptions{}); err != nil {
+					t.Fatalf("restore from %s: %v", path, err)
+				}
+				for i, entry := range entries {
+					data, err := os.ReadFile(filepath.Join(restorePath, entry.Path))
+					if err != nil {
+						t.Fatalf("reading restored file: %v", err)
+					}
+					if string(data) != string(distinctContent(i, 3*1024*1024)) {
+						t.Errorf("restored %s from %s has wrong content", entry.Path, path)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCreateBackup_ReplicasShareRunTimestamp(t *testing.T) {
+	primary, replica := t.TempDir(), t.TempDir()
+	if err := writeChunk(replica, 4000000000, 0, Chunk{Full: true, Final: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []*FileEntry{{Path: "a.txt", Mode: 0644, Content: []byte("a")}}
+	if err := createBackup(primary, entries, backupOptions{replicas: []string{replica}}); err != nil {
+		t.Fatalf("createBackup() error = %v", err)
+	}
+
+	for _, path := range []string{primary, replica} {
+		if _, err := os.Stat(filepath.Join(path, "chunk_4000000001_000.dat")); err != nil {
+			t.Errorf("expected run stamped past the replica's latest run in %s: %v", path, err)
+		}
+	}
+}
+
+func TestParseWritePolicy(t *testing.T) {
+	for name, want := range writePolicyNames {
+		got, err := parseWritePolicy(name)
+		if err != nil || got != want {
+			t.Errorf("parseWritePolicy(%q) = %v, %v; want %v", name, got, err, want)
+		}
+		if got.String() != name {
+			t.Errorf("String() = %q, want %q", got.String(), name)
+		}
+	}
+	if _, err := parseWritePolicy("most"); !errors.Is(err, ErrUnsupportedWritePolicy) {
+		t.Errorf("expected ErrUnsupportedWritePolicy, got %v", err)
+	}
+}
+
+func TestBackupOnce_ReplicaCatchesUpOnMissedRun(t *testing.T) {
+	for _, contentAddressed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("content-addressed=%v", contentAddressed), func(t *testing.T) {
+			tmpWatch, primary := t.TempDir(), t.TempDir()
+			replica := filepath.Join(t.TempDir(), "replica")
+			opts := watchOptions{
+				watchPath:        tmpWatch,
+				backupPath:       primary,
+				replicas:         []string{replica},
+				writePolicy:      writeAny,
+				contentAddressed: contentAddressed,
+			}
+			write := func(name, content string) {
+				t.Helper()
+				if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			lagging := func() map[string][]int64 {
+				t.Helper()
+				state, err := loadSnapshot(filepath.Join(primary, defaultSnapshotName), tmpWatch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return state.Lagging
+			}
+
+			write("a.txt", "one")
+			if err := backupOnce(opts); err != nil {
+				t.Fatalf("first backupOnce() error = %v", err)
+			}
+
+			// The replica is unavailable for the second run only
+			if err := os.Rename(replica, replica+".away"); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(replica, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			write("a.txt", "two")
+			write("b.txt", "b")
+			if err := backupOnce(opts); err != nil {
+				t.Fatalf("second backupOnce() error = %v", err)
+			}
+			if got := lagging()[replica]; len(got) != 1 {
+				t.Fatalf("expected the replica recorded as missing one run, got %v", got)
+			}
+
+			if err := os.Remove(replica); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(replica+".away", replica); err != nil {
+				t.Fatal(err)
+			}
+			write("c.txt", "c")
+			if err := backupOnce(opts); err != nil {
+				t.Fatalf("third backupOnce() error = %v", err)
+			}
+			if got := lagging(); len(got) != 0 {
+				t.Errorf("expected no lagging destinations after catching up, got %v", got)
+			}
+
+			restorePath := t.TempDir()
+			if err := restore(replica, restorePath, restoreOptions{}); err != nil {
+				t.Fatalf("restore from replica: %v", err)
+			}
+			for name, want := range map[string]string{"a.txt": "two", "b.txt": "b", "c.txt": "c"} {
+				data, err := os.ReadFile(filepath.Join(restorePath, name))
+				if err != nil {
+					t.Errorf("reading restored %s: %v", name, err)
+					continue
+				}
+				if string(data) != want {
+					t.Errorf("restored %s = %q, want %q", name, data, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// sameDevice reports whether paths a and b are on the same filesystem, so
+// a file can be renamed or hardlinked from one to the other.
+func sameDevice(a, b string) (bool, error) {
+	devA, err := device(a)
+	if err != nil {
+		return false, err
+	}
+	devB, err := device(b)
+	if err != nil {
+		return false, err
+	}
+	return devA == devB, nil
+}
+
+func device(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("%s: no device information", path)
+	}
+	return uint64(stat.Dev), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSameDevice(t *testing.T) {
+	root := t.TempDir()
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	for _, dir := range []string{a, b} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if same, err := sameDevice(a, b); err != nil || !same {
+		t.Errorf("sameDevice(siblings) = %t, %v; want true", same, err)
+	}
+
+	if _, err := sameDevice(a, filepath.Join(root, "missing")); err == nil {
+		t.Error("expected an error for a missing path")
+	}
+
+	// procfs is always its own filesystem
+	if runtime.GOOS == "linux" {
+		if same, err := sameDevice(a, "/proc"); err != nil || same {
+			t.Errorf("sameDevice(tmp, /proc) = %t, %v; want false", same, err)
+		}
+	}
+}
+
+func TestBackupOnce_NotesSameDevice(t *testing.T) {
+	root := t.TempDir()
+	tmpWatch, tmpBackup := filepath.Join(root, "watch"), filepath.Join(root, "backup")
+	if err := os.Mkdir(tmpWatch, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := captureLog(t)
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "is on the same device as "+tmpWatch) {
+		t.Errorf("expected a same-device note, got %q", logs.String())
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sameDevice reports whether paths a and b are on the same volume, by
+// drive letter or UNC share. Volumes mounted in folders are not told apart.
+func sameDevice(a, b string) (bool, error) {
+	var volumes [2]string
+	for i, path := range []string{a, b} {
+		if _, err := os.Stat(path); err != nil {
+			return false, err
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return false, err
+		}
+		volumes[i] = filepath.VolumeName(abs)
+	}
+	return strings.EqualFold(volumes[0], volumes[1]), nil
+}
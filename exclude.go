@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Exclude patterns follow gitignore conventions: a leading "!" re-includes,
+// a trailing "/" only matches directories, and a pattern containing a "/"
+// is anchored to the watch root instead of matching a name at any depth.
+// The last matching pattern decides.
+//
+// Beyond path.Match syntax, "**" matches any number of path segments and
+// "{a,b}" matches either alternative.
+type excludeRule struct {
+	// alternatives holds the brace expansions of the pattern, each split
+	// into path segments.
+	alternatives [][]string
+	negate       bool
+	dirOnly      bool
+	anchored     bool
+}
+
+type excludeMatcher struct {
+	rules []excludeRule
+	// ignoreCase lowercases patterns and paths before matching.
+	ignoreCase bool
+}
+
+func newExcludeMatcher(patterns []string, ignoreCase bool) (*excludeMatcher, error) {
+	m := &excludeMatcher{ignoreCase: ignoreCase}
+	for _, p := range patterns {
+		if ignoreCase {
+			p = strings.ToLower(p)
+		}
+		var rule excludeRule
+		if strings.HasPrefix(p, "!") {
+			rule.negate = true
+			p = p[1:]
+		} else if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			rule.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		if strings.Contains(p, "/") {
+			rule.anchored = true
+			p = strings.TrimPrefix(p, "/")
+		}
+		if p == "" {
+			continue
+		}
+		for _, alt := range expandBraces(p) {
+			segments := strings.Split(alt, "/")
+			for _, segment := range segments {
+				if _, err := path.Match(segment, ""); err != nil {
+					return nil, fmt.Errorf("invalid exclude pattern %q: %w", p, err)
+				}
+			}
+			rule.alternatives = append(rule.alternatives, segments)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, nil
+}
+
+func loadExcludeFile(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// excluded reports whether relPath, a forward-slash path relative to the
+// watch root, is excluded.
+func (m *excludeMatcher) excluded(relPath string, isDir bool) bool {
+	excluded, _ := m.match(relPath, isDir)
+	return excluded
+}
+
+// match reports whether relPath is excluded, and whether any rule matched
+// it at all, so layered matchers can tell "not excluded" from "no opinion".
+func (m *excludeMatcher) match(relPath string, isDir bool) (excluded, matched bool) {
+	if m == nil {
+		return false, false
+	}
+
+	if m.ignoreCase {
+		relPath = strings.ToLower(relPath)
+	}
+
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		name := relPath
+		if !rule.anchored {
+			name = path.Base(relPath)
+		}
+		segments := strings.Split(name, "/")
+		for _, alt := range rule.alternatives {
+			if matchSegments(alt, segments) {
+				excluded, matched = !rule.negate, true
+				break
+			}
+		}
+	}
+	return excluded, matched
+}
+
+// ignoreFileName is a per-directory file of exclude patterns, applied to
+// the directory it is in and everything below it.
+const ignoreFileName = ".backupignore"
+
+// ignoreFiles holds the .backupignore patterns a scan has found so far,
+// keyed by the directory they were found in.
+type ignoreFiles struct {
+	ignoreCase bool
+	byDir      map[string]*excludeMatcher
+}
+
+func newIgnoreFiles(ignoreCase bool) *ignoreFiles {
+	return &ignoreFiles{ignoreCase: ignoreCase, byDir: make(map[string]*excludeMatcher)}
+}
+
+// clone copies f, so a walk of a subtree can add the rules it finds
+// without affecting other walks.
+func (f *ignoreFiles) clone() *ignoreFiles {
+	return &ignoreFiles{ignoreCase: f.ignoreCase, byDir: maps.Clone(f.byDir)}
+}
+
+// load reads the .backupignore in dir, whose path relative to the watch
+// root is relDir, if there is one.
+func (f *ignoreFiles) load(dir, relDir string) error {
+	patterns, err := loadExcludeFile(filepath.Join(dir, ignoreFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	matcher, err := newExcludeMatcher(patterns, f.ignoreCase)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path.Join(relDir, ignoreFileName), err)
+	}
+	f.byDir[relDir] = matcher
+	return nil
+}
+
+// excluded reports whether relPath is excluded by the .backupignore files
+// of its ancestors together with the global patterns. As with gitignore, a
+// deeper file overrides the ones above it and the global patterns override
+// them all. Patterns in a .backupignore are matched against paths relative
+// to its directory. The .backupignore files themselves are left out unless
+// a pattern explicitly includes them.
+func (f *ignoreFiles) excluded(global *excludeMatcher, relPath string, isDir bool) bool {
+	excluded, matched := false, false
+	dir := "."
+	for _, segment := range strings.Split(relPath, "/") {
+		if matcher := f.byDir[dir]; matcher != nil {
+			rel := strings.TrimPrefix(relPath, dir+"/")
+			if e, ok := matcher.match(rel, isDir); ok {
+				excluded, matched = e, true
+			}
+		}
+		dir = path.Join(dir, segment)
+	}
+	if e, ok := global.match(relPath, isDir); ok {
+		excluded, matched = e, true
+	}
+	if !isDir && path.Base(relPath) == ignoreFileName && !matched {
+		return true
+	}
+	return excluded
+}
+
+// matchSegments matches a path against a pattern segment by segment, with
+// a "**" segment matching zero or more path segments.
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(segments); i >= 0; i-- {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// expandBraces expands the first top-level "{a,b}" group in p, recursing
+// until none remain. Backslash-escaped braces and groups without a comma
+// are left as they are.
+func expandBraces(p string) []string {
+	start, depth := -1, 0
+	var commas []int
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				start = i
+				commas = nil
+			}
+			depth++
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+		case '}':
+			if depth == 0 {
+				continue
+			}
+			depth--
+			if depth > 0 {
+				continue
+			}
+			if len(commas) == 0 {
+				start = -1
+				continue
+			}
+
+			prefix, suffix := p[:start], p[i+1:]
+			bounds := append(append([]int{start}, commas...), i)
+			var out []string
+			for j := 0; j+1 < len(bounds); j++ {
+				option := p[bounds[j]+1 : bounds[j+1]]
+				out = append(out, expandBraces(prefix+option+suffix)...)
+			}
+			return out
+		}
+	}
+	return []string{p}
+}
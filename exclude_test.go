@@ -0,0 +1,288 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestLoadExcludeFile_CommentsAndNegation(t *testing.T) {
+	patternFile := filepath.Join(t.TempDir(), "excludes")
+	content := `# build output
+*.log
+
+!important.log
+build/
+/cache
+docs/*.tmp
+`
+	if err := os.WriteFile(patternFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, err := loadExcludeFile(patternFile)
+	if err != nil {
+		t.Fatalf("loadExcludeFile() error = %v", err)
+	}
+	if len(patterns) != 5 {
+		t.Fatalf("expected 5 patterns (comments and blanks dropped), got %d: %v", len(patterns), patterns)
+	}
+
+	matcher, err := newExcludeMatcher(patterns, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"app.log", false, true},
+		{"nested/dir/app.log", false, true},
+		{"important.log", false, false},
+		{"nested/important.log", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"src/build", true, true},
+		{"cache", true, true},
+		{"src/cache", true, false},
+		{"docs/a.tmp", false, true},
+		{"other/docs/a.tmp", false, false},
+		{"main.go", false, false},
+	}
+	for _, tt := range tests {
+		if got := matcher.excluded(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("excluded(%q, dir=%v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestNewExcludeMatcher_InvalidPattern(t *testing.T) {
+	if _, err := newExcludeMatcher([]string{"[abc"}, false); err == nil {
+		t.Error("expected error for malformed pattern, got nil")
+	}
+}
+
+func TestDetectChanges_Excludes(t *testing.T) {
+	tmpDir := t.TempDir()
+	snapshot := newFileSnapshot(nil)
+
+	files := []string{
+		"keep.txt",
+		"debug.log",
+		"important.log",
+		filepath.Join("build", "out.bin"),
+	}
+	for _, f := range files {
+		full := filepath.Join(tmpDir, f)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matcher, err := newExcludeMatcher([]string{"*.log", "!important.log", "build/"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := detectChanges(tmpDir, snapshot, scanOptions{exclude: matcher})
+	if err != nil {
+		t.Fatalf("detectChanges() error = %v", err)
+	}
+
+	got := make(map[string]bool)
+	for _, c := range changes {
+		got[c.Path] = true
+	}
+	if len(got) != 2 || !got["keep.txt"] || !got["important.log"] {
+		t.Errorf("expected keep.txt and important.log, got %v", got)
+	}
+}
+
+func TestExcludeMatcher_DoubleStar(t *testing.T) {
+	matcher, err := newExcludeMatcher([]string{"src/**/*.test.js", "**/tmp", "logs/**/old/"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"src/a.test.js", false, true},
+		{"src/app/a.test.js", false, true},
+		{"src/app/deep/nested/a.test.js", false, true},
+		{"src/app/a.js", false, false},
+		{"lib/a.test.js", false, false},
+		{"tmp", true, true},
+		{"a/b/tmp", false, true},
+		{"a/b/tmpfile", false, false},
+		{"logs/old", true, true},
+		{"logs/2024/01/old", true, true},
+		{"logs/2024/01/old", false, false},
+	}
+	for _, tt := range tests {
+		if got := matcher.excluded(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("excluded(%q, dir=%v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestExcludeMatcher_BraceAlternation(t *testing.T) {
+	matcher, err := newExcludeMatcher([]string{"*.{tmp,bak}", "{build,dist}/", "cfg/{a,b{1,2}}.ini", "!keep.{bak}"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"file.tmp", false, true},
+		{"deep/dir/file.bak", false, true},
+		{"file.txt", false, false},
+		{"build", true, true},
+		{"dist", true, true},
+		{"docs", true, false},
+		{"cfg/a.ini", false, true},
+		{"cfg/b1.ini", false, true},
+		{"cfg/b2.ini", false, true},
+		{"cfg/b.ini", false, false},
+		// A brace group without a comma is literal
+		{"keep.bak", false, true},
+		{"keep.{bak}", false, false},
+	}
+	for _, tt := range tests {
+		if got := matcher.excluded(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("excluded(%q, dir=%v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"plain", []string{"plain"}},
+		{"*.{a,b}", []string{"*.a", "*.b"}},
+		{"{x,y}/{1,2}", []string{"x/1", "x/2", "y/1", "y/2"}},
+		{"a{b,c{d,e}}", []string{"ab", "acd", "ace"}},
+		{`\{a,b}`, []string{`\{a,b}`}},
+		{"{single}", []string{"{single}"}},
+	}
+	for _, tt := range tests {
+		if got := expandBraces(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandBraces(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExcludeMatcher_IgnoreCase(t *testing.T) {
+	patterns := []string{"*.TMP", "Build/", "!Keep.tmp", "docs/**/*.{Bak,Old}"}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"file.tmp", false, true},
+		{"FILE.Tmp", false, true},
+		{"build", true, true},
+		{"BUILD", true, true},
+		{"keep.TMP", false, false},
+		{"Docs/a/b/notes.OLD", false, true},
+		{"file.txt", false, false},
+	}
+
+	matcher, err := newExcludeMatcher(patterns, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if got := matcher.excluded(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("ignore case: excluded(%q, dir=%v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+
+	// Matching stays case-sensitive by default
+	matcher, err = newExcludeMatcher(patterns, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"file.tmp", "FILE.Tmp", "Docs/a/b/notes.OLD"} {
+		if matcher.excluded(path, false) {
+			t.Errorf("case-sensitive: %q should not be excluded", path)
+		}
+	}
+	if !matcher.excluded("file.TMP", false) {
+		t.Error("case-sensitive: file.TMP should be excluded")
+	}
+}
+
+func TestDetectChanges_NestedBackupIgnore(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		".backupignore":                 "*.tmp\n/top-only.txt\nscratch/\n",
+		"a.tmp":                         "",
+		"top-only.txt":                  "",
+		"keep.txt":                      "",
+		"scratch/x.txt":                 "",
+		"sub/.backupignore":             "# keep temp files here\n!*.tmp\n/top-only.txt\ncache/\n",
+		"sub/b.tmp":                     "",
+		"sub/top-only.txt":              "",
+		"sub/cache/data.bin":            "",
+		"sub/deep/c.tmp":                "",
+		"sub/deep/top-only.txt":         "",
+		"sub/deep/.backupignore":        "*.tmp\n!.backupignore\n",
+		"other/top-only.txt":            "",
+		"other/nested/cache/kept.bin":   "",
+		"other/nested/scratch/gone.txt": "",
+	}
+	for name, content := range files {
+		full := filepath.Join(tmpDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	matcher, err := newExcludeMatcher([]string{"keep.txt"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := detectChanges(tmpDir, newFileSnapshot(nil), scanOptions{exclude: matcher})
+	if err != nil {
+		t.Fatalf("detectChanges() error = %v", err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.Path)
+	}
+	slices.Sort(got)
+
+	want := []string{
+		// The root's /top-only.txt is anchored to the root, and the global
+		// keep.txt exclude overrides everything
+		"other/nested/cache/kept.bin",
+		"other/top-only.txt",
+		// sub re-includes *.tmp and anchors its own /top-only.txt
+		"sub/b.tmp",
+		// deep excludes *.tmp again and explicitly keeps its ignore file
+		"sub/deep/.backupignore",
+		"sub/deep/top-only.txt",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("backed up %v\nwant %v", got, want)
+	}
+}
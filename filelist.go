@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A line starting with deletedPrefix in a file list records a deletion. A
+// file whose name really starts with it can be listed as "./-name".
+const deletedPrefix = "-"
+
+// backupFileList backs up exactly the paths read from list instead of
+// scanning watchPath, for callers that already know what changed. Each line
+// is a path relative to watchPath (or an absolute path inside it); blank
+// lines are ignored. The snapshot is updated for the listed paths so a
+// later scan does not back them up again.
+func backupFileList(opts watchOptions, list io.Reader) (int, error) {
+	state, err := prepareBackup(&opts)
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []*FileEntry
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		deleted := strings.HasPrefix(line, deletedPrefix)
+		if deleted {
+			line = strings.TrimPrefix(line, deletedPrefix)
+		}
+
+		relPath, err := listedPath(opts.watchPath, line)
+		if err != nil {
+			return 0, err
+		}
+		if deleted {
+			entries = append(entries, &FileEntry{Path: relPath, Deleted: true})
+			continue
+		}
+
+		entry, err := readListedFile(opts.watchPath, relPath)
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("reading file list: %w", err)
+	}
+	if len(entries) == 0 {
+		log.Println("File list is empty, nothing to back up")
+		return 0, nil
+	}
+
+	if err := createBackup(opts.backupPath, entries, backupOptions{
+		maxChunks:        opts.maxChunks,
+		maxEntries:       opts.entriesPerChunk,
+		source:           opts.sourceLabel(),
+		format:           opts.format,
+		contentAddressed: opts.contentAddressed,
+		fsync:            opts.fsync,
+	}); err != nil {
+		return 0, err
+	}
+	log.Printf("Backup of %d listed paths completed", len(entries))
+
+	for _, entry := range entries {
+		if entry.Deleted {
+			state.Files.delete(entry.Path)
+		} else {
+			state.Files.set(entry.Path, entry.ContentHash)
+		}
+	}
+	if err := saveSnapshot(opts.snapshotFile, state); err != nil {
+		return len(entries), fmt.Errorf("saving snapshot: %w", err)
+	}
+	return len(entries), nil
+}
+
+// listedPath converts a listed path to the forward-slash form stored in
+// backups, rejecting paths outside watchPath.
+func listedPath(watchPath, listed string) (string, error) {
+	if filepath.IsAbs(listed) {
+		rel, err := filepath.Rel(watchPath, listed)
+		if err != nil {
+			return "", fmt.Errorf("listed path %q: %w", listed, err)
+		}
+		listed = rel
+	}
+	relPath := path.Clean(filepath.ToSlash(listed))
+	if relPath == "." || relPath == ".." || strings.HasPrefix(relPath, "../") || path.IsAbs(relPath) {
+		return "", fmt.Errorf("listed path %q is outside %s", listed, watchPath)
+	}
+	return relPath, nil
+}
+
+func readListedFile(watchPath, relPath string) (*FileEntry, error) {
+	fullPath := filepath.Join(watchPath, filepath.FromSlash(relPath))
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("listed path %s is not a regular file", relPath)
+	}
+	content, err := os.ReadFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	acl, err := readACL(fullPath)
+	if err != nil {
+		log.Printf("Warning: could not read ACL for %s: %v", relPath, err)
+	}
+	capability, err := readCapability(fullPath)
+	if err != nil {
+		log.Printf("Warning: could not read file capabilities for %s: %v", relPath, err)
+	}
+	return &FileEntry{
+		Path:        relPath,
+		Mode:        info.Mode(),
+		ModTime:     info.ModTime(),
+		Size:        int64(len(content)),
+		Content:     content,
+		ACL:         acl,
+		Capability:  capability,
+		ContentHash: hashContent(content),
+	}, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupFileList_BacksUpListedPaths(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(tmpWatch, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "unlisted.txt", "src/b.go"} {
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := "a.txt\n\n" + filepath.Join(tmpWatch, "src", "b.go") + "\n-gone.txt\n"
+	n, err := backupFileList(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}, strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("backupFileList() error = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 entries, got %d", n)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 chunk, got %d", len(files))
+	}
+	chunk, err := readChunk(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, entry := range chunk.Entries {
+		desc := entry.Path
+		if entry.Deleted {
+			desc = "deleted " + desc
+		} else if string(entry.Content) != entry.Path {
+			t.Errorf("%s: unexpected content %q", entry.Path, entry.Content)
+		}
+		got = append(got, desc)
+	}
+	want := "a.txt,deleted gone.txt,src/b.go"
+	if strings.Join(got, ",") != want {
+		t.Errorf("expected entries %s, got %s", want, strings.Join(got, ","))
+	}
+}
+
+func TestBackupFileList_UpdatesSnapshot(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}
+	if _, err := backupFileList(opts, strings.NewReader("a.txt\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := loadSnapshot(filepath.Join(tmpBackup, defaultSnapshotName), tmpWatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := state.Files.clone()["a.txt"]; hash != hashContent([]byte("a")) {
+		t.Errorf("expected a.txt in the snapshot, got %v", state.Files.clone())
+	}
+}
+
+func TestBackupFileList_RejectsPathsOutsideWatch(t *testing.T) {
+	tmpWatch := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, list := range []string{"../secret\n", outside + "\n", "-../../etc/passwd\n"} {
+		_, err := backupFileList(watchOptions{watchPath: tmpWatch, backupPath: t.TempDir()}, strings.NewReader(list))
+		if err == nil {
+			t.Errorf("list %q: expected an error", list)
+		}
+	}
+}
+
+func TestBackupFileList_MissingFile(t *testing.T) {
+	tmpBackup := t.TempDir()
+	_, err := backupFileList(watchOptions{watchPath: t.TempDir(), backupPath: tmpBackup}, strings.NewReader("missing.txt\n"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a not-exist error, got %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat")); len(files) != 0 {
+		t.Errorf("expected no chunks, got %d", len(files))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// chunkFormat identifies how a chunk's payload is serialized. From chunk
+// version 3 it is stored in the header right after the version byte.
+type chunkFormat byte
+
+const (
+	formatGob chunkFormat = iota
+	// formatJSON can be read by tools in any language. []byte fields are
+	// base64 strings, so a chunk holds about a quarter less content than
+	// with gob.
+	formatJSON
+)
+
+// Fixed cost of an entry in each format beyond its path, hashes, ACL,
+// capability, and content, measured from encoded chunks and rounded up.
+// Gob leaves out a zero birth time, so its cost is only added when set.
+const (
+	gobEntryOverhead  = 40
+	gobBirthTimeSize  = 20
+	jsonEntryOverhead = 255
+)
+
+// encodedEntrySize estimates how many bytes entry adds to a chunk in format,
+// so chunks are packed close to chunkSize whatever the path lengths.
+func encodedEntrySize(entry *FileEntry, format chunkFormat) int {
+	size := len(entry.Path) + len(entry.ContentHash) + len(entry.ContentRef)
+	if format == formatJSON {
+		return size + jsonEntryOverhead + base64.StdEncoding.EncodedLen(len(entry.Content)) +
+			base64.StdEncoding.EncodedLen(len(entry.ACL)) + base64.StdEncoding.EncodedLen(len(entry.Capability))
+	}
+	if !entry.BirthTime.IsZero() {
+		size += gobBirthTimeSize
+	}
+	return size + gobEntryOverhead + len(entry.Content) + len(entry.ACL) + len(entry.Capability)
+}
+
+var ErrUnsupportedChunkFormat = errors.New("unsupported chunk format")
+
+// chunkCodec serializes a chunk's payload.
+type chunkCodec interface {
+	encode(w io.Writer, chunk Chunk) error
+	decode(r io.Reader) (Chunk, error)
+}
+
+var chunkCodecs = map[chunkFormat]chunkCodec{
+	formatGob:  gobCodec{},
+	formatJSON: jsonCodec{},
+}
+
+var chunkFormatNames = map[string]chunkFormat{
+	"gob":  formatGob,
+	"json": formatJSON,
+}
+
+func parseChunkFormat(name string) (chunkFormat, error) {
+	format, ok := chunkFormatNames[name]
+	if !ok {
+		names := make([]string, 0, len(chunkFormatNames))
+		for name := range chunkFormatNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("%w %q (want one of %v)", ErrUnsupportedChunkFormat, name, names)
+	}
+	return format, nil
+}
+
+func codecFor(format chunkFormat) (chunkCodec, error) {
+	codec, ok := chunkCodecs[format]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedChunkFormat, format)
+	}
+	return codec, nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) encode(w io.Writer, chunk Chunk) error {
+	return gob.NewEncoder(w).Encode(chunk)
+}
+
+func (gobCodec) decode(r io.Reader) (Chunk, error) {
+	var chunk Chunk
+	err := gob.NewDecoder(r).Decode(&chunk)
+	return chunk, err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(w io.Writer, chunk Chunk) error {
+	return json.NewEncoder(w).Encode(chunk)
+}
+
+func (jsonCodec) decode(r io.Reader) (Chunk, error) {
+	var chunk Chunk
+	err := json.NewDecoder(r).Decode(&chunk)
+	return chunk, err
+}
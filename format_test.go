@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChunkFormats_RoundTrip(t *testing.T) {
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	entries := []*FileEntry{
+		{Path: "a.txt", Mode: 0640, ModTime: modTime, Size: 5, Content: []byte("hello"), ACL: []byte{2, 0, 0, 0}},
+		{Path: "dir", Mode: os.ModeDir | 0755, ModTime: modTime},
+		{Path: "gone.txt", Deleted: true},
+	}
+
+	for name, format := range chunkFormatNames {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := createBackup(tmpDir, entries, backupOptions{full: true, format: format}); err != nil {
+				t.Fatalf("createBackup() error = %v", err)
+			}
+
+			files, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
+			if len(files) != 1 {
+				t.Fatalf("expected 1 chunk, got %d", len(files))
+			}
+			data, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chunkFormat(data[len(chunkMagic)+1]); got != format {
+				t.Errorf("header records format %d, want %d", got, format)
+			}
+
+			chunk, err := readChunk(files[0])
+			if err != nil {
+				t.Fatalf("readChunk() error = %v", err)
+			}
+			if chunk.format != format || !chunk.Full || !chunk.Final {
+				t.Errorf("unexpected chunk flags: format=%d full=%v final=%v", chunk.format, chunk.Full, chunk.Final)
+			}
+			if len(chunk.Entries) != len(entries) {
+				t.Fatalf("expected %d entries, got %d", len(entries), len(chunk.Entries))
+			}
+			for i, got := range chunk.Entries {
+				want := entries[i]
+				if got.Path != want.Path || got.Mode != want.Mode || !got.ModTime.Equal(want.ModTime) ||
+					got.Deleted != want.Deleted || !bytes.Equal(got.Content, want.Content) || !bytes.Equal(got.ACL, want.ACL) {
+					t.Errorf("entry %d: got %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadChunk_Version2IsGob(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "chunk_1000_000.dat")
+
+	var payload bytes.Buffer
+	chunk := Chunk{Entries: []*FileEntry{{Path: "v2.txt", Content: []byte("v2")}}}
+	if err := gob.NewEncoder(&payload).Encode(chunk); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(payload.Bytes())
+	data := append([]byte(chunkMagic), 2)
+	data = append(append(data, payload.Bytes()...), sum[:]...)
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readChunk(file)
+	if err != nil {
+		t.Fatalf("readChunk() error = %v", err)
+	}
+	if len(got.Entries) != 1 || got.Entries[0].Path != "v2.txt" {
+		t.Errorf("version 2 chunk not decoded correctly: %+v", got)
+	}
+}
+
+func TestReadChunk_UnsupportedFormat(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "chunk_1000_000.dat")
+	data := append([]byte(chunkMagic), chunkVersion, 99)
+	if err := os.WriteFile(file, append(data, "payload"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readChunk(file); !errors.Is(err, ErrUnsupportedChunkFormat) {
+		t.Errorf("expected ErrUnsupportedChunkFormat, got %v", err)
+	}
+}
+
+func TestRewriteChunk_KeepsFormat(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := createBackup(tmpDir, []*FileEntry{{Path: "a.txt", Content: []byte("a")}}, backupOptions{format: formatJSON}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(tmpDir, "chunk_*.dat"))
+
+	chunk, err := readChunk(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk.Entries = nil
+	if err := rewriteChunk(files[0], chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten, err := readChunk(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten.format != formatJSON {
+		t.Errorf("expected the rewritten chunk to stay JSON, got format %d", rewritten.format)
+	}
+}
+
+func TestParseChunkFormat(t *testing.T) {
+	if format, err := parseChunkFormat("json"); err != nil || format != formatJSON {
+		t.Errorf("parseChunkFormat(json) = %d, %v", format, err)
+	}
+	if _, err := parseChunkFormat("msgpack"); !errors.Is(err, ErrUnsupportedChunkFormat) {
+		t.Errorf("expected ErrUnsupportedChunkFormat, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// hashCache remembers the content hash of each file along with the size
+// and modtime it had when hashed, so the first scan after a restart can
+// trust it instead of reading the file again. A file whose size or modtime
+// has changed since is hashed afresh. It is safe for concurrent use.
+type hashCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]cachedHash
+	dirty   bool
+}
+
+type cachedHash struct {
+	Size    int64
+	ModTime int64 // UnixNano
+	Hash    string
+}
+
+// loadHashCache reads the cache persisted at path. A missing or corrupt
+// cache starts empty, since it only saves work.
+func loadHashCache(path string) *hashCache {
+	c := &hashCache{path: path, entries: make(map[string]cachedHash)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &c.entries)
+	}
+	if err != nil || c.entries == nil {
+		log.Printf("Warning: ignoring hash cache %s: %v", path, err)
+		c.entries = make(map[string]cachedHash)
+	}
+	return c
+}
+
+// hashFile returns the content hash of the file at path, taken from the
+// cache if its size and modtime match, or hashed with buf and recorded.
+// A nil cache always hashes.
+func (c *hashCache) hashFile(path, relPath string, d fs.DirEntry, buf []byte) (string, error) {
+	if c == nil {
+		return hashFileBuffer(path, buf)
+	}
+	info, err := d.Info()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	cached, ok := c.entries[relPath]
+	c.mu.Unlock()
+	if ok && cached.Size == info.Size() && cached.ModTime == info.ModTime().UnixNano() {
+		return cached.Hash, nil
+	}
+
+	hash, err := hashFileBuffer(path, buf)
+	if err != nil {
+		return "", err
+	}
+	c.store(relPath, info, hash)
+	return hash, nil
+}
+
+// store records hash for a file that had info when it was read. Files
+// modified within fastScanSettle are not cached, since a write in the same
+// modtime tick would go unnoticed.
+func (c *hashCache) store(relPath string, info fs.FileInfo, hash string) {
+	if c == nil || time.Since(info.ModTime()) < fastScanSettle {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[relPath] = cachedHash{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Hash: hash}
+	c.dirty = true
+}
+
+// retain drops every path not in keep, so files that are gone do not
+// accumulate.
+func (c *hashCache) retain(keep map[string]string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for relPath := range c.entries {
+		if _, ok := keep[relPath]; !ok {
+			delete(c.entries, relPath)
+			c.dirty = true
+		}
+	}
+}
+
+// save writes the cache back to disk if it changed since it was loaded.
+func (c *hashCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
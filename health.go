@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthState tracks the outcome of watch runs for the --health-addr
+// probe. The daemon is healthy while a run has succeeded within maxAge;
+// before the first run completes, the start time stands in for it.
+type healthState struct {
+	mu          sync.Mutex
+	maxAge      time.Duration
+	lastSuccess time.Time
+	lastErr     error
+	failures    int
+}
+
+func newHealthState(maxAge time.Duration) *healthState {
+	return &healthState{maxAge: maxAge, lastSuccess: clock()}
+}
+
+// record notes the result of a run. A nil state ignores it.
+func (h *healthState) record(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.lastErr = err
+		h.failures++
+		return
+	}
+	h.lastSuccess = clock()
+	h.lastErr = nil
+	h.failures = 0
+}
+
+func (h *healthState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	age := clock().Sub(h.lastSuccess)
+	lastSuccess, lastErr, failures := h.lastSuccess, h.lastErr, h.failures
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if age > h.maxAge {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "unhealthy: no successful backup for %s (limit %s)\n", age.Round(time.Second), h.maxAge)
+		if lastErr != nil {
+			fmt.Fprintf(w, "%d consecutive failures, last: %v\n", failures, lastErr)
+		}
+		return
+	}
+	fmt.Fprintf(w, "ok: last successful backup at %s\n", lastSuccess.UTC().Format(time.RFC3339))
+	if lastErr != nil {
+		fmt.Fprintf(w, "%d consecutive failures since, last: %v\n", failures, lastErr)
+	}
+}
+
+// serveHealth answers health probes on listener until ctx is done, then
+// shuts the server down.
+func serveHealth(ctx context.Context, listener net.Listener, h *healthState) error {
+	server := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(listener) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: health endpoint did not shut down cleanly: %v", err)
+	}
+	if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
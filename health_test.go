@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func probe(t *testing.T, h *healthState) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestHealthState_StalledThenRecovered(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	origClock := clock
+	clock = func() time.Time { return now }
+	defer func() { clock = origClock }()
+
+	h := newHealthState(3 * time.Minute)
+	if code, body := probe(t, h); code != http.StatusOK {
+		t.Fatalf("expected a fresh daemon to be healthy, got %d: %s", code, body)
+	}
+
+	// Runs keep failing until the last success is too old
+	now = now.Add(2 * time.Minute)
+	h.record(errors.New("disk full"))
+	if code, body := probe(t, h); code != http.StatusOK || !strings.Contains(body, "disk full") {
+		t.Errorf("expected healthy with the failure reported, got %d: %s", code, body)
+	}
+	now = now.Add(2 * time.Minute)
+	h.record(errors.New("disk full"))
+	code, body := probe(t, h)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a stalled daemon to be unhealthy, got %d: %s", code, body)
+	}
+	if !strings.Contains(body, "no successful backup for 4m0s") || !strings.Contains(body, "2 consecutive failures, last: disk full") {
+		t.Errorf("expected details of the stall, got:\n%s", body)
+	}
+
+	h.record(nil)
+	if code, body := probe(t, h); code != http.StatusOK || strings.Contains(body, "failures") {
+		t.Errorf("expected healthy after a successful run, got %d: %s", code, body)
+	}
+}
+
+func TestServeHealth_StopsWithContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serveHealth(ctx, listener, newHealthState(time.Minute)) }()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "ok") {
+		t.Errorf("expected a healthy probe, got %d: %s", resp.StatusCode, body)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serveHealth() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("health endpoint did not shut down")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// latestVersion selects a file's most recent version.
+const latestVersion = "latest"
+
+type fileVersion struct {
+	Timestamp int64
+	Entry     *FileEntry
+}
+
+// fileVersions returns every backed-up version of relPath, oldest first,
+// including the runs that recorded it as deleted.
+func fileVersions(backupPath, relPath string) ([]fileVersion, error) {
+	files, err := listChunks(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+
+	var versions []fileVersion
+	r := newResolver()
+	for _, chunkFile := range files {
+		chunk, err := readChunk(chunkFile)
+		if err != nil {
+			log.Printf("Error reading %s: %v", chunkFile, err)
+			continue
+		}
+		timestamp, _, _ := parseChunkName(filepath.Base(chunkFile))
+		// Every entry goes through assemble so content references to other
+		// paths resolve
+		for _, entry := range chunk.Entries {
+			if entry = r.assemble(entry, timestamp); entry != nil && entry.Path == relPath {
+				versions = append(versions, fileVersion{Timestamp: timestamp, Entry: entry})
+			}
+		}
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%s is not in the backup", relPath)
+	}
+	return versions, nil
+}
+
+// versionEntry is one version of a path, as listed by printVersions.
+type versionEntry struct {
+	Version   int       `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Op        string    `json:"op"`
+	Size      int64     `json:"size,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+}
+
+// versionListing describes each version, numbered as --restore-file
+// --version takes them.
+func versionListing(versions []fileVersion) []versionEntry {
+	listed := make([]versionEntry, len(versions))
+	for i, v := range versions {
+		listed[i] = versionEntry{Version: i + 1, Timestamp: time.Unix(v.Timestamp, 0).UTC(), Op: "delete"}
+		if v.Entry.Deleted {
+			continue
+		}
+		// A metadata-only version has no content, only the size and hash
+		// recorded at backup time
+		size, hash := int64(len(v.Entry.Content)), v.Entry.ContentHash
+		if v.Entry.MetadataOnly {
+			size = v.Entry.Size
+		} else if hash == "" {
+			hash = hashContent(v.Entry.Content)
+		}
+		listed[i].Op = "write"
+		listed[i].Size = size
+		listed[i].Mode = fmt.Sprintf("%04o", v.Entry.Mode.Perm())
+		listed[i].SHA256 = hash
+	}
+	return listed
+}
+
+// printVersions writes the listing of versions as text, one line per
+// version, or as a JSON array.
+func printVersions(w io.Writer, versions []fileVersion, asJSON bool) error {
+	listed := versionListing(versions)
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(listed)
+	}
+	for _, v := range listed {
+		when := v.Timestamp.Format(time.RFC3339)
+		if v.Op == "delete" {
+			fmt.Fprintf(w, "%3d  %s  delete\n", v.Version, when)
+		} else {
+			fmt.Fprintf(w, "%3d  %s  write   %d bytes  mode %s  sha256 %s\n", v.Version, when, v.Size, v.Mode, v.SHA256)
+		}
+	}
+	return nil
+}
+
+// listVersions prints every version of relPath in backupPath, oldest first,
+// with the run that wrote or deleted it.
+func listVersions(w io.Writer, backupPath, relPath string, asJSON bool) error {
+	versions, err := fileVersions(backupPath, relPath)
+	if err != nil {
+		return err
+	}
+	return printVersions(w, versions, asJSON)
+}
+
+// selectVersion picks a version by its 1-based index in the listing, as
+// the latest version at or before an RFC 3339 time, or, for "latest", the
+// most recent one.
+func selectVersion(versions []fileVersion, spec string) (fileVersion, error) {
+	var selected fileVersion
+	if spec == latestVersion {
+		selected = versions[len(versions)-1]
+	} else if n, err := strconv.Atoi(spec); err == nil {
+		if n < 1 || n > len(versions) {
+			return fileVersion{}, fmt.Errorf("version %d out of range (1-%d)", n, len(versions))
+		}
+		selected = versions[n-1]
+	} else {
+		at, err := time.Parse(time.RFC3339, spec)
+		if err != nil {
+			return fileVersion{}, fmt.Errorf("version %q is neither an index nor an RFC 3339 time", spec)
+		}
+		found := false
+		for _, v := range versions {
+			if v.Timestamp <= at.Unix() {
+				selected, found = v, true
+			}
+		}
+		if !found {
+			return fileVersion{}, fmt.Errorf("no version at or before %s", spec)
+		}
+	}
+
+	if selected.Entry.Deleted {
+		when := time.Unix(selected.Timestamp, 0).UTC().Format(time.RFC3339)
+		return fileVersion{}, fmt.Errorf("%s was deleted as of %s", selected.Entry.Path, when)
+	}
+	return selected, nil
+}
+
+// restoreFileVersion writes one version of relPath into restorePath, or to
+// w when restorePath is empty. Without a version spec it lists the
+// available versions instead.
+func restoreFileVersion(w io.Writer, backupPath, relPath, spec, restorePath string) error {
+	versions, err := fileVersions(backupPath, relPath)
+	if err != nil {
+		return err
+	}
+	if spec == "" {
+		return printVersions(w, versions, false)
+	}
+
+	v, err := selectVersion(versions, spec)
+	if err != nil {
+		return err
+	}
+	if v.Entry.MetadataOnly {
+		when := time.Unix(v.Timestamp, 0).UTC().Format(time.RFC3339)
+		return fmt.Errorf("%s as of %s was backed up without its content (--backup-metadata-only); only its size, %d bytes, and sha256 %s are known",
+			v.Entry.Path, when, v.Entry.Size, v.Entry.ContentHash)
+	}
+	if restorePath == "" {
+		_, err := w.Write(v.Entry.Content)
+		return err
+	}
+
+	targetPath, err := safeJoin(restorePath, filepath.FromSlash(v.Entry.Path))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(targetPath, v.Entry.Content, withDefaultMode(v.Entry).Mode.Perm(), ""); err != nil {
+		return err
+	}
+	if err := os.Chtimes(targetPath, v.Entry.ModTime, v.Entry.ModTime); err != nil {
+		log.Printf("Warning: could not restore times for %s", v.Entry.Path)
+	}
+	log.Printf("Restored %s as of %s", v.Entry.Path, time.Unix(v.Timestamp, 0).UTC().Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFileHistory(t *testing.T, backupPath string) {
+	t.Helper()
+	for i, content := range []string{"first", "second", "third"} {
+		chunk := Chunk{
+			Entries: []*FileEntry{{Path: "docs/notes.txt", Mode: 0644, Content: []byte(content)}},
+			Final:   true,
+		}
+		if err := writeChunk(backupPath, int64(1000*(i+1)), 0, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deletion := Chunk{Entries: []*FileEntry{{Path: "docs/notes.txt", Deleted: true}}, Final: true}
+	if err := writeChunk(backupPath, 4000, 0, deletion); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreFileVersion_ByIndex(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	writeFileHistory(t, tmpBackup)
+
+	if err := restoreFileVersion(nil, tmpBackup, "docs/notes.txt", "2", tmpRestore); err != nil {
+		t.Fatalf("restoreFileVersion() error = %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(tmpRestore, "docs", "notes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "second" {
+		t.Errorf("expected the middle version, got %q", content)
+	}
+}
+
+func TestRestoreFileVersion_ToWriterByTime(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeFileHistory(t, tmpBackup)
+
+	var out bytes.Buffer
+	// 1970-01-01T00:20:00Z is between the first (1000) and second (2000) runs
+	if err := restoreFileVersion(&out, tmpBackup, "docs/notes.txt", "1970-01-01T00:20:00Z", ""); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "first" {
+		t.Errorf("expected the first version, got %q", out.String())
+	}
+}
+
+func TestRestoreFileVersion_ListsVersions(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeFileHistory(t, tmpBackup)
+
+	var out bytes.Buffer
+	if err := restoreFileVersion(&out, tmpBackup, "docs/notes.txt", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 versions, got %d:\n%s", len(lines), out.String())
+	}
+	if !strings.Contains(lines[1], "6 bytes") || !strings.Contains(lines[3], "delete") {
+		t.Errorf("unexpected version listing:\n%s", out.String())
+	}
+}
+
+func TestRestoreFileVersion_Errors(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeFileHistory(t, tmpBackup)
+
+	for _, spec := range []string{"0", "5", "4", "yesterday"} {
+		if err := restoreFileVersion(&bytes.Buffer{}, tmpBackup, "docs/notes.txt", spec, ""); err == nil {
+			t.Errorf("expected an error for version %q", spec)
+		}
+	}
+	if err := restoreFileVersion(&bytes.Buffer{}, tmpBackup, "missing.txt", "", ""); err == nil {
+		t.Error("expected an error for a path that was never backed up")
+	}
+}
+
+func TestRestoreFileVersion_LatestToWriter(t *testing.T) {
+	tmpBackup := t.TempDir()
+	content := []byte("line 1\nline 2\x00binary\n")
+	for i, data := range [][]byte{[]byte("old"), content} {
+		chunk := Chunk{Entries: []*FileEntry{{Path: "secret.conf", Mode: 0600, Content: data}}, Final: true}
+		if err := writeChunk(tmpBackup, int64(1000*(i+1)), 0, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := restoreFileVersion(&out, tmpBackup, "secret.conf", latestVersion, ""); err != nil {
+		t.Fatalf("restoreFileVersion() error = %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("expected the latest content %q, got %q", content, out.Bytes())
+	}
+
+	// The latest version of docs/notes.txt is its deletion
+	writeFileHistory(t, tmpBackup)
+	if err := restoreFileVersion(&bytes.Buffer{}, tmpBackup, "docs/notes.txt", latestVersion, ""); err == nil {
+		t.Error("expected an error for a file whose latest version is deleted")
+	}
+}
+
+func TestListVersions(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeFileHistory(t, tmpBackup)
+	recreated := Chunk{
+		Entries: []*FileEntry{{Path: "docs/notes.txt", Mode: 0600, Content: []byte("fourth!")}},
+		Final:   true,
+	}
+	if err := writeChunk(tmpBackup, 5000, 0, recreated); err != nil {
+		t.Fatal(err)
+	}
+	other := Chunk{Entries: []*FileEntry{{Path: "docs/other.txt", Mode: 0644, Content: []byte("x")}}, Final: true}
+	if err := writeChunk(tmpBackup, 6000, 0, other); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := listVersions(&out, tmpBackup, "docs/notes.txt", true); err != nil {
+		t.Fatalf("listVersions() error = %v", err)
+	}
+	var versions []versionEntry
+	if err := json.Unmarshal(out.Bytes(), &versions); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out.String())
+	}
+
+	want := []struct {
+		timestamp int64
+		op        string
+		content   string
+		mode      string
+	}{
+		{1000, "write", "first", "0644"},
+		{2000, "write", "second", "0644"},
+		{3000, "write", "third", "0644"},
+		{4000, "delete", "", ""},
+		{5000, "write", "fourth!", "0600"},
+	}
+	if len(versions) != len(want) {
+		t.Fatalf("expected %d versions, got %d:\n%s", len(want), len(versions), out.String())
+	}
+	for i, w := range want {
+		v := versions[i]
+		if v.Version != i+1 || v.Timestamp.Unix() != w.timestamp || v.Op != w.op || v.Mode != w.mode {
+			t.Errorf("version %d = %+v, want run %d %s mode %q", i+1, v, w.timestamp, w.op, w.mode)
+		}
+		if w.op == "write" && (v.Size != int64(len(w.content)) || v.SHA256 != hashContent([]byte(w.content))) {
+			t.Errorf("version %d has size %d and hash %s, want those of %q", i+1, v.Size, v.SHA256, w.content)
+		}
+		if w.op == "delete" && (v.Size != 0 || v.SHA256 != "") {
+			t.Errorf("deletion %d should carry no content, got %+v", i+1, v)
+		}
+	}
+
+	out.Reset()
+	if err := listVersions(&out, tmpBackup, "docs/notes.txt", false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(want) || !strings.Contains(lines[3], "delete") ||
+		!strings.Contains(lines[4], "7 bytes  mode 0600  sha256 "+hashContent([]byte("fourth!"))) {
+		t.Errorf("unexpected version listing:\n%s", out.String())
+	}
+
+	var fromRestoreFile bytes.Buffer
+	if err := restoreFileVersion(&fromRestoreFile, tmpBackup, "docs/notes.txt", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if fromRestoreFile.String() != out.String() {
+		t.Errorf("--restore-file listing differs from --list-versions:\n%s\nvs\n%s", fromRestoreFile.String(), out.String())
+	}
+
+	if err := listVersions(&out, tmpBackup, "docs/missing.txt", false); err == nil {
+		t.Error("expected an error for a path not in the backup")
+	}
+}
+
+func TestRestoreFileVersion_MetadataOnly(t *testing.T) {
+	tmpBackup := t.TempDir()
+	chunk := Chunk{
+		Entries: []*FileEntry{{Path: "big.iso", Mode: 0644, Size: 4096, ContentHash: "abc123", MetadataOnly: true}},
+		Final:   true,
+	}
+	if err := writeChunk(tmpBackup, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := restoreFileVersion(&out, tmpBackup, "big.iso", latestVersion, ""); err == nil || !strings.Contains(err.Error(), "without its content") {
+		t.Errorf("expected --stdout to refuse a version without content, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected nothing written to stdout, got %q", out.String())
+	}
+
+	tmpRestore := t.TempDir()
+	if err := restoreFileVersion(nil, tmpBackup, "big.iso", "1", tmpRestore); err == nil {
+		t.Error("expected restoring a version without content to fail")
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "big.iso")); !os.IsNotExist(err) {
+		t.Errorf("expected no file written, stat error = %v", err)
+	}
+}
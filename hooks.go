@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+const defaultHookTimeout = 5 * time.Minute
+
+// runHook runs command through the shell with extra environment variables,
+// killing it after timeout. An empty command does nothing.
+func runHook(command string, timeout time.Duration, env []string) error {
+	if command == "" {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%q timed out after %s", command, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%q: %w", command, err)
+	}
+	return nil
+}
+
+// shellCommand runs command through the shell. On Unix, args become the
+// script's positional parameters, $1 onwards.
+func shellCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", append([]string{"-c", command, "sh"}, args...)...)
+}
+
+// contentTransform filters the content of restored files matching match
+// through command, for filling in placeholders such as machine-specific
+// secrets that were never backed up.
+type contentTransform struct {
+	command string
+	match   *excludeMatcher
+	timeout time.Duration
+}
+
+func (t *contentTransform) matches(relPath string) bool {
+	return t != nil && t.match.excluded(filepath.ToSlash(relPath), false)
+}
+
+// apply runs the command with content on stdin and relPath as $1, also
+// set as AIKIDO_RESTORE_FILE, returning what it writes to stdout. A
+// command that fails or times out is an error; its output is discarded.
+func (t *contentTransform) apply(relPath string, content []byte) ([]byte, error) {
+	timeout := t.timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, t.command, filepath.ToSlash(relPath))
+	cmd.Env = append(os.Environ(), "AIKIDO_RESTORE_FILE="+filepath.ToSlash(relPath))
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("transform %q timed out after %s", t.command, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("transform %q: %w", t.command, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func skipWithoutShell(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("hook tests use POSIX shell syntax")
+	}
+}
+
+func TestBackupOnce_FailingPreHookAbortsBackup(t *testing.T) {
+	skipWithoutShell(t)
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	postMarker := filepath.Join(t.TempDir(), "post")
+
+	opts := watchOptions{
+		watchPath:  tmpWatch,
+		backupPath: tmpBackup,
+		preHook:    "exit 3",
+		postHook:   "touch " + postMarker,
+	}
+	if err := backupOnce(opts); err == nil {
+		t.Fatal("expected a failing pre-hook to abort the backup")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	if len(files) != 0 {
+		t.Errorf("expected no chunks after an aborted backup, got %d", len(files))
+	}
+	if _, err := os.Stat(postMarker); !os.IsNotExist(err) {
+		t.Error("post-hook should not run when the pre-hook aborted the backup")
+	}
+}
+
+func TestBackupOnce_HooksRunAroundBackup(t *testing.T) {
+	skipWithoutShell(t)
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hookDir := t.TempDir()
+	preOut := filepath.Join(hookDir, "pre")
+	postOut := filepath.Join(hookDir, "post")
+
+	opts := watchOptions{
+		watchPath:  tmpWatch,
+		backupPath: tmpBackup,
+		// The pre-hook writes a file into the watched tree, which the scan
+		// must then pick up
+		preHook:  `echo "$AIKIDO_WATCH_PATH" > ` + preOut + ` && echo flushed > "$AIKIDO_WATCH_PATH/state.db"`,
+		postHook: `echo "$AIKIDO_BACKUP_STATUS $AIKIDO_BACKUP_PATH" > ` + postOut,
+	}
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("backupOnce() error = %v", err)
+	}
+
+	pre, err := os.ReadFile(preOut)
+	if err != nil || strings.TrimSpace(string(pre)) != tmpWatch {
+		t.Errorf("pre-hook did not receive the watch path: %q (%v)", pre, err)
+	}
+	post, err := os.ReadFile(postOut)
+	if err != nil || strings.TrimSpace(string(post)) != "ok "+tmpBackup {
+		t.Errorf("post-hook did not run with the backup status: %q (%v)", post, err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 chunk, got %d", len(files))
+	}
+	chunk, err := readChunk(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunk.Entries) != 2 {
+		t.Errorf("expected the file written by the pre-hook to be backed up, got %d entries", len(chunk.Entries))
+	}
+}
+
+func TestRunHook_Timeout(t *testing.T) {
+	skipWithoutShell(t)
+	start := time.Now()
+	err := runHook("sleep 5", 100*time.Millisecond, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Error("hook was not killed at the timeout")
+	}
+}
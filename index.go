@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Content-addressed backups store each chunk as objects/<sha256>.dat, named
+// by the hash of its encoded bytes, so identical chunks share one file. The
+// order of a run's chunks is kept in index_<timestamp>.txt, one hash per
+// line. Readers see them under the usual chunk_<timestamp>_<seq>.dat names,
+// which chunkPath maps to the object.
+const (
+	objectsDir  = "objects"
+	indexPrefix = "index_"
+	indexSuffix = ".txt"
+)
+
+// chunkFiles lists the chunks of backupPath, both timestamp-named files and
+// those of indexed runs, in replay order.
+func chunkFiles(backupPath string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(backupPath, "chunk_*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := filepath.Glob(filepath.Join(backupPath, indexPrefix+"*"+indexSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(files))
+	for _, file := range files {
+		seen[file] = true
+	}
+	for _, index := range indexes {
+		var timestamp int64
+		if _, err := fmt.Sscanf(filepath.Base(index), indexPrefix+"%d"+indexSuffix, &timestamp); err != nil {
+			continue
+		}
+		hashes, err := readRunIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		for seq := range hashes {
+			// A chunk rewritten in place, e.g. by a purge or repair, is a
+			// real file that takes precedence over its object
+			name := filepath.Join(backupPath, fmt.Sprintf("chunk_%d_%03d.dat", timestamp, seq))
+			if !seen[name] {
+				seen[name] = true
+				files = append(files, name)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return chunkLess(files[i], files[j]) })
+	return files, nil
+}
+
+// chunkLess orders chunk files by run timestamp, then sequence number.
+// Both are compared as numbers: sequence numbers are only padded to three
+// digits, so a run of more than 1000 chunks does not sort by name.
+func chunkLess(a, b string) bool {
+	tsA, seqA, okA := parseChunkName(filepath.Base(a))
+	tsB, seqB, okB := parseChunkName(filepath.Base(b))
+	if !okA || !okB {
+		return a < b
+	}
+	if tsA != tsB {
+		return tsA < tsB
+	}
+	return seqA < seqB
+}
+
+// indexedObjects returns the hashes of every object a run index in
+// backupPath names.
+func indexedObjects(backupPath string) (map[string]bool, error) {
+	indexes, err := filepath.Glob(filepath.Join(backupPath, indexPrefix+"*"+indexSuffix))
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool)
+	for _, index := range indexes {
+		hashes, err := readRunIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range hashes {
+			referenced[hash] = true
+		}
+	}
+	return referenced, nil
+}
+
+func readRunIndex(index string) ([]string, error) {
+	data, err := os.ReadFile(index)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// chunkPath returns the file holding the chunk named filename: filename
+// itself, or the object an index maps it to if no such file exists.
+func chunkPath(filename string) string {
+	if _, err := os.Stat(filename); !errors.Is(err, fs.ErrNotExist) {
+		return filename
+	}
+	timestamp, seq, ok := parseChunkName(filepath.Base(filename))
+	if !ok {
+		return filename
+	}
+	dir := filepath.Dir(filename)
+	hashes, err := readRunIndex(filepath.Join(dir, fmt.Sprintf("%s%d%s", indexPrefix, timestamp, indexSuffix)))
+	if err != nil || seq >= len(hashes) {
+		return filename
+	}
+	return filepath.Join(dir, objectsDir, hashes[seq]+".dat")
+}
+
+// writeObject stores chunk under the hash of its encoding, returning the
+// hash and, if the object did not exist yet, the file it created.
+func writeObject(backupPath string, chunk Chunk, mode fsyncMode) (string, string, error) {
+	var buf bytes.Buffer
+	if err := encodeChunk(&buf, chunk); err != nil {
+		return "", "", err
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+
+	dir := filepath.Join(backupPath, objectsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+	filename := filepath.Join(dir, hash+".dat")
+	if _, err := os.Stat(filename); err == nil {
+		return hash, "", nil
+	}
+	tmp := filename + ".tmp"
+	if err := writeSynced(tmp, buf.Bytes(), mode); err != nil {
+		os.Remove(tmp)
+		return "", "", err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return "", "", err
+	}
+	return hash, filename, mode.syncDir(dir)
+}
+
+// writeRunIndex records the order of a run's objects. It is written after
+// all of them, so a run without an index is never replayed.
+func writeRunIndex(backupPath string, timestamp int64, hashes []string, mode fsyncMode) error {
+	filename := filepath.Join(backupPath, fmt.Sprintf("%s%d%s", indexPrefix, timestamp, indexSuffix))
+	tmp := filename + ".tmp"
+	if err := writeSynced(tmp, []byte(strings.Join(hashes, "\n")+"\n"), mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	return mode.syncDir(backupPath)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// restoreJournalName is kept in the restore target while a restore runs.
+const restoreJournalName = ".aikido-restore-journal"
+
+// restoreJournal records each file a restore has finished writing, one
+// "<content hash> <quoted path>" line per file, so an interrupted restore
+// can be re-run without rewriting them.
+type restoreJournal struct {
+	path string
+	done map[string]string
+	file *os.File
+}
+
+// openRestoreJournal loads the journal left by an interrupted restore into
+// restorePath, if any, and opens it for appending.
+func openRestoreJournal(restorePath string) (*restoreJournal, error) {
+	j := &restoreJournal{
+		path: filepath.Join(restorePath, restoreJournalName),
+		done: make(map[string]string),
+	}
+
+	data, err := os.ReadFile(j.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// A line torn by the interruption fails to parse and is ignored
+		hash, quoted, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		if relPath, err := strconv.Unquote(quoted); err == nil {
+			j.done[relPath] = hash
+		}
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// restored reports whether relPath was already written with content of this
+// hash, and is still in place with the size and modtime restore gave it.
+func (j *restoreJournal) restored(relPath, targetPath, hash string, size int, modTime time.Time) bool {
+	if j.done[relPath] != hash {
+		return false
+	}
+	info, err := os.Stat(targetPath)
+	return err == nil && info.Mode().IsRegular() && info.Size() == int64(size) && info.ModTime().Equal(modTime)
+}
+
+func (j *restoreJournal) record(relPath, hash string) error {
+	_, err := fmt.Fprintf(j.file, "%s %s\n", hash, strconv.Quote(relPath))
+	return err
+}
+
+func (j *restoreJournal) close() {
+	j.file.Close()
+}
+
+// remove deletes the journal once the restore has completed.
+func (j *restoreJournal) remove() error {
+	j.close()
+	return os.Remove(j.path)
+}
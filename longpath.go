@@ -0,0 +1,21 @@
+package main
+
+import "strings"
+
+// maxPath is the length at which Win32 file APIs stop accepting a path
+// unless it carries the extended-length prefix.
+const maxPath = 260
+
+// extendedLengthPath adds the \\?\ prefix to an absolute, cleaned Windows
+// path of maxPath characters or more, so the file APIs accept it. UNC paths
+// (\\server\share\...) take the \\?\UNC\ form. Shorter and already prefixed
+// paths are returned as they are.
+func extendedLengthPath(abs string) string {
+	if len(abs) < maxPath || strings.HasPrefix(abs, `\\?\`) {
+		return abs
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtendedLengthPath(t *testing.T) {
+	deep := `C:\restore\` + strings.Repeat(`nested-directory\`, 16) + "file.txt"
+	deepUNC := `\\server\share\` + strings.Repeat(`nested-directory\`, 16) + "file.txt"
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"short path", `C:\restore\file.txt`, `C:\restore\file.txt`},
+		{"over-long path", deep, `\\?\` + deep},
+		{"over-long UNC path", deepUNC, `\\?\UNC\server\share\` + deepUNC[len(`\\server\share\`):]},
+		{"already prefixed", `\\?\` + deep, `\\?\` + deep},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extendedLengthPath(tt.path); got != tt.want {
+				t.Errorf("extendedLengthPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import "path/filepath"
+
+// longPath makes a restore target usable when it exceeds MAX_PATH.
+func longPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return extendedLengthPath(abs)
+}
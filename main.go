@@ -1,54 +1,813 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// expandPath expands $VAR, ${VAR}, and a leading ~ in a path flag. An unset
+// variable is an error rather than silently expanding to nothing.
+func expandPath(p string) (string, error) {
+	var missing []string
+	p = os.Expand(p, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+
+	if p == "~" || strings.HasPrefix(p, "~/") || strings.HasPrefix(p, "~"+string(filepath.Separator)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		p = filepath.Join(home, p[1:])
+	}
+	return p, nil
+}
+
+// parseSize parses a byte count with an optional K, M, G, or T suffix
+// (powers of 1024, optionally followed by B), such as "50G" or "512MB".
+func parseSize(s string) (int64, error) {
+	units := []string{"K", "M", "G", "T"}
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	multiplier := int64(1)
+	for i, unit := range units {
+		if strings.HasSuffix(value, unit) {
+			value = strings.TrimSuffix(value, unit)
+			multiplier = int64(1) << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
 func main() {
-	watchPath := flag.String("watch", "", "path to watch")
-	backupPath := flag.String("backup", "", "path to backup")
-	refreshInterval := flag.Int("refresh", 60, "scan interval in seconds")
-	restorePath := flag.String("restore", "", "path to restored files")
+	os.Exit(run(os.Args[1:], os.Stdout))
+}
+
+// Exit codes. exitUsage matches what the flag package uses for bad flags.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+	exitPartial = 3
+)
+
+// partialError reports a run that finished but could not do all of its
+// work, such as a restore that had to skip some files.
+type partialError struct {
+	msg string
+}
+
+func (e *partialError) Error() string {
+	return e.msg
+}
+
+func exitCode(err error) int {
+	var partial *partialError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &partial):
+		return exitPartial
+	default:
+		return exitFailure
+	}
+}
+
+// fail logs err and returns the matching exit code.
+func fail(err error) int {
+	log.Println(err)
+	return exitCode(err)
+}
+
+// startProfiling starts a CPU profile and/or execution trace. The returned
+// stop function flushes them and must run before the process exits.
+func startProfiling(cpuFile, traceFile string) (func(), error) {
+	var stops []func()
+	stop := func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	if cpuFile != "" {
+		f, err := os.Create(cpuFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+
+	if traceFile != "" {
+		f, err := os.Create(traceFile)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			stop()
+			return nil, err
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+
+	return stop, nil
+}
+
+func run(args []string, stdout io.Writer) int {
+	var cmd *command
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		c, ok := findCommand(args[0])
+		if !ok {
+			log.Printf("Error: unknown command %q (want one of %s)", args[0], strings.Join(commandNames(), ", "))
+			return exitUsage
+		}
+		cmd, args = c, args[1:]
+	}
+
+	fs := flag.NewFlagSet("aikido-backup", flag.ContinueOnError)
+	watchPath := fs.String("watch", "", "path to watch")
+	var backupPaths stringList
+	fs.Var(&backupPaths, "backup", "path to backup (repeat with --restore to merge several backups, or when backing up to write every chunk to each)")
+	writePolicyName := fs.String("write-policy", "all", "with repeated --backup, how many destinations must store each chunk: all, quorum, or any")
+	refreshInterval := fs.Int("refresh", 60, "scan interval in seconds")
+	maxBackoff := fs.Duration("max-error-backoff", 30*time.Minute, "in watch mode, double the wait after each consecutive failed backup, up to this long (0 keeps the --refresh interval)")
+	intervalJitter := fs.Duration("interval-jitter", 0, "in watch mode, shift each wait between scans by a random amount of up to this much either way, e.g. 10s")
+	restorePath := fs.String("restore", "", "path to restored files")
+	dereferenceRoot := fs.Bool("dereference-root", false, "resolve --watch through symlinks before scanning, so a symlinked root is scanned as its target")
+	pidFile := fs.String("pid-file", "", "record this process's PID here, refusing to start while another live instance holds it")
+	healthAddr := fs.String("health-addr", "", "in watch mode, serve an HTTP health probe on this address, e.g. :8080")
+	healthMaxAge := fs.Duration("health-max-age", 0, "report unhealthy when no backup has succeeded for this long (default 3 times --refresh)")
+	idleFor := fs.Duration("backup-if-idle", 0, "defer a backup while anything in --watch was modified within this long, e.g. 30s")
+	verifySnapshot := fs.Bool("verify-snapshot", false, "at startup, check the snapshot against the backup's chunks and rebuild it if they disagree")
+	dryScan := fs.Bool("dry-scan", false, "walk and hash --watch without backing it up, estimating the time and chunk count of an initial backup")
+	observeOnly := fs.Bool("observe", false, "scan --watch every --refresh interval and report what changed, without backing anything up")
+	backupNow := fs.Bool("backup-now", false, "run a single backup of --watch and exit")
+	hashCacheFile := fs.String("hash-cache", "", "file to persist content hashes in, keyed by size and modtime, so scans after a restart skip rehashing unchanged files")
+	snapshotFile := fs.String("snapshot-file", "", "path to the persisted snapshot (default <backup>/snapshot.json)")
+	fullEvery := fs.Int("full-every", 0, "make every Nth backup run a full snapshot (0 disables)")
+	entriesPerChunk := fs.Int("entries-per-chunk", 0, "start a new chunk once one holds this many entries, even if it is under 5MB (0 for unlimited)")
+	sourceLabel := fs.String("source-label", "", "label recorded with each run naming the backed-up tree (default the absolute --watch path)")
+	maxChunks := fs.Int("max-chunks-per-run", 0, "abort a backup run that would write more than this many chunks (0 for unlimited)")
+	preHook := fs.String("pre-backup-hook", "", "shell command to run before each backup; a failure skips the backup")
+	postHook := fs.String("post-backup-hook", "", "shell command to run after each backup")
+	hookTimeout := fs.Duration("hook-timeout", defaultHookTimeout, "how long a backup hook or restore --transform may run before it is killed")
+	inflightMB := fs.Int("inflight-budget", 32, "max MB of file content held in memory during a backup (0 for unbounded)")
+	comparePath := fs.String("compare", "", "live path to diff against the final state of --backup")
+	restoreFile := fs.String("restore-file", "", "restore a single file's history; lists its versions unless --version is set")
+	version := fs.String("version", "", "with --restore-file, the version to restore: an index from the listing, an RFC 3339 time, or latest")
+	toStdout := fs.Bool("stdout", false, "with --restore-file, write the file's content to stdout, the latest version unless --version is set")
+	listVersionsOf := fs.String("list-versions", "", "list every backed-up version of this path in --backup, with the run that wrote or deleted it")
+	asJSON := fs.Bool("json", false, "with --list-versions, print the versions as JSON")
+	verify := fs.Bool("verify", false, "check every chunk in --backup against its checksum")
+	mirrorPath := fs.String("mirror", "", "with --verify or --verify-sample, repair corrupt chunks from this copy of the backup")
+	verifySampleSize := fs.Int("verify-sample", 0, "in watch mode, check this many random chunks of --backup against their checksums after every scan")
+	list := fs.Bool("list", false, "list the backup runs in --backup")
+	stats := fs.Bool("stats", false, "print statistics about --backup")
+	filterDeleted := fs.Bool("filter-deleted", false, "with --list or --stats, only report deletions")
+	top := fs.Int("top", 0, "with --stats, list this many of the most frequently changed files")
+	snapshotOnly := fs.Bool("snapshot-only", false, "print the resolved live state of --backup as JSON without restoring anything")
+	follow := fs.Bool("follow", false, "with --list, keep running and print each new run as it finishes")
+	purge := fs.Bool("purge-tombstones", false, "drop paths deleted longer than --tombstone-retention from --backup")
+	maxTotalSize := fs.String("max-total-size", "", "prune the oldest runs of --backup until its chunks total at most this size, e.g. 50G")
+	dryRun := fs.Bool("prune-dry-run", false, "with --max-total-size, report what would be pruned without removing anything")
+	retention := fs.Duration("tombstone-retention", 30*24*time.Hour, "how long a deleted path is kept before it can be purged")
+	growing := fs.String("growing-files", "", "how to store a file that grows while being read: prefix (its length when stat'd) or retry")
+	excludeOlderThan := fs.Duration("exclude-older-than", 0, "skip files last modified longer ago than this, e.g. 720h")
+	excludeNewerThan := fs.Duration("exclude-newer-than", 0, "skip files last modified more recently than this, e.g. 10m")
+	failOnSkip := fs.Bool("fail-on-skip", false, "fail a backup run instead of skipping files it cannot read")
+	maxScanDuration := fs.Duration("max-scan-duration", 0, "abort a scan that takes longer than this and skip that backup, e.g. 5m (0 disables)")
+	hashBufferSize := fs.String("hash-buffer-size", "1M", "how much of a file each read takes while hashing it, e.g. 256K or 4M")
+	parallelWalk := fs.Int("parallel-walk", 0, "walk up to this many top-level directories of --watch at once, for fast storage (0 walks serially)")
+	fastScan := fs.Bool("fast-scan", false, "skip rereading files in directories whose modtime is unchanged (can miss in-place edits)")
+	metadataOnly := fs.Bool("backup-metadata-only", false, "back up paths, sizes, modes, modtimes, and hashes without file content")
+	maxDeleteRatio := fs.Float64("max-delete-ratio", 0, "skip a backup whose scan finds more than this fraction of tracked files deleted, e.g. 0.5 (0 disables)")
+	confirmMassDelete := fs.Bool("confirm-mass-delete", false, "let the first backup proceed even if it exceeds --max-delete-ratio")
+	noDelete := fs.Bool("no-delete", false, "never record deletions, so files that vanish from --watch stay in the backup as last seen")
+	var excludes stringList
+	fs.Var(&excludes, "exclude", "gitignore-style pattern to exclude from backup (repeatable)")
+	ignoreCase := fs.Bool("ignore-case-glob", false, "match exclude patterns case-insensitively")
+	excludeFrom := fs.String("exclude-from", "", "file of exclude patterns, one per line")
+	stripPrefix := fs.String("strip-prefix", "", "leading path prefix to remove from restored entries")
+	addPrefix := fs.String("add-prefix", "", "path prefix to prepend to restored entries")
+	modifiedAfter := fs.String("modified-after", "", "restore only files modified after this RFC 3339 time")
+	base := fs.String("base", "", "restore onto this existing tree, e.g. a recent image, rewriting only files that differ and removing those the backup records as deleted")
+	removeExtraFiles := fs.Bool("remove-extras", false, "with --base, also remove files the backup does not hold")
+	emptyAsDelete := fs.Bool("backup-empty-content-as-delete", false, "with --restore, treat every file stored with no content as a deletion, to recover backups whose imports wrote empty entries instead of deletions; RISKY: genuinely empty files are not restored and hide their earlier versions")
+	var restoreExcludes stringList
+	fs.Var(&restoreExcludes, "restore-exclude", "with --restore, gitignore-style pattern of target paths to leave alone (repeatable)")
+	preserveNewer := fs.Bool("preserve-target-newer", false, "with --restore, keep target files modified more recently than their backed-up version")
+	expectSource := fs.String("expect-source", "", "with --restore, refuse a backup whose latest run was not labelled with this source")
+	transformCommand := fs.String("transform", "", "with --restore, shell command that filters the content of files matching --transform-match: content on stdin, path as $1, output written")
+	var transformMatches stringList
+	fs.Var(&transformMatches, "transform-match", "gitignore-style pattern of restored paths to run through --transform (repeatable)")
+	var tracePaths stringList
+	fs.Var(&tracePaths, "trace-path", "with --restore, log every chunk that touched this backed-up path and which one won (repeatable)")
+	simulate := fs.Bool("simulate-restore", false, "with --restore, report which files would be created, are identical, or conflict, without writing anything")
+	forceOverwrite := fs.Bool("force-overwrite", false, "make read-only files in the restore target writable so they can be replaced, instead of skipping them")
+	execBitOnly := fs.Bool("exec-bit-only", false, "for restore targets that cannot store Unix modes, only preserve the executable bit")
+	cpuProfile := fs.String("cpuprofile", "", "write a CPU profile to this file")
+	traceFile := fs.String("trace", "", "write an execution trace to this file")
+	importTarPath := fs.String("import-tar", "", "seed --backup with a full run from this tar archive (- for stdin), optionally gzipped")
+	filesFrom := fs.String("files-from", "", "back up only the paths listed in this file (- for stdin) instead of scanning --watch")
+	manifestDir := fs.String("checksum-manifest", "", "directory to write a checksum manifest of each backup run to")
+	deletionLog := fs.String("deletion-log", "", "file to append a line to for every deletion a backup run records, for auditing")
+	formatName := fs.String("format", "gob", "chunk serialization for new backups: gob or json")
+	chunkFsync := fs.String("chunk-fsync", "always", "how new chunks are flushed to disk: always (file and directory), dir (directory only), or none")
+	contentAddressed := fs.Bool("content-addressed", false, "name new chunks by the hash of their content, with a per-run index, so identical chunks are stored once")
+	tempDir := fs.String("temp-dir", "", "directory for restore's temporary files (default: next to each restored file)")
+
+	if cmd != nil {
+		fs.Usage = func() { cmd.printUsage(stdout, fs) }
+	} else {
+		fs.Usage = func() {
+			printCommands(fs.Output())
+			fs.PrintDefaults()
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if cmd != nil {
+		if err := cmd.apply(fs); err != nil {
+			log.Printf("Error: %v", err)
+			return exitUsage
+		}
+	} else if name := legacyCommand(fs); name != "" {
+		log.Printf("Warning: selecting a mode by flags alone is deprecated and will stop working in the next release; use ./app %s instead", name)
+	}
+
+	// Watch mode returns on SIGINT/SIGTERM, so profiles are flushed on
+	// shutdown too
+	stopProfiling, err := startProfiling(*cpuProfile, *traceFile)
+	if err != nil {
+		return fail(err)
+	}
+	defer stopProfiling()
+
+	paths := []*string{watchPath, restorePath, manifestDir, base, deletionLog, pidFile}
+	for i := range backupPaths {
+		paths = append(paths, &backupPaths[i])
+	}
+	for _, p := range paths {
+		expanded, err := expandPath(*p)
+		if err != nil {
+			return fail(fmt.Errorf("expanding %q: %w", *p, err))
+		}
+		*p = expanded
+	}
+
+	// Paths are then computed against the real directory, whatever the
+	// symlinks on the way to it
+	if *dereferenceRoot && *watchPath != "" {
+		resolved, err := filepath.EvalSymlinks(*watchPath)
+		if err != nil {
+			return fail(fmt.Errorf("resolving --watch: %w", err))
+		}
+		*watchPath = resolved
+	}
+
+	// --base names the restore target, which it updates in place
+	if *base != "" {
+		if *restorePath != "" && filepath.Clean(*restorePath) != filepath.Clean(*base) {
+			log.Println("Error: --base is restored onto in place; give it instead of --restore")
+			return exitUsage
+		}
+		*restorePath = *base
+	}
+	if *removeExtraFiles && *base == "" {
+		log.Println("Error: --remove-extras requires --base")
+		return exitUsage
+	}
+
+	// Restore merges several backups and watch mode writes to all of them;
+	// every other mode uses one
+	backupPath := ""
+	if len(backupPaths) > 0 {
+		backupPath = backupPaths[0]
+	}
+	restoring := *restorePath != "" && !*observeOnly && *filesFrom == "" && *importTarPath == "" && !*backupNow && *watchPath == "" && *restoreFile == ""
+	watching := *watchPath != "" && !*observeOnly && *filesFrom == "" && *importTarPath == ""
+	if len(backupPaths) > 1 && !restoring && !watching {
+		log.Println("Error: --backup can only be repeated with --restore, --watch, or --backup-now")
+		return exitUsage
+	}
+	writePolicy, err := parseWritePolicy(*writePolicyName)
+	if err != nil {
+		log.Printf("Error: --write-policy: %v", err)
+		return exitUsage
+	}
 
-	flag.Parse()
+	if *asJSON && *listVersionsOf == "" {
+		log.Println("Error: --json requires --list-versions")
+		return exitUsage
+	}
+	if *follow && !*list {
+		log.Println("Error: --follow requires --list")
+		return exitUsage
+	}
+
+	if *growing != "" && *growing != growingPrefix && *growing != growingRetry {
+		log.Printf("Error: --growing-files must be %q or %q", growingPrefix, growingRetry)
+		return exitUsage
+	}
+	if *maxDeleteRatio < 0 || *maxDeleteRatio > 1 {
+		log.Println("Error: --max-delete-ratio must be between 0 and 1")
+		return exitUsage
+	}
+	hashBuffer, err := parseSize(*hashBufferSize)
+	if err != nil || hashBuffer == 0 || hashBuffer > 1<<30 {
+		log.Printf("Error: --hash-buffer-size must be a size between 1 byte and 1G, got %q", *hashBufferSize)
+		return exitUsage
+	}
+	if *entriesPerChunk < 0 {
+		log.Println("Error: --entries-per-chunk cannot be negative")
+		return exitUsage
+	}
+	if *parallelWalk < 0 {
+		log.Println("Error: --parallel-walk cannot be negative")
+		return exitUsage
+	}
+	if *verifySampleSize < 0 {
+		log.Println("Error: --verify-sample cannot be negative")
+		return exitUsage
+	}
+	// A full run replaces everything before it, which would drop the paths
+	// --no-delete keeps
+	if *noDelete && *fullEvery > 0 {
+		log.Println("Error: --no-delete cannot be combined with --full-every")
+		return exitUsage
+	}
+	if *excludeOlderThan > 0 && *excludeNewerThan >= *excludeOlderThan {
+		log.Println("Error: --exclude-newer-than must be shorter than --exclude-older-than")
+		return exitUsage
+	}
+	scan := scanOptions{
+		fastScan:          *fastScan,
+		failOnSkip:        *failOnSkip,
+		growing:           *growing,
+		excludeOlderThan:  *excludeOlderThan,
+		excludeNewerThan:  *excludeNewerThan,
+		metadataOnly:      *metadataOnly,
+		maxDuration:       *maxScanDuration,
+		noDelete:          *noDelete,
+		maxDeleteRatio:    *maxDeleteRatio,
+		confirmMassDelete: *confirmMassDelete,
+		walkers:           *parallelWalk,
+		hashBufferSize:    int(hashBuffer),
+	}
+	if *excludeFrom != "" || len(excludes) > 0 {
+		var patterns []string
+		if *excludeFrom != "" {
+			filePatterns, err := loadExcludeFile(*excludeFrom)
+			if err != nil {
+				return fail(fmt.Errorf("reading --exclude-from: %w", err))
+			}
+			patterns = append(patterns, filePatterns...)
+		}
+		patterns = append(patterns, excludes...)
+
+		matcher, err := newExcludeMatcher(patterns, *ignoreCase)
+		if err != nil {
+			return fail(err)
+		}
+		scan.exclude = matcher
+	}
+
+	format, err := parseChunkFormat(*formatName)
+	if err != nil {
+		log.Printf("Error: --format: %v", err)
+		return exitUsage
+	}
 
-	if *watchPath != "" {
-		if *backupPath == "" {
+	if *pidFile != "" {
+		release, err := acquirePIDFile(*pidFile)
+		if err != nil {
+			return fail(fmt.Errorf("--pid-file: %w", err))
+		}
+		defer release()
+	}
+
+	fsync, err := parseFsyncMode(*chunkFsync)
+	if err != nil {
+		log.Printf("Error: --chunk-fsync: %v", err)
+		return exitUsage
+	}
+
+	var budget *byteBudget
+	if *inflightMB > 0 {
+		budget = newByteBudget(int64(*inflightMB) * 1024 * 1024)
+	}
+
+	if *observeOnly {
+		if *watchPath == "" {
+			log.Println("Error: --watch required for observe mode")
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --observe --watch <path> [--refresh <seconds>]")
+			return exitUsage
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		opts := watchOptions{
+			watchPath: *watchPath,
+			refresh:   time.Duration(*refreshInterval) * time.Second,
+			scan:      scan,
+		}
+		if err := observe(ctx, stdout, opts); err != nil {
+			return fail(err)
+		}
+	} else if *dryScan {
+		if *watchPath == "" {
+			log.Println("Error: --watch required with --dry-scan")
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --dry-scan --watch <path>")
+			return exitUsage
+		}
+		bench, err := benchScan(*watchPath, scan, format)
+		if err != nil {
+			return fail(err)
+		}
+		printScanBench(stdout, bench)
+	} else if *importTarPath != "" {
+		if backupPath == "" {
+			log.Println("Error: --backup required with --import-tar")
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --import-tar <file|-> --backup <path>")
+			return exitUsage
+		}
+		archive := os.Stdin
+		if *importTarPath != "-" {
+			file, err := os.Open(*importTarPath)
+			if err != nil {
+				return fail(fmt.Errorf("opening --import-tar: %w", err))
+			}
+			defer file.Close()
+			archive = file
+		}
+		opts := backupOptions{
+			budget:           budget,
+			maxChunks:        *maxChunks,
+			maxEntries:       *entriesPerChunk,
+			source:           *sourceLabel,
+			format:           format,
+			contentAddressed: *contentAddressed,
+			fsync:            fsync,
+		}
+		if _, err := importTar(archive, backupPath, opts); err != nil {
+			return fail(err)
+		}
+	} else if *filesFrom != "" {
+		if *watchPath == "" || backupPath == "" {
+			log.Println("Error: --watch and --backup required with --files-from")
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --files-from <file|-> --watch <path> --backup <path> [--snapshot-file <path>]")
+			return exitUsage
+		}
+		list := os.Stdin
+		if *filesFrom != "-" {
+			file, err := os.Open(*filesFrom)
+			if err != nil {
+				return fail(fmt.Errorf("opening --files-from: %w", err))
+			}
+			defer file.Close()
+			list = file
+		}
+		opts := watchOptions{
+			watchPath:        *watchPath,
+			backupPath:       backupPath,
+			snapshotFile:     *snapshotFile,
+			maxChunks:        *maxChunks,
+			entriesPerChunk:  *entriesPerChunk,
+			source:           *sourceLabel,
+			format:           format,
+			contentAddressed: *contentAddressed,
+			fsync:            fsync,
+		}
+		if _, err := backupFileList(opts, list); err != nil {
+			return fail(err)
+		}
+	} else if *backupNow {
+		if *watchPath == "" || backupPath == "" {
+			log.Println("Error: --watch and --backup required for backup-now mode")
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --backup-now --watch <path> --backup <path> [--snapshot-file <path>]")
+			return exitUsage
+		}
+		opts := watchOptions{
+			watchPath:        *watchPath,
+			backupPath:       backupPath,
+			snapshotFile:     *snapshotFile,
+			fullEvery:        *fullEvery,
+			maxChunks:        *maxChunks,
+			entriesPerChunk:  *entriesPerChunk,
+			source:           *sourceLabel,
+			preHook:          *preHook,
+			postHook:         *postHook,
+			hookTimeout:      *hookTimeout,
+			scan:             scan,
+			budget:           budget,
+			format:           format,
+			manifestDir:      *manifestDir,
+			deletionLog:      *deletionLog,
+			idleFor:          *idleFor,
+			verifySnapshot:   *verifySnapshot,
+			contentAddressed: *contentAddressed,
+			fsync:            fsync,
+			hashCacheFile:    *hashCacheFile,
+			replicas:         backupPaths[1:],
+			writePolicy:      writePolicy,
+		}
+		if err := backupOnce(opts); err != nil {
+			return fail(err)
+		}
+	} else if *watchPath != "" {
+		if backupPath == "" {
 			log.Println("Error: --backup required for watch mode")
-			fmt.Println("\nUsage:")
-			fmt.Println("  ./app --watch <path> --backup <path> --refresh <seconds>")
-			os.Exit(1)
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --watch <path> --backup <path> --refresh <seconds>")
+			return exitUsage
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		opts := watchOptions{
+			watchPath:        *watchPath,
+			backupPath:       backupPath,
+			refresh:          time.Duration(*refreshInterval) * time.Second,
+			jitter:           *intervalJitter,
+			maxBackoff:       *maxBackoff,
+			verifySample:     *verifySampleSize,
+			verifyMirror:     *mirrorPath,
+			snapshotFile:     *snapshotFile,
+			fullEvery:        *fullEvery,
+			maxChunks:        *maxChunks,
+			entriesPerChunk:  *entriesPerChunk,
+			source:           *sourceLabel,
+			preHook:          *preHook,
+			postHook:         *postHook,
+			hookTimeout:      *hookTimeout,
+			scan:             scan,
+			budget:           budget,
+			format:           format,
+			manifestDir:      *manifestDir,
+			deletionLog:      *deletionLog,
+			idleFor:          *idleFor,
+			verifySnapshot:   *verifySnapshot,
+			contentAddressed: *contentAddressed,
+			fsync:            fsync,
+			hashCacheFile:    *hashCacheFile,
+			replicas:         backupPaths[1:],
+			writePolicy:      writePolicy,
+		}
+		var healthDone chan struct{}
+		if *healthAddr != "" {
+			listener, err := net.Listen("tcp", *healthAddr)
+			if err != nil {
+				return fail(fmt.Errorf("--health-addr: %w", err))
+			}
+			maxAge := *healthMaxAge
+			if maxAge <= 0 {
+				maxAge = 3 * opts.refresh
+			}
+			opts.health = newHealthState(maxAge)
+			healthDone = make(chan struct{})
+			go func() {
+				defer close(healthDone)
+				if err := serveHealth(ctx, listener, opts.health); err != nil {
+					log.Printf("Health endpoint error: %v", err)
+				}
+			}()
+			log.Printf("Serving health probes on http://%s/", listener.Addr())
+		}
+		err := watch(ctx, opts)
+		// The health endpoint shuts down with the watch loop
+		stop()
+		if healthDone != nil {
+			<-healthDone
+		}
+		if err != nil {
+			return fail(err)
+		}
+	} else if *listVersionsOf != "" {
+		if backupPath == "" {
+			log.Println("Error: --backup required to list a file's versions")
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --list-versions <path> --backup <path> [--json]")
+			return exitUsage
+		}
+		if err := listVersions(stdout, backupPath, *listVersionsOf, *asJSON); err != nil {
+			return fail(err)
+		}
+	} else if *restoreFile != "" {
+		if backupPath == "" {
+			log.Println("Error: --backup required to restore a file version")
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --restore-file <path> --backup <path> [--version <N|time|latest>] [--restore <path> | --stdout]")
+			return exitUsage
+		}
+		if *toStdout {
+			if *restorePath != "" {
+				log.Println("Error: --stdout and --restore cannot be combined")
+				return exitUsage
+			}
+			if *version == "" {
+				*version = latestVersion
+			}
 		}
-		if err := watch(*watchPath, *backupPath, *refreshInterval); err != nil {
-			log.Fatal(err)
+		if err := restoreFileVersion(stdout, backupPath, *restoreFile, *version, *restorePath); err != nil {
+			return fail(err)
 		}
 	} else if *restorePath != "" {
-		if *backupPath == "" {
+		if backupPath == "" {
 			log.Println("Error: --backup required for restore mode")
-			fmt.Println("\nUsage:")
-			fmt.Println("  ./app --restore <path> --backup <path>")
-			os.Exit(1)
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --restore <path> --backup <path> [--strip-prefix <prefix>] [--add-prefix <prefix>]")
+			return exitUsage
+		}
+		opts := restoreOptions{
+			stripPrefix:    *stripPrefix,
+			addPrefix:      *addPrefix,
+			tempDir:        *tempDir,
+			execBitOnly:    *execBitOnly,
+			mergeFrom:      backupPaths[1:],
+			forceOverwrite: *forceOverwrite,
+			overlay:        *base != "",
+			removeExtras:   *removeExtraFiles,
+			tracePaths:     tracePaths,
+			emptyAsDelete:  *emptyAsDelete,
+			preserveNewer:  *preserveNewer,
+			expectSource:   *expectSource,
+		}
+		if (*transformCommand == "") != (len(transformMatches) == 0) {
+			log.Println("Error: --transform and --transform-match must be used together")
+			return exitUsage
+		}
+		if *transformCommand != "" {
+			matcher, err := newExcludeMatcher(transformMatches, *ignoreCase)
+			if err != nil {
+				log.Printf("Error: --transform-match: %v", err)
+				return exitUsage
+			}
+			opts.transform = &contentTransform{command: *transformCommand, match: matcher, timeout: *hookTimeout}
+		}
+		if len(restoreExcludes) > 0 {
+			matcher, err := newExcludeMatcher(restoreExcludes, *ignoreCase)
+			if err != nil {
+				log.Printf("Error: --restore-exclude: %v", err)
+				return exitUsage
+			}
+			opts.exclude = matcher
+		}
+		if *modifiedAfter != "" {
+			cutoff, err := time.Parse(time.RFC3339, *modifiedAfter)
+			if err != nil {
+				log.Printf("Error: --modified-after: %v", err)
+				return exitUsage
+			}
+			opts.modifiedAfter = cutoff
+		}
+		if *simulate {
+			plan, err := simulateRestore(backupPath, *restorePath, opts)
+			if err != nil {
+				return fail(err)
+			}
+			printRestorePlan(stdout, plan)
+		} else if err := restore(backupPath, *restorePath, opts); err != nil {
+			return fail(err)
+		}
+	} else if *comparePath != "" {
+		if backupPath == "" {
+			log.Println("Error: --backup required for compare mode")
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --compare <path> --backup <path>")
+			return exitUsage
+		}
+		diff, err := compareBackup(backupPath, *comparePath, scan)
+		if err != nil {
+			return fail(err)
+		}
+		printDiff(stdout, diff)
+	} else if *verify {
+		if backupPath == "" {
+			log.Println("Error: --backup required for verify mode")
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --verify --backup <path> [--mirror <path>]")
+			return exitUsage
+		}
+		result, err := verifyBackup(backupPath, *mirrorPath)
+		printVerify(stdout, result)
+		if err != nil {
+			return fail(err)
+		}
+	} else if *list || *stats || *purge || *maxTotalSize != "" || *snapshotOnly {
+		if backupPath == "" {
+			log.Println("Error: --backup required")
+			fmt.Fprintln(stdout, "\nUsage:")
+			fmt.Fprintln(stdout, "  ./app --list --backup <path> [--filter-deleted] [--follow]")
+			fmt.Fprintln(stdout, "  ./app --stats --backup <path> [--filter-deleted] [--top <N>]")
+			fmt.Fprintln(stdout, "  ./app --purge-tombstones --backup <path> [--tombstone-retention <duration>]")
+			fmt.Fprintln(stdout, "  ./app --max-total-size <size> --backup <path> [--prune-dry-run]")
+			fmt.Fprintln(stdout, "  ./app --snapshot-only --backup <path>")
+			return exitUsage
+		}
+		var err error
+		switch {
+		case *maxTotalSize != "":
+			limit, parseErr := parseSize(*maxTotalSize)
+			if parseErr != nil {
+				log.Printf("Error: --max-total-size: %v", parseErr)
+				return exitUsage
+			}
+			if *dryRun {
+				err = pruneDryRun(stdout, backupPath, limit)
+				break
+			}
+			var pruned []runInfo
+			var total int64
+			pruned, total, err = pruneToSize(backupPath, limit)
+			printPruned(stdout, pruned, total)
+		case *purge:
+			_, err = purgeTombstones(backupPath, *retention, time.Now())
+		case *snapshotOnly:
+			err = printLiveState(stdout, backupPath)
+		case *list && *follow:
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			err = followBackup(ctx, stdout, backupPath, *filterDeleted)
+		case *list:
+			err = listBackup(stdout, backupPath, *filterDeleted)
+		default:
+			err = printStats(stdout, backupPath, *filterDeleted, *top)
 		}
-		if err := restore(*backupPath, *restorePath); err != nil {
-			log.Fatal(err)
+		if err != nil {
+			return fail(err)
 		}
 	} else {
-		flag.Visit(func(f *flag.Flag) {
+		code := exitOK
+		fs.Visit(func(f *flag.Flag) {
 			if f.Name == "watch" && *watchPath == "" {
 				log.Println("Error: --watch requires a path")
-				fmt.Println("\nUsage:")
-				fmt.Println("  ./app --watch <path> --backup <path> --refresh <seconds>")
-				os.Exit(1)
+				fmt.Fprintln(stdout, "\nUsage:")
+				fmt.Fprintln(stdout, "  ./app --watch <path> --backup <path> --refresh <seconds>")
+				code = exitUsage
 			}
 			if f.Name == "restore" && *restorePath == "" {
 				log.Println("Error: --restore requires a path")
-				fmt.Println("\nUsage:")
-				fmt.Println("  ./app --restore <path> --backup <path>")
-				os.Exit(1)
+				fmt.Fprintln(stdout, "\nUsage:")
+				fmt.Fprintln(stdout, "  ./app --restore <path> --backup <path> [--strip-prefix <prefix>] [--add-prefix <prefix>]")
+				code = exitUsage
 			}
 		})
+		return code
 	}
+	return exitOK
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandPath_EnvironmentVariables(t *testing.T) {
+	t.Setenv("AIKIDO_ROOT", "/srv/data")
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"$AIKIDO_ROOT/watch", "/srv/data/watch"},
+		{"${AIKIDO_ROOT}/backup", "/srv/data/backup"},
+		{"/plain/path", "/plain/path"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := expandPath(tt.in)
+		if err != nil {
+			t.Errorf("expandPath(%q) error = %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExpandPath_Tilde(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	got, err := expandPath("~/backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(home, "backups"); got != want {
+		t.Errorf("expandPath(~/backups) = %q, want %q", got, want)
+	}
+
+	got, err = expandPath("~")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != home {
+		t.Errorf("expandPath(~) = %q, want %q", got, home)
+	}
+
+	// Only a leading ~ is the home directory
+	if got, _ := expandPath("/data/~/x"); got != "/data/~/x" {
+		t.Errorf("expected inner ~ to be left alone, got %q", got)
+	}
+}
+
+func TestExpandPath_UnsetVariable(t *testing.T) {
+	os.Unsetenv("AIKIDO_UNSET_FOR_TEST")
+
+	_, err := expandPath("$AIKIDO_UNSET_FOR_TEST/watch")
+	if err == nil {
+		t.Fatal("expected an error for an unset variable")
+	}
+	if got := err.Error(); got != "environment variable AIKIDO_UNSET_FOR_TEST is not set" {
+		t.Errorf("unexpected error %q", got)
+	}
+}
+
+func TestRun_ExitCodes(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := run([]string{"--backup-now", "--watch", tmpWatch, "--backup", tmpBackup}, io.Discard); code != exitOK {
+		t.Errorf("clean backup: exit code %d, want %d", code, exitOK)
+	}
+	if code := run([]string{"--restore", t.TempDir(), "--backup", tmpBackup}, io.Discard); code != exitOK {
+		t.Errorf("clean restore: exit code %d, want %d", code, exitOK)
+	}
+
+	// A chunk that cannot be read makes the restore partial
+	if err := os.WriteFile(filepath.Join(tmpBackup, "chunk_9999999999_000.dat"), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"--restore", t.TempDir(), "--backup", tmpBackup}, io.Discard); code != exitPartial {
+		t.Errorf("partial restore: exit code %d, want %d", code, exitPartial)
+	}
+
+	if code := run([]string{"--restore", t.TempDir(), "--backup", t.TempDir()}, io.Discard); code != exitFailure {
+		t.Errorf("failed restore: exit code %d, want %d", code, exitFailure)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	if code := run([]string{"--backup-now", "--watch", missing, "--backup", tmpBackup}, io.Discard); code != exitFailure {
+		t.Errorf("failed backup: exit code %d, want %d", code, exitFailure)
+	}
+}
+
+func TestRun_UsageErrors(t *testing.T) {
+	tests := [][]string{
+		{"--backup-now", "--watch", "/tmp"},
+		{"--restore", "/tmp"},
+		{"--files-from", "-", "--backup", "/tmp"},
+		{"--list", "--backup", "/tmp", "--backup", "/var"},
+		{"--backup-now", "--watch", "/tmp", "--backup", "/tmp", "--growing-files", "truncate"},
+		{"--stats", "--follow", "--backup", "/tmp"},
+		{"--import-tar", "-"},
+		{"--restore-file", "a.txt", "--backup", "/tmp", "--stdout", "--restore", "/tmp/out"},
+		{"--list", "--backup", "/tmp", "--json"},
+		{"--backup-now", "--watch", "/tmp", "--backup", "/tmp", "--exclude-older-than", "1h", "--exclude-newer-than", "2h"},
+		{"--backup-now", "--watch", "/tmp", "--backup", "/tmp", "--format", "msgpack"},
+		{"--backup-now", "--watch", "/tmp", "--backup", "/tmp", "--no-delete", "--full-every", "5"},
+		{"--backup-now", "--watch", "/tmp", "--backup", "/tmp", "--backup", "/var", "--write-policy", "most"},
+		{"--files-from", "-", "--watch", "/tmp", "--backup", "/tmp", "--backup", "/var"},
+		{"--restore", "/tmp/a", "--base", "/tmp/b", "--backup", "/tmp"},
+		{"--restore", "/tmp/a", "--remove-extras", "--backup", "/tmp"},
+		{"--backup-now", "--watch", "/tmp", "--backup", "/tmp", "--max-delete-ratio", "1.5"},
+		{"--backup-now", "--watch", "/tmp", "--backup", "/tmp", "--hash-buffer-size", "0"},
+		{"--restore", "/tmp/a", "--backup", "/tmp", "--transform", "cat"},
+		{"--no-such-flag"},
+	}
+	for _, args := range tests {
+		if code := run(args, io.Discard); code != exitUsage {
+			t.Errorf("run(%v) exit code %d, want %d", args, code, exitUsage)
+		}
+	}
+}
+
+func TestWatch_AllRunsFailing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	opts := watchOptions{
+		watchPath:  t.TempDir(),
+		backupPath: t.TempDir(),
+		refresh:    time.Hour,
+		preHook:    "exit 1",
+	}
+	err := watch(ctx, opts)
+	if err == nil || exitCode(err) != exitFailure {
+		t.Errorf("expected watch to fail when every run failed, got %v", err)
+	}
+}
+
+func TestRun_ProfilingFlags(t *testing.T) {
+	tmpWatch := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profileDir := t.TempDir()
+	cpuFile := filepath.Join(profileDir, "cpu.pprof")
+	traceFile := filepath.Join(profileDir, "trace.out")
+
+	args := []string{"--backup-now", "--watch", tmpWatch, "--backup", t.TempDir(),
+		"--cpuprofile", cpuFile, "--trace", traceFile}
+	if code := run(args, io.Discard); code != exitOK {
+		t.Fatalf("run() exit code %d", code)
+	}
+
+	for _, file := range []string{cpuFile, traceFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Errorf("profile not written: %v", err)
+			continue
+		}
+		if info.Size() == 0 {
+			t.Errorf("%s is empty", filepath.Base(file))
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"1024": 1024,
+		"4K":   4 << 10,
+		"512M": 512 << 20,
+		"50G":  50 << 30,
+		"2tb":  2 << 40,
+	}
+	for in, want := range tests {
+		got, err := parseSize(in)
+		if err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "G", "-1", "10X"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q): expected an error", in)
+		}
+	}
+}
+
+func TestRun_DereferenceRoot(t *testing.T) {
+	realDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(realDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"a.txt": "a", "sub/b.txt": "b"} {
+		if err := os.WriteFile(filepath.Join(realDir, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(t.TempDir(), "watched")
+	if err := os.Symlink(realDir, link); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	tmpBackup := t.TempDir()
+	args := []string{"--backup-now", "--watch", link, "--backup", tmpBackup, "--dereference-root"}
+	if code := run(args, io.Discard); code != exitOK {
+		t.Fatalf("backup through a symlinked root: exit code %d", code)
+	}
+
+	state, err := resolveBackup(tmpBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{"a.txt": "a", "sub/b.txt": "b"} {
+		if entry, ok := state.files[path]; !ok || string(entry.Content) != content {
+			t.Errorf("%s: expected %q in the backup, got %v", path, content, entry)
+		}
+	}
+	if len(state.files) != 2 {
+		t.Errorf("expected 2 files, got %d", len(state.files))
+	}
+
+	// The snapshot records the real directory, not the link
+	resolved, err := filepath.EvalSymlinks(realDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := loadSnapshot(filepath.Join(tmpBackup, defaultSnapshotName), resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Files.len() == 0 {
+		t.Error("expected the snapshot to be kept for the resolved watch path")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestEntry is one line of a checksum manifest: a file stored by a run.
+type manifestEntry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Hash    string
+}
+
+// manifestRecord returns the manifest line for entry, or false for entries
+// that store no file content, such as deletions and directories.
+func manifestRecord(entry *FileEntry) (manifestEntry, bool) {
+	if entry.Deleted || entry.Mode.IsDir() {
+		return manifestEntry{}, false
+	}
+	hash := entry.ContentHash
+	if hash == "" {
+		hash = hashContent(entry.Content)
+	}
+	return manifestEntry{Path: entry.Path, Size: entry.Size, ModTime: entry.ModTime, Hash: hash}, true
+}
+
+// writeManifest writes manifest_<timestamp>.txt to dir, one line per file
+// sorted by path, so identical runs produce identical manifests:
+//
+//	<sha256>  <size>  <modtime, RFC 3339 UTC>  <path>
+func writeManifest(dir string, timestamp int64, records []manifestEntry) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+
+	var b strings.Builder
+	for _, r := range records {
+		fmt.Fprintf(&b, "%s  %d  %s  %s\n", r.Hash, r.Size, r.ModTime.UTC().Format(time.RFC3339Nano), r.Path)
+	}
+
+	filename := filepath.Join(dir, fmt.Sprintf("manifest_%d.txt", timestamp))
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return "", err
+	}
+	return filename, os.Rename(tmp, filename)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupOnce_WritesChecksumManifest(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	manifestDir := filepath.Join(t.TempDir(), "manifests")
+
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, content := range map[string]string{"b.txt": "bravo", "a.txt": "alpha", "sub/c.txt": "alpha"} {
+		path := filepath.Join(tmpWatch, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, manifestDir: manifestDir}
+	if err := backupOnce(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, _ := filepath.Glob(filepath.Join(manifestDir, "manifest_*.txt"))
+	if len(manifests) != 1 {
+		t.Fatalf("expected 1 manifest, got %d", len(manifests))
+	}
+	got, err := os.ReadFile(manifests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alpha, bravo := hashContent([]byte("alpha")), hashContent([]byte("bravo"))
+	want := strings.Join([]string{
+		alpha + "  5  2024-01-02T03:04:05Z  a.txt",
+		bravo + "  5  2024-01-02T03:04:05Z  b.txt",
+		alpha + "  5  2024-01-02T03:04:05Z  sub/c.txt",
+	}, "\n") + "\n"
+	if string(got) != want {
+		t.Errorf("manifest mismatch:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	// An identical tree backed up from scratch produces the same manifest
+	otherManifests := t.TempDir()
+	opts.backupPath, opts.manifestDir = t.TempDir(), otherManifests
+	if err := backupOnce(opts); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := filepath.Glob(filepath.Join(otherManifests, "manifest_*.txt"))
+	if len(again) != 1 {
+		t.Fatalf("expected 1 manifest, got %d", len(again))
+	}
+	if second, _ := os.ReadFile(again[0]); string(second) != string(got) {
+		t.Errorf("manifest not stable across identical runs:\n%s\nvs\n%s", got, second)
+	}
+}
+
+func TestBackupOnce_NoManifestWithoutChanges(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	manifestDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, manifestDir: manifestDir}
+	for range 2 {
+		if err := backupOnce(opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if manifests, _ := filepath.Glob(filepath.Join(manifestDir, "manifest_*.txt")); len(manifests) != 1 {
+		t.Errorf("expected 1 manifest, got %d", len(manifests))
+	}
+}
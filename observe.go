@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// observation summarizes what one scan found changed since the previous one.
+type observation struct {
+	Added, Modified, Deleted []string
+	Bytes                    int64
+}
+
+// observeOnce scans watchPath against snapshot and reports the changes
+// without storing anything. Content is discarded as soon as it is hashed.
+func observeOnce(watchPath string, snapshot *fileSnapshot, opts scanOptions) (observation, error) {
+	opts.budget = nil
+	previous := make(map[string]bool, snapshot.len())
+	for path := range snapshot.clone() {
+		previous[path] = true
+	}
+
+	var obs observation
+	entries := make(chan *FileEntry)
+	done := make(chan struct{})
+	go func() {
+		for entry := range entries {
+			switch {
+			case entry.Deleted:
+				obs.Deleted = append(obs.Deleted, entry.Path)
+			case previous[entry.Path]:
+				obs.Modified = append(obs.Modified, entry.Path)
+				obs.Bytes += entry.Size
+			default:
+				obs.Added = append(obs.Added, entry.Path)
+				obs.Bytes += entry.Size
+			}
+		}
+		close(done)
+	}()
+
+	_, err := scanChanges(watchPath, snapshot, opts, entries)
+	close(entries)
+	<-done
+	if err != nil {
+		return observation{}, err
+	}
+
+	sort.Strings(obs.Added)
+	sort.Strings(obs.Modified)
+	sort.Strings(obs.Deleted)
+	return obs, nil
+}
+
+// observe runs the watch loop only to report churn: each interval prints a
+// summary of what a backup would store. Nothing is written to disk; the
+// snapshot is kept in memory, so the first interval reports the whole tree.
+func observe(ctx context.Context, w io.Writer, opts watchOptions) error {
+	if err := validateWatchPath(opts.watchPath); err != nil {
+		return err
+	}
+	log.Printf("Observing %s every %s; nothing will be backed up\n", opts.watchPath, opts.refresh)
+
+	snapshot := newFileSnapshot(nil)
+	scan := opts.scan
+	if scan.fastScan {
+		scan.dirs = make(map[string]int64)
+	}
+	// Mass deletions are worth seeing here, not blocking
+	scan.maxDeleteRatio = 0
+	for {
+		obs, err := observeOnce(opts.watchPath, snapshot, scan)
+		if err != nil {
+			log.Printf("Scan error: %v", err)
+		} else {
+			printObservation(w, time.Now(), obs)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(opts.refresh):
+		}
+	}
+}
+
+func printObservation(w io.Writer, at time.Time, obs observation) {
+	fmt.Fprintf(w, "%s  added=%d modified=%d deleted=%d bytes=%d\n",
+		at.UTC().Format(time.RFC3339), len(obs.Added), len(obs.Modified), len(obs.Deleted), obs.Bytes)
+	for _, path := range obs.Added {
+		fmt.Fprintf(w, "    A %s\n", path)
+	}
+	for _, path := range obs.Modified {
+		fmt.Fprintf(w, "    M %s\n", path)
+	}
+	for _, path := range obs.Deleted {
+		fmt.Fprintf(w, "    D %s\n", path)
+	}
+}
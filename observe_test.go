@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserveOnce_ReportsChangesAcrossIntervals(t *testing.T) {
+	tmpWatch := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", "aaa")
+	write("b.txt", "bb")
+
+	snapshot := newFileSnapshot(nil)
+	obs, err := observeOnce(tmpWatch, snapshot, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(obs.Added, []string{"a.txt", "b.txt"}) || obs.Bytes != 5 {
+		t.Errorf("first interval: got %+v", obs)
+	}
+
+	write("a.txt", "changed")
+	write("c.txt", "c")
+	if err := os.Remove(filepath.Join(tmpWatch, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	obs, err = observeOnce(tmpWatch, snapshot, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(obs.Added, []string{"c.txt"}) || !slices.Equal(obs.Modified, []string{"a.txt"}) ||
+		!slices.Equal(obs.Deleted, []string{"b.txt"}) || obs.Bytes != 8 {
+		t.Errorf("second interval: got %+v", obs)
+	}
+
+	obs, err = observeOnce(tmpWatch, snapshot, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(obs.Added)+len(obs.Modified)+len(obs.Deleted) != 0 {
+		t.Errorf("third interval: expected no changes, got %+v", obs)
+	}
+}
+
+func TestObserve_WritesNothing(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	go func() {
+		time.Sleep(120 * time.Millisecond)
+		os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a2"), 0644)
+	}()
+
+	var out bytes.Buffer
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, refresh: 50 * time.Millisecond}
+	if err := observe(ctx, &out, opts); err != nil {
+		t.Fatalf("observe() error = %v", err)
+	}
+
+	if n := strings.Count(out.String(), "added="); n < 2 {
+		t.Errorf("expected a summary per interval, got %d:\n%s", n, out.String())
+	}
+	for _, want := range []string{"    A a.txt\n", "    M a.txt\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in output:\n%s", want, out.String())
+		}
+	}
+	if entries, _ := os.ReadDir(tmpBackup); len(entries) != 0 {
+		t.Errorf("expected nothing written to the backup directory, got %d entries", len(entries))
+	}
+	if entries, _ := os.ReadDir(tmpWatch); len(entries) != 1 {
+		t.Errorf("expected no snapshot in the watch directory, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrAlreadyRunning = errors.New("another instance is already running")
+
+// acquirePIDFile records this process's PID in path, refusing to if the
+// file names another live process. A file left behind by a process that
+// is gone, or naming this process's own PID as after a container restart,
+// is reclaimed. It returns a function that removes the file.
+func acquirePIDFile(path string) (func(), error) {
+	for attempt := 0; ; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() { releasePIDFile(path) }, nil
+		}
+		// A second failure means another process reclaimed the file first
+		if !errors.Is(err, fs.ErrExist) || attempt > 0 {
+			return nil, err
+		}
+
+		pid, err := readPIDFile(path)
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return nil, fmt.Errorf("%w: %s names process %d", ErrAlreadyRunning, path, pid)
+		}
+		if err != nil {
+			log.Printf("Reclaiming unreadable PID file %s: %v", path, err)
+		} else {
+			log.Printf("Reclaiming stale PID file %s left by process %d", path, pid)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+}
+
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("no PID in %q", strings.TrimSpace(string(data)))
+	}
+	return pid, nil
+}
+
+// releasePIDFile removes path if it still names this process, so a file
+// another instance has since reclaimed is left alone.
+func releasePIDFile(path string) {
+	if pid, err := readPIDFile(path); err != nil || pid != os.Getpid() {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Warning: could not remove PID file %s: %v", path, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAcquirePIDFile_RejectsSecondInstance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aikido.pid")
+	// The test binary's parent is alive for as long as the test runs
+	other := os.Getppid()
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%d\n", other)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := acquirePIDFile(path)
+	if !errors.Is(err, ErrAlreadyRunning) || !strings.Contains(err.Error(), fmt.Sprint(other)) {
+		t.Fatalf("expected ErrAlreadyRunning naming %d, got %v", other, err)
+	}
+	if pid, _ := readPIDFile(path); pid != other {
+		t.Errorf("expected the live instance's PID file left alone, got %d", pid)
+	}
+}
+
+func TestAcquirePIDFile_ReclaimsStaleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aikido.pid")
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{fmt.Sprintf("%d\n", exited.Process.Pid), "garbage", fmt.Sprintf("%d\n", os.Getpid())} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		release, err := acquirePIDFile(path)
+		if err != nil {
+			t.Fatalf("expected the stale PID file %q reclaimed, got %v", content, err)
+		}
+		if pid, err := readPIDFile(path); err != nil || pid != os.Getpid() {
+			t.Errorf("expected the PID file to name this process, got %d (%v)", pid, err)
+		}
+		release()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected release to remove the PID file, got %v", err)
+		}
+	}
+}
+
+func TestReleasePIDFile_LeavesReclaimedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aikido.pid")
+	release, err := acquirePIDFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another instance took the file over after deciding this one was gone
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getppid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the other instance's PID file kept, got %v", err)
+	}
+}
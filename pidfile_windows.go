@@ -0,0 +1,14 @@
+package main
+
+import "os"
+
+// processAlive reports whether a process with pid exists. On Windows,
+// FindProcess opens the process and fails if there is none.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+func listChunks(backupPath string) ([]string, error) {
+	files, err := chunkFiles(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no backup chunks found in %s", backupPath)
+	}
+	return files, nil
+}
+
+// resolver replays chunks in order to compute the final state of a backup.
+type resolver struct {
+	files map[string]*FileEntry
+	// dirs holds directory entries, kept apart from files so only restore
+	// has to know about them.
+	dirs map[string]*FileEntry
+	// deleted maps each currently deleted path to the run that deleted it.
+	deleted map[string]int64
+
+	// Paths seen in the full run currently being replayed, and how many of
+	// its chunks were read, so an interrupted or damaged full run never
+	// discards files.
+	fullRun       map[string]bool
+	fullTimestamp int64
+	fullChunks    int
+
+	// unreadable counts chunks that were skipped because they could not be
+	// read.
+	unreadable int
+
+	// pending holds split files whose parts are still being read, and
+	// incomplete counts split files dropped because parts were missing.
+	pending    map[string]*pendingFile
+	incomplete int
+
+	// runContent maps content hashes to content stored in the run being
+	// replayed, for resolving ContentRef.
+	runContent   map[string][]byte
+	runTimestamp int64
+
+	// traced lists paths whose every touch is logged, and tracedFrom the
+	// chunk the current entry of each came from.
+	traced     map[string]bool
+	tracedFrom map[string]string
+
+	// emptyAsDelete replays files stored with no content as deletions,
+	// counting them in emptyDeleted.
+	emptyAsDelete bool
+	emptyDeleted  int
+
+	// source is the label of the last run replayed.
+	source string
+}
+
+// resolveOptions adjust how restore replays a backup.
+type resolveOptions struct {
+	tracePaths []string
+	// emptyAsDelete is a compatibility mode for backups holding empty
+	// entries where deletions were meant, as some broken imports wrote.
+	// It turns genuinely empty files into deletions too.
+	emptyAsDelete bool
+}
+
+type pendingFile struct {
+	entry     *FileEntry
+	next      int
+	timestamp int64
+}
+
+func newResolver() *resolver {
+	return &resolver{
+		files:   make(map[string]*FileEntry),
+		dirs:    make(map[string]*FileEntry),
+		deleted: make(map[string]int64),
+		pending: make(map[string]*pendingFile),
+	}
+}
+
+// assemble returns an entry's complete form: split files are collected
+// until their last part arrives (nil is returned before that), and content
+// references are resolved against content stored earlier in the run. A
+// file with missing parts or content is dropped, leaving any earlier
+// version in place.
+func (r *resolver) assemble(entry *FileEntry, timestamp int64) *FileEntry {
+	if timestamp != r.runTimestamp || r.runContent == nil {
+		r.runContent = make(map[string][]byte)
+		r.runTimestamp = timestamp
+	}
+
+	if entry.Parts > 1 {
+		if entry = r.collectPart(entry, timestamp); entry == nil {
+			return nil
+		}
+	}
+
+	if entry.ContentRef != "" {
+		content, ok := r.runContent[entry.ContentRef]
+		if !ok {
+			log.Printf("Warning: content of %s is missing from backup %d, skipping it", entry.Path, timestamp)
+			r.incomplete++
+			return nil
+		}
+		resolved := *entry
+		resolved.Content = content
+		resolved.ContentHash, resolved.ContentRef = entry.ContentRef, ""
+		return &resolved
+	}
+	if entry.ContentHash != "" {
+		r.runContent[entry.ContentHash] = entry.Content
+	}
+	return entry
+}
+
+func (r *resolver) collectPart(entry *FileEntry, timestamp int64) *FileEntry {
+	p := r.pending[entry.Path]
+	if entry.Part == 0 {
+		whole := *entry
+		whole.Content = make([]byte, 0, entry.Size)
+		p = &pendingFile{entry: &whole, timestamp: timestamp}
+		r.pending[entry.Path] = p
+	}
+	if p == nil || p.next != entry.Part || p.timestamp != timestamp {
+		log.Printf("Warning: %s is missing parts in backup %d, skipping it", entry.Path, timestamp)
+		delete(r.pending, entry.Path)
+		r.incomplete++
+		return nil
+	}
+
+	p.entry.Content = append(p.entry.Content, entry.Content...)
+	p.next++
+	if p.next < entry.Parts {
+		return nil
+	}
+
+	delete(r.pending, entry.Path)
+	p.entry.Part, p.entry.Parts = 0, 0
+	return p.entry
+}
+
+func (r *resolver) apply(chunkFile string, chunk Chunk) {
+	timestamp, seq, _ := parseChunkName(filepath.Base(chunkFile))
+	r.source = chunk.Source
+	if chunk.Full {
+		if r.fullRun == nil || timestamp != r.fullTimestamp {
+			r.fullRun = make(map[string]bool)
+			r.fullTimestamp = timestamp
+			r.fullChunks = 0
+		}
+		r.fullChunks++
+	}
+
+	for _, entry := range chunk.Entries {
+		if chunk.Full {
+			r.fullRun[entry.Path] = true
+		}
+		traced := r.traced[entry.Path]
+		if traced {
+			traceTouch(chunkFile, timestamp, entry)
+		}
+		if entry = r.assemble(entry, timestamp); entry == nil {
+			continue
+		}
+		if r.emptyAsDelete && !entry.Deleted && !entry.Mode.IsDir() && !entry.MetadataOnly && len(entry.Content) == 0 {
+			entry = &FileEntry{Path: entry.Path, Deleted: true}
+			r.emptyDeleted++
+		}
+		if traced {
+			r.tracedFrom[entry.Path] = filepath.Base(chunkFile)
+		}
+		switch {
+		case entry.Deleted && entry.Mode.IsDir():
+			delete(r.dirs, entry.Path)
+		case entry.Deleted:
+			r.deleted[entry.Path] = timestamp
+			delete(r.files, entry.Path)
+		case entry.Mode.IsDir():
+			delete(r.files, entry.Path)
+			r.dirs[entry.Path] = entry
+		default:
+			delete(r.deleted, entry.Path)
+			delete(r.dirs, entry.Path)
+			r.files[entry.Path] = entry
+		}
+	}
+
+	if chunk.Full && chunk.Final {
+		if r.fullChunks == seq+1 {
+			for path := range r.files {
+				if !r.fullRun[path] {
+					r.traceDrop(path, timestamp)
+					delete(r.files, path)
+				}
+			}
+			for path := range r.dirs {
+				if !r.fullRun[path] {
+					r.traceDrop(path, timestamp)
+					delete(r.dirs, path)
+				}
+			}
+		} else {
+			log.Printf("Warning: full backup %d is incomplete, replaying it as incremental", timestamp)
+		}
+		r.fullRun = nil
+	}
+}
+
+// checkSource fails unless the latest run replayed was labelled expect.
+// An empty expect accepts any backup.
+func (r *resolver) checkSource(expect string) error {
+	switch {
+	case expect == "" || r.source == expect:
+		return nil
+	case r.source == "":
+		return fmt.Errorf("backup records no source label, expected %q", expect)
+	default:
+		return fmt.Errorf("backup is of %q, not the expected source %q", r.source, expect)
+	}
+}
+
+// trace makes the resolver log every chunk that touches one of paths, so
+// a surprising restore can be followed back to the run that caused it.
+func (r *resolver) trace(paths []string) {
+	r.traced = make(map[string]bool)
+	r.tracedFrom = make(map[string]string)
+	for _, path := range paths {
+		r.traced[filepath.ToSlash(filepath.Clean(path))] = true
+	}
+}
+
+func traceTouch(chunkFile string, timestamp int64, entry *FileEntry) {
+	var action string
+	switch {
+	case entry.Deleted:
+		action = "delete"
+	case entry.Mode.IsDir():
+		action = fmt.Sprintf("directory %s", entry.Mode)
+	case entry.MetadataOnly:
+		action = fmt.Sprintf("write of metadata only, %d bytes", entry.Size)
+	case entry.ContentRef != "":
+		action = fmt.Sprintf("write of %d bytes, same content as %s", entry.Size, entry.ContentRef)
+	default:
+		action = fmt.Sprintf("write of %d bytes", entry.Size)
+	}
+	if entry.Parts > 1 {
+		action += fmt.Sprintf(" (part %d of %d)", entry.Part+1, entry.Parts)
+	}
+	if !entry.Deleted {
+		action += ", modified " + entry.ModTime.UTC().Format(time.RFC3339)
+	}
+	log.Printf("Trace %s: %s in run %s (%s)", entry.Path, action,
+		time.Unix(timestamp, 0).UTC().Format(time.RFC3339), filepath.Base(chunkFile))
+}
+
+func (r *resolver) traceDrop(path string, timestamp int64) {
+	if r.traced[path] {
+		log.Printf("Trace %s: dropped, absent from the full run %s", path,
+			time.Unix(timestamp, 0).UTC().Format(time.RFC3339))
+	}
+}
+
+// traceOutcome logs which touch of each traced path won the replay.
+func (r *resolver) traceOutcome() {
+	paths := make([]string, 0, len(r.traced))
+	for path := range r.traced {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		switch {
+		case r.files[path] != nil:
+			log.Printf("Trace %s: restored from %s", path, r.tracedFrom[path])
+		case r.dirs[path] != nil:
+			log.Printf("Trace %s: restored as a directory from %s", path, r.tracedFrom[path])
+		case r.deleted[path] != 0:
+			log.Printf("Trace %s: not restored, deleted in run %s", path,
+				time.Unix(r.deleted[path], 0).UTC().Format(time.RFC3339))
+		default:
+			log.Printf("Trace %s: not restored, no run holds it", path)
+		}
+	}
+}
+
+// mergeChunks lists the chunks of several backups as one replay, ordered by
+// run timestamp. Runs with the same timestamp in different backups replay
+// in the order the backups are given, each run's chunks kept together.
+func mergeChunks(backupPaths []string) ([]string, error) {
+	type chunkRef struct {
+		file      string
+		timestamp int64
+		backup    int
+		seq       int
+	}
+	var refs []chunkRef
+	for i, backupPath := range backupPaths {
+		files, err := listChunks(backupPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			timestamp, seq, _ := parseChunkName(filepath.Base(file))
+			refs = append(refs, chunkRef{file, timestamp, i, seq})
+		}
+	}
+
+	sort.SliceStable(refs, func(i, j int) bool {
+		a, b := refs[i], refs[j]
+		if a.timestamp != b.timestamp {
+			return a.timestamp < b.timestamp
+		}
+		if a.backup != b.backup {
+			return a.backup < b.backup
+		}
+		return a.seq < b.seq
+	})
+	files := make([]string, len(refs))
+	for i, ref := range refs {
+		files[i] = ref.file
+	}
+	return files, nil
+}
+
+// resolveBackup replays the chunks of one or more backups, merged by
+// mergeChunks. It only reads from them, so read-only operations such as
+// restore and stats are safe against immutable or read-only backups.
+func resolveBackup(backupPaths ...string) (*resolver, error) {
+	return resolveBackupWith(backupPaths, resolveOptions{})
+}
+
+func resolveBackupWith(backupPaths []string, opts resolveOptions) (*resolver, error) {
+	files, err := mergeChunks(backupPaths)
+	if err != nil {
+		return nil, err
+	}
+	r := newResolver()
+	r.emptyAsDelete = opts.emptyAsDelete
+	if len(opts.tracePaths) > 0 {
+		r.trace(opts.tracePaths)
+	}
+	r.replay(files)
+	if len(opts.tracePaths) > 0 {
+		r.traceOutcome()
+	}
+	return r, nil
+}
+
+// replayChunks resolves the given chunk files, which must be in replay order.
+func replayChunks(files []string) *resolver {
+	r := newResolver()
+	r.replay(files)
+	return r
+}
+
+func (r *resolver) replay(files []string) {
+	for _, chunkFile := range files {
+		chunk, err := readChunk(chunkFile)
+		if err != nil {
+			log.Printf("Error reading %s: %v", chunkFile, err)
+			r.unreadable++
+			continue
+		}
+		r.apply(chunkFile, chunk)
+	}
+}
@@ -1,81 +1,693 @@
 package main
 
 import (
-	"encoding/gob"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func restore(backupPath, restorePath string) error {
-	log.Printf("Restoring from %s to %s", backupPath, restorePath)
+type restoreOptions struct {
+	stripPrefix string
+	addPrefix   string
+	// tempDir holds files while they are written, before being renamed into
+	// place. Empty means the target file's own directory.
+	tempDir string
+	// execBitOnly is for targets such as FAT that cannot store full Unix
+	// modes: only the executable bit is checked and fixed up.
+	execBitOnly bool
+	// onFile, when set, is called with each file's remapped relative path
+	// before it is written. It may modify the entry; returning ErrSkipFile
+	// skips writing it, and any other error aborts the restore.
+	onFile func(relPath string, entry *FileEntry) error
+	// mergeFrom lists more backups whose runs are replayed together with
+	// the main one, for backups that were split across directories.
+	mergeFrom []string
+	// modifiedAfter, when set, limits the restore to files modified after
+	// it, and removes files deleted by runs after it, leaving everything
+	// older in the target untouched.
+	modifiedAfter time.Time
+	// forceOverwrite makes read-only files in the target writable so they
+	// can be replaced. Without it they are skipped.
+	forceOverwrite bool
+	// overlay restores onto a target that already holds a base image of
+	// the tree: files whose content already matches are not rewritten, and
+	// files the backup records as deleted are removed. removeExtras also
+	// removes files the backup does not hold at all.
+	overlay      bool
+	removeExtras bool
+	// tracePaths are logged through the replay: every chunk that touched
+	// them, and which one won.
+	tracePaths []string
+	// emptyAsDelete treats files stored with no content as deletions; see
+	// resolveOptions.
+	emptyAsDelete bool
+	// exclude lists target paths restore leaves alone; see protected.
+	exclude *excludeMatcher
+	// preserveNewer keeps target files modified after the backed-up
+	// version, or after the run that deleted them.
+	preserveNewer bool
+	// transform, when set, filters the content of the files it matches
+	// before they are written.
+	transform *contentTransform
+	// expectSource, when set, refuses a backup whose latest run has a
+	// different source label, before anything is written.
+	expectSource string
+}
 
-	if err := os.MkdirAll(restorePath, 0755); err != nil {
-		return err
-	}
+func (opts restoreOptions) resolveOptions() resolveOptions {
+	return resolveOptions{tracePaths: opts.tracePaths, emptyAsDelete: opts.emptyAsDelete}
+}
+
+// ErrSkipFile is returned by a restoreOptions.onFile callback to skip
+// writing a file, for example because the callback stored it elsewhere.
+var ErrSkipFile = errors.New("skip file")
+
+func restore(backupPath, restorePath string, opts restoreOptions) error {
+	backupPaths := append([]string{backupPath}, opts.mergeFrom...)
+	log.Printf("Restoring from %s to %s", strings.Join(backupPaths, ", "), restorePath)
 
-	files, err := filepath.Glob(filepath.Join(backupPath, "chunk_*.dat"))
+	state, err := resolveBackupWith(backupPaths, opts.resolveOptions())
 	if err != nil {
 		return err
 	}
+	if err := state.checkSource(opts.expectSource); err != nil {
+		return err
+	}
 
-	if len(files) == 0 {
-		return fmt.Errorf("no backup chunks found in %s", backupPath)
+	if err := os.MkdirAll(restorePath, 0755); err != nil {
+		return err
+	}
+	// Files written in a temp dir on another device cannot be renamed into
+	// place, so each would be written twice
+	if opts.tempDir != "" {
+		if same, err := sameDevice(opts.tempDir, restorePath); err == nil && !same {
+			log.Printf("Warning: --temp-dir %s is on a different device than %s, writing temporary files next to their targets instead", opts.tempDir, restorePath)
+			opts.tempDir = ""
+		}
 	}
 
-	sort.Strings(files)
+	journal, err := openRestoreJournal(restorePath)
+	if err != nil {
+		return fmt.Errorf("opening restore journal: %w", err)
+	}
+	defer journal.close()
 
-	fileData := make(map[string]*FileEntry)
-	deletedFiles := make(map[string]bool)
+	// Directories are created up front, so empty ones are restored too, and
+	// their modes and modtimes applied last since writing files changes them
+	dirs := make(map[string]*FileEntry)
+	// failed lists paths that could not be written; the restore carries on
+	// with the rest and reports them at the end.
+	var failed []string
+	// placeholders lists files backed up without content, restored empty.
+	var placeholders []*FileEntry
+	for _, entry := range state.dirs {
+		relPath, ok := remapPath(entry.Path, opts)
+		if !ok {
+			continue
+		}
+		targetPath, err := safeJoin(restorePath, relPath)
+		if err != nil {
+			log.Printf("Warning: skipping directory %s: %v", entry.Path, err)
+			continue
+		}
+		if protected(restorePath, relPath, true, opts) {
+			continue
+		}
+		targetPath = longPath(targetPath)
+		if err := os.MkdirAll(targetPath, 0755); err != nil {
+			log.Printf("Error: could not restore directory %s: %v", relPath, err)
+			failed = append(failed, relPath)
+			continue
+		}
+		dirs[targetPath] = withDefaultMode(entry)
+	}
 
-	for _, chunkFile := range files {
-		chunk, err := readChunk(chunkFile)
+	restored, resumed, skipped, unchanged := 0, 0, state.incomplete, 0
+	// kept counts files left alone because they are protected, and newer
+	// those kept for --preserve-target-newer
+	kept, newer := 0, 0
+	hashBuf := make([]byte, defaultHashBufferSize)
+	for _, entry := range state.files {
+		relPath, ok := remapPath(entry.Path, opts)
+		if !ok || relPath == restoreJournalName {
+			continue
+		}
+		if !opts.modifiedAfter.IsZero() && !entry.ModTime.After(opts.modifiedAfter) {
+			continue
+		}
+		targetPath, err := safeJoin(restorePath, relPath)
 		if err != nil {
-			log.Printf("Error reading %s: %v", chunkFile, err)
+			log.Printf("Warning: skipping %s: %v", entry.Path, err)
+			skipped++
+			continue
+		}
+		targetPath = longPath(targetPath)
+		if protected(restorePath, relPath, false, opts) {
+			kept++
+			continue
+		}
+		if opts.preserveNewer && modifiedAfter(targetPath, entry.ModTime) {
+			log.Printf("Keeping %s: the target was modified after the backed-up version", relPath)
+			newer++
 			continue
 		}
 
-		for _, entry := range chunk.Entries {
-			if entry.Deleted {
-				deletedFiles[entry.Path] = true
-				delete(fileData, entry.Path)
-			} else {
-				delete(deletedFiles, entry.Path)
-				fileData[entry.Path] = entry
+		if opts.onFile != nil {
+			if err := opts.onFile(relPath, entry); errors.Is(err, ErrSkipFile) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("restoring %s: %w", entry.Path, err)
 			}
 		}
-	}
+		entry = withDefaultMode(entry)
 
-	for _, entry := range fileData {
-		targetPath := filepath.Join(restorePath, entry.Path)
+		transformed := false
+		if opts.transform.matches(relPath) && !entry.MetadataOnly {
+			content, err := opts.transform.apply(relPath, entry.Content)
+			if err != nil {
+				log.Printf("Error: could not restore %s: %v", relPath, err)
+				failed = append(failed, relPath)
+				continue
+			}
+			filtered := *entry
+			filtered.Content, filtered.Size = content, int64(len(content))
+			entry, transformed = &filtered, true
+		}
+
+		hash := entry.ContentHash
+		if hash == "" || opts.onFile != nil || transformed {
+			hash = hashContent(entry.Content)
+		}
+		if journal.restored(relPath, targetPath, hash, len(entry.Content), entry.ModTime) {
+			resumed++
+			continue
+		}
 
 		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-			return err
+			log.Printf("Error: could not restore %s: %v", relPath, err)
+			failed = append(failed, relPath)
+			continue
+		}
+
+		// Over a base image, a file that already holds the right content
+		// only gets its metadata applied
+		same := false
+		if opts.overlay {
+			// A file backed up without content is restored as an empty
+			// placeholder
+			want := hash
+			if entry.MetadataOnly {
+				want = hashContent(entry.Content)
+			}
+			if info, err := os.Lstat(targetPath); err == nil {
+				if same, err = holdsContent(targetPath, info, len(entry.Content), want, hashBuf); err != nil {
+					log.Printf("Warning: could not compare %s with the base, rewriting it: %v", relPath, err)
+				}
+			}
+		}
+		if same {
+			unchanged++
+		} else if !writeTarget(targetPath, relPath, entry, opts, &skipped, &failed) {
+			continue
 		}
 
-		if err := os.WriteFile(targetPath, entry.Content, entry.Mode); err != nil {
-			return err
+		if entry.MetadataOnly {
+			placeholders = append(placeholders, entry)
+		}
+
+		if len(entry.ACL) > 0 {
+			if err := applyACL(targetPath, entry.ACL); err != nil {
+				log.Printf("Warning: could not restore ACL for %s: %v", entry.Path, err)
+			}
 		}
 
+		if runtime.GOOS != "windows" {
+			// The file is created with its permissions only, so a partly
+			// written setuid file never exists; the special bits go on now
+			mode := restoreMode(entry.Mode)
+			if mode&specialBits != 0 {
+				if err := os.Chmod(targetPath, mode); err != nil {
+					log.Printf("Warning: could not restore %s for %s: %v", specialBitNames(mode), entry.Path, err)
+				}
+			}
+			checkMode(targetPath, entry.Path, mode, opts.execBitOnly)
+		}
+
+		// Capabilities last, since changing the file afterwards clears them
+		if len(entry.Capability) > 0 {
+			if err := applyCapability(targetPath, entry.Capability); err != nil {
+				log.Printf("Warning: could not restore file capabilities for %s: %v", entry.Path, err)
+			}
+		}
+
+		if !entry.BirthTime.IsZero() {
+			if err := applyBirthTime(targetPath, entry.BirthTime); err != nil {
+				log.Printf("Warning: could not restore creation time for %s: %v", entry.Path, err)
+			}
+		}
 		if err := os.Chtimes(targetPath, entry.ModTime, entry.ModTime); err != nil {
 			log.Printf("Warning: could not restore times for %s", entry.Path)
 		}
+		if err := journal.record(relPath, hash); err != nil {
+			log.Printf("Warning: could not record %s in the restore journal: %v", relPath, err)
+		}
+		restored++
+	}
+
+	if !opts.modifiedAfter.IsZero() || opts.overlay {
+		removeDeletions(state, restorePath, opts)
+	}
+	if opts.overlay && opts.removeExtras {
+		removeExtras(state, restorePath, opts)
 	}
 
-	log.Printf("Restored %d files", len(fileData))
+	for targetPath, entry := range dirs {
+		if err := os.Chmod(targetPath, restoreMode(entry.Mode)); err != nil {
+			log.Printf("Warning: could not restore mode for directory %s: %v", entry.Path, err)
+		}
+		if err := os.Chtimes(targetPath, entry.ModTime, entry.ModTime); err != nil {
+			log.Printf("Warning: could not restore times for directory %s", entry.Path)
+		}
+	}
+
+	if resumed > 0 {
+		log.Printf("Restored %d files, %d already restored by an earlier run", restored, resumed)
+	} else {
+		log.Printf("Restored %d files", restored)
+	}
+	if unchanged > 0 {
+		log.Printf("%d of them already matched the base and were not rewritten", unchanged)
+	}
+	if kept > 0 {
+		log.Printf("Left %d files alone under --restore-exclude or an existing .git", kept)
+	}
+	if newer > 0 {
+		log.Printf("Kept %d target files modified after their backed-up version", newer)
+	}
+	if state.emptyDeleted > 0 {
+		log.Printf("Treated %d empty entries as deletions (--backup-empty-content-as-delete)", state.emptyDeleted)
+	}
+	if len(placeholders) > 0 {
+		sort.Slice(placeholders, func(i, j int) bool { return placeholders[i].Path < placeholders[j].Path })
+		log.Printf("%d files were backed up without content and restored as empty placeholders:", len(placeholders))
+		for _, entry := range placeholders {
+			log.Printf("    %s (%d bytes, sha256 %s)", entry.Path, entry.Size, entry.ContentHash)
+		}
+	}
+	restored += resumed
+	// The journal only helps a rerun after a failed write; skipped files and
+	// unreadable chunks are skipped the same way every time
+	if len(failed) == 0 {
+		if err := journal.remove(); err != nil {
+			log.Printf("Warning: could not remove the restore journal: %v", err)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		log.Printf("Could not restore %d paths:", len(failed))
+		for _, relPath := range failed {
+			log.Printf("    %s", relPath)
+		}
+		return &partialError{fmt.Sprintf("restored %d files; could not restore %d paths, skipped %d files and %d unreadable chunks",
+			restored, len(failed), skipped, state.unreadable)}
+	}
+	if skipped > 0 || state.unreadable > 0 {
+		return &partialError{fmt.Sprintf("restored %d files; skipped %d files and %d unreadable chunks",
+			restored, skipped, state.unreadable)}
+	}
 	return nil
 }
 
+// writeTarget writes entry's content to targetPath, counting a read-only
+// target it may not replace in skipped and a failed write in failed. It
+// reports whether the file was written.
+func writeTarget(targetPath, relPath string, entry *FileEntry, opts restoreOptions, skipped *int, failed *[]string) bool {
+	existingMode, readOnly := readOnlyTarget(targetPath)
+	if readOnly && !opts.forceOverwrite {
+		log.Printf("Warning: skipping %s: the existing file is read-only (use --force-overwrite to replace it)", relPath)
+		*skipped++
+		return false
+	}
+	if readOnly {
+		if err := os.Chmod(targetPath, existingMode|0200); err != nil {
+			log.Printf("Error: could not make %s writable: %v", relPath, err)
+			*failed = append(*failed, relPath)
+			return false
+		}
+	}
+
+	if err := writeFileAtomic(targetPath, entry.Content, entry.Mode.Perm(), opts.tempDir); err != nil {
+		log.Printf("Error: could not restore %s: %v", relPath, err)
+		if readOnly {
+			os.Chmod(targetPath, existingMode)
+		}
+		*failed = append(*failed, relPath)
+		return false
+	}
+	return true
+}
+
+// removeDeletions removes files from the target that the backup records as
+// deleted: with opts.modifiedAfter, those a run after it deleted, so a
+// restore of recent changes includes them, and over a base image all of
+// them.
+func removeDeletions(state *resolver, restorePath string, opts restoreOptions) {
+	cutoff := opts.modifiedAfter.Unix()
+	for path, deletedAt := range state.deleted {
+		if !opts.modifiedAfter.IsZero() && deletedAt <= cutoff {
+			continue
+		}
+		relPath, ok := remapPath(path, opts)
+		if !ok {
+			continue
+		}
+		targetPath, err := safeJoin(restorePath, relPath)
+		if err != nil {
+			continue
+		}
+		targetPath = longPath(targetPath)
+		if protected(restorePath, relPath, false, opts) {
+			continue
+		}
+		if info, err := os.Lstat(targetPath); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if opts.preserveNewer && modifiedAfter(targetPath, time.Unix(deletedAt, 0)) {
+			log.Printf("Keeping %s: the target was modified after the run that deleted it", relPath)
+			continue
+		}
+		if err := os.Remove(targetPath); err != nil {
+			log.Printf("Warning: could not remove deleted file %s: %v", relPath, err)
+		} else if !opts.modifiedAfter.IsZero() {
+			log.Printf("Removed %s, deleted since %s", relPath, opts.modifiedAfter.Format(time.RFC3339))
+		} else {
+			log.Printf("Removed %s, deleted in the backup", relPath)
+		}
+	}
+}
+
+// removeExtras removes files from a base image that the backup does not
+// hold, so the target ends up with exactly the backed-up files. Directories
+// are left in place.
+func removeExtras(state *resolver, restorePath string, opts restoreOptions) {
+	keep := map[string]bool{filepath.Join(restorePath, restoreJournalName): true}
+	for _, entry := range state.files {
+		if relPath, ok := remapPath(entry.Path, opts); ok {
+			if targetPath, err := safeJoin(restorePath, relPath); err == nil {
+				keep[targetPath] = true
+			}
+		}
+	}
+
+	err := filepath.WalkDir(restorePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Warning: could not check %s for extra files: %v", path, err)
+			return nil
+		}
+		relPath, _ := filepath.Rel(restorePath, path)
+		if path != restorePath && protected(restorePath, relPath, d.IsDir(), opts) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || keep[path] {
+			return nil
+		}
+		if err := os.Remove(longPath(path)); err != nil {
+			log.Printf("Warning: could not remove extra file %s: %v", relPath, err)
+		} else {
+			log.Printf("Removed %s, not in the backup", relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: could not remove extra files: %v", err)
+	}
+}
+
+// protected reports whether restore must leave relPath in the target
+// alone: it matches --restore-exclude, or it is or lies in a .git that
+// already exists in the target, so restoring into a working tree never
+// touches the repository. A .git the target lacks is restored as usual.
+func protected(restorePath, relPath string, isDir bool, opts restoreOptions) bool {
+	segments := strings.Split(filepath.ToSlash(relPath), "/")
+	// As in a scan, excluding a directory excludes everything in it
+	for i, segment := range segments {
+		prefix := strings.Join(segments[:i+1], "/")
+		if opts.exclude.excluded(prefix, isDir || i < len(segments)-1) {
+			return true
+		}
+		if segment == ".git" {
+			if _, err := os.Lstat(longPath(filepath.Join(restorePath, filepath.FromSlash(prefix)))); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// modifiedAfter reports whether the file at path exists and was modified
+// after t.
+func modifiedAfter(path string, t time.Time) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.ModTime().After(t)
+}
+
+// renameFile is swapped out by tests to simulate cross-device renames, and
+// statFile to simulate filesystems that do not keep the requested mode.
+var (
+	renameFile = os.Rename
+	statFile   = os.Stat
+)
+
+// specialBits are the mode bits beyond the permissions that restore
+// carries over.
+const specialBits = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// restoreMode is the part of a backed-up mode that restore applies.
+func restoreMode(mode os.FileMode) os.FileMode {
+	return mode.Perm() | mode&specialBits
+}
+
+// withDefaultMode returns entry with a default mode if it has no
+// permissions at all, which only a malformed chunk or import produces: a
+// file restored with it could not be read or restored over.
+func withDefaultMode(entry *FileEntry) *FileEntry {
+	if entry.Mode.Perm() != 0 {
+		return entry
+	}
+	perm := os.FileMode(0644)
+	if entry.Mode.IsDir() {
+		perm = 0755
+	}
+	log.Printf("Warning: %s has no permissions in the backup, restoring it with %s", entry.Path, perm)
+	fixed := *entry
+	fixed.Mode |= perm
+	return &fixed
+}
+
+// specialBitNames describes the special bits set in mode, e.g. "setuid and
+// setgid bits".
+func specialBitNames(mode os.FileMode) string {
+	var names []string
+	for _, bit := range []struct {
+		mode os.FileMode
+		name string
+	}{{os.ModeSetuid, "setuid"}, {os.ModeSetgid, "setgid"}, {os.ModeSticky, "sticky"}} {
+		if mode&bit.mode != 0 {
+			names = append(names, bit.name)
+		}
+	}
+	if len(names) == 1 {
+		return names[0] + " bit"
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1] + " bits"
+}
+
+// checkMode warns when the filesystem did not keep the mode restore asked
+// for. Lost special bits get a warning of their own, since they usually
+// mean restore lacked the privilege to set them rather than a limited
+// filesystem. With execBitOnly, a lost executable bit gets a best-effort
+// chmod and other differences are expected.
+func checkMode(targetPath, name string, want os.FileMode, execBitOnly bool) {
+	info, err := statFile(targetPath)
+	if err != nil {
+		log.Printf("Warning: could not check mode of %s: %v", name, err)
+		return
+	}
+	got := restoreMode(info.Mode())
+
+	if lost := want &^ got & specialBits; lost != 0 {
+		log.Printf("Warning: %s lost its %s; restoring special bits needs root, or ownership of the file and, for setgid, membership of its group",
+			name, specialBitNames(lost))
+	}
+	want, got = want.Perm(), got.Perm()
+
+	if !execBitOnly {
+		if got != want {
+			log.Printf("Warning: target filesystem did not keep mode %v for %s (got %v)", want, name, got)
+		}
+		return
+	}
+
+	if want&0111 == 0 || got&0111 != 0 {
+		return
+	}
+	if err := os.Chmod(targetPath, got|want&0111); err == nil {
+		if info, err := statFile(targetPath); err == nil && info.Mode().Perm()&0111 != 0 {
+			return
+		}
+	}
+	log.Printf("Warning: target filesystem did not keep the executable bit for %s", name)
+}
+
+// readOnlyTarget reports whether path is an existing file that is not
+// writable by its owner, returning its permissions. Replacing it by rename
+// works on Unix but fails on Windows, so restore treats it the same way
+// everywhere.
+func readOnlyTarget(path string) (os.FileMode, bool) {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, false
+	}
+	return info.Mode().Perm(), info.Mode().Perm()&0200 == 0
+}
+
+// writeFileAtomic writes content to a temporary file and renames it over
+// path, so an interrupted restore never leaves a half-written file. If
+// tempDir is on a different filesystem than path, the rename fails with
+// EXDEV and the write is redone in path's own directory.
+func writeFileAtomic(path string, content []byte, perm os.FileMode, tempDir string) error {
+	dir := filepath.Dir(path)
+	if tempDir == "" {
+		tempDir = dir
+	}
+
+	err := writeAndRename(path, content, perm, tempDir)
+	if errors.Is(err, syscall.EXDEV) && tempDir != dir {
+		return writeAndRename(path, content, perm, dir)
+	}
+	return err
+}
+
+func writeAndRename(path string, content []byte, perm os.FileMode, tempDir string) error {
+	file, err := os.CreateTemp(tempDir, ".aikido-restore-*")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+
+	_, err = file.Write(content)
+	if err == nil {
+		// Some filesystems reject chmod outright; the content still matters
+		// more, and restore checks the resulting mode afterwards
+		file.Chmod(perm)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameFile(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func remapPath(p string, opts restoreOptions) (string, bool) {
+	p = filepath.Clean(filepath.FromSlash(p))
+	if opts.stripPrefix != "" {
+		prefix := filepath.Clean(opts.stripPrefix)
+		if p == prefix {
+			return "", false
+		}
+		p = strings.TrimPrefix(p, prefix+string(filepath.Separator))
+	}
+	if opts.addPrefix != "" {
+		p = filepath.Join(opts.addPrefix, p)
+	}
+	return p, true
+}
+
+func safeJoin(root, relPath string) (string, error) {
+	if filepath.IsAbs(relPath) || !filepath.IsLocal(relPath) {
+		return "", fmt.Errorf("path %q escapes the restore directory", relPath)
+	}
+	return filepath.Join(root, relPath), nil
+}
+
+func parseChunkName(name string) (int64, int, bool) {
+	var timestamp int64
+	var seq int
+	if _, err := fmt.Sscanf(name, "chunk_%d_%d.dat", &timestamp, &seq); err != nil {
+		return 0, 0, false
+	}
+	return timestamp, seq, true
+}
+
 func readChunk(filename string) (Chunk, error) {
-	file, err := os.Open(filename)
+	file, err := os.Open(chunkPath(filename))
 	if err != nil {
 		return Chunk{}, err
 	}
 	defer file.Close()
 
-	var chunk Chunk
-	err = gob.NewDecoder(file).Decode(&chunk)
+	reader := bufio.NewReader(file)
+	var version byte
+	format := formatGob
+	header, err := reader.Peek(len(chunkMagic) + 1)
+	if err == nil && string(header[:len(chunkMagic)]) == chunkMagic {
+		version = header[len(chunkMagic)]
+		if version > chunkVersion {
+			return Chunk{}, fmt.Errorf("%w: %d", ErrUnsupportedChunkVersion, version)
+		}
+		if _, err := reader.Discard(len(header)); err != nil {
+			return Chunk{}, err
+		}
+		if version >= 3 {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return Chunk{}, err
+			}
+			format = chunkFormat(b)
+		}
+	}
+	codec, err := codecFor(format)
+	if err != nil {
+		return Chunk{}, err
+	}
+
+	var payload io.Reader = reader
+	if version >= 2 {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return Chunk{}, err
+		}
+		if len(data) < sha256.Size {
+			return Chunk{}, fmt.Errorf("%w: file truncated", ErrChunkChecksum)
+		}
+		body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+		if got := sha256.Sum256(body); !bytes.Equal(got[:], sum) {
+			return Chunk{}, ErrChunkChecksum
+		}
+		payload = bytes.NewReader(body)
+	}
+
+	chunk, err := codec.decode(payload)
+	chunk.format = format
 	return chunk, err
 }
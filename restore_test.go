@@ -1,8 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -11,7 +23,7 @@ func TestRestore_NoChunksFound(t *testing.T) {
 	tmpBackup := t.TempDir()
 	tmpRestore := t.TempDir()
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err == nil {
 		t.Error("expected error when no chunks found, got nil")
 	}
@@ -40,7 +52,7 @@ func TestRestore_SingleFile(t *testing.T) {
 	}
 
 	// Restore
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -89,7 +101,7 @@ func TestRestore_MultipleFiles(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -131,7 +143,7 @@ func TestRestore_NestedDirectoryStructure(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -174,7 +186,7 @@ func TestRestore_PreservesPermissions(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -234,7 +246,7 @@ func TestRestore_LaterChunkOverridesEarlier(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -283,7 +295,7 @@ func TestRestore_FileDeletedInLaterChunk(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -341,7 +353,7 @@ func TestRestore_FileDeletedThenRecreated(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -379,7 +391,7 @@ func TestRestore_OnlyDeletedEntries(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -422,7 +434,7 @@ func TestRestore_MixedDeletedAndNormal(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -480,7 +492,7 @@ func TestRestore_MultipleBackupRuns(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -537,7 +549,7 @@ func TestRestore_ChunksProcessedInOrder(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -556,7 +568,7 @@ func TestRestore_ChunksProcessedInOrder(t *testing.T) {
 func TestRestore_InvalidBackupPath(t *testing.T) {
 	tmpRestore := t.TempDir()
 
-	err := restore("/nonexistent/backup", tmpRestore)
+	err := restore("/nonexistent/backup", tmpRestore, restoreOptions{})
 	if err == nil {
 		t.Error("expected error with invalid backup path, got nil")
 	}
@@ -582,10 +594,12 @@ func TestRestore_CorruptedChunk(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Restore should skip corrupted chunk and restore valid one
-	err := restore(tmpBackup, tmpRestore)
-	if err != nil {
-		t.Fatalf("restore() error = %v", err)
+	// Restore should skip corrupted chunk, restore valid one, and report
+	// the result as partial
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
+	var partial *partialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected a partial restore, got %v", err)
 	}
 
 	// Valid file should still be restored
@@ -618,7 +632,7 @@ func TestRestore_MultipleChunksSameTimestamp(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err := restore(tmpBackup, tmpRestore)
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
 	if err != nil {
 		t.Fatalf("restore() error = %v", err)
 	}
@@ -631,3 +645,1481 @@ func TestRestore_MultipleChunksSameTimestamp(t *testing.T) {
 		t.Error("file2.txt should exist")
 	}
 }
+
+func writeRemapChunk(t *testing.T, backupPath string) {
+	t.Helper()
+	chunk := Chunk{
+		Entries: []*FileEntry{
+			{Path: filepath.Join("etc", "nginx", "nginx.conf"), Mode: 0644, Content: []byte("conf")},
+			{Path: filepath.Join("etc", "hosts"), Mode: 0644, Content: []byte("hosts")},
+		},
+	}
+	if err := writeChunk(backupPath, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestore_StripPrefix(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	writeRemapChunk(t, tmpBackup)
+
+	err := restore(tmpBackup, tmpRestore, restoreOptions{stripPrefix: "etc"})
+	if err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(tmpRestore, "nginx", "nginx.conf"))
+	if err != nil {
+		t.Fatalf("expected stripped path to exist: %v", err)
+	}
+	if string(content) != "conf" {
+		t.Errorf("expected 'conf', got %s", string(content))
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "hosts")); err != nil {
+		t.Errorf("expected hosts at stripped path: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "etc")); !os.IsNotExist(err) {
+		t.Error("original prefix directory should not be created")
+	}
+}
+
+func TestRestore_AddPrefix(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	writeRemapChunk(t, tmpBackup)
+
+	err := restore(tmpBackup, tmpRestore, restoreOptions{addPrefix: "recovered"})
+	if err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	target := filepath.Join(tmpRestore, "recovered", "etc", "nginx", "nginx.conf")
+	if _, err := os.Stat(target); err != nil {
+		t.Errorf("expected file at prefixed path: %v", err)
+	}
+}
+
+func TestRestore_StripAndAddPrefix(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	writeRemapChunk(t, tmpBackup)
+
+	opts := restoreOptions{stripPrefix: filepath.Join("etc", "nginx"), addPrefix: "web"}
+	if err := restore(tmpBackup, tmpRestore, opts); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpRestore, "web", "nginx.conf")); err != nil {
+		t.Errorf("expected remapped file: %v", err)
+	}
+	// Entries outside the stripped prefix only get the added prefix
+	if _, err := os.Stat(filepath.Join(tmpRestore, "web", "etc", "hosts")); err != nil {
+		t.Errorf("expected non-matching entry under added prefix: %v", err)
+	}
+}
+
+func TestRestore_RemapCannotEscapeTarget(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	writeRemapChunk(t, tmpBackup)
+
+	opts := restoreOptions{addPrefix: filepath.Join("..", "outside")}
+	var partial *partialError
+	if err := restore(tmpBackup, tmpRestore, opts); !errors.As(err, &partial) {
+		t.Fatalf("expected skipped entries to make the restore partial, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(tmpRestore), "outside")); !os.IsNotExist(err) {
+		t.Error("remapped entries must not be written outside the restore path")
+	}
+}
+
+func TestRestore_FullRunDropsFilesItDoesNotContain(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	chunk1 := Chunk{
+		Entries: []*FileEntry{
+			{Path: "stale.txt", Mode: 0644, Content: []byte("stale")},
+			{Path: "kept.txt", Mode: 0644, Content: []byte("v1")},
+		},
+		Final: true,
+	}
+	full := Chunk{
+		Entries: []*FileEntry{
+			{Path: "kept.txt", Mode: 0644, Content: []byte("v2")},
+		},
+		Full:  true,
+		Final: true,
+	}
+
+	if err := writeChunk(tmpBackup, 1000, 0, chunk1); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeChunk(tmpBackup, 2000, 0, full); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpRestore, "stale.txt")); !os.IsNotExist(err) {
+		t.Error("file absent from the full run should not be restored")
+	}
+	content, _ := os.ReadFile(filepath.Join(tmpRestore, "kept.txt"))
+	if string(content) != "v2" {
+		t.Errorf("expected 'v2', got %s", string(content))
+	}
+}
+
+func TestRestore_IncompleteFullRunKeepsEarlierFiles(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	chunk1 := Chunk{
+		Entries: []*FileEntry{
+			{Path: "a.txt", Mode: 0644, Content: []byte("a")},
+			{Path: "b.txt", Mode: 0644, Content: []byte("b")},
+		},
+		Final: true,
+	}
+	// The full run's first chunk is corrupt, so its final chunk alone
+	// must not be treated as the complete tree
+	full := Chunk{
+		Entries: []*FileEntry{{Path: "b.txt", Mode: 0644, Content: []byte("b")}},
+		Full:    true,
+		Final:   true,
+	}
+
+	if err := writeChunk(tmpBackup, 1000, 0, chunk1); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpBackup, "chunk_2000_000.dat"), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeChunk(tmpBackup, 2000, 1, full); err != nil {
+		t.Fatal(err)
+	}
+
+	var partial *partialError
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); !errors.As(err, &partial) {
+		t.Fatalf("expected a partial restore, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpRestore, "a.txt")); err != nil {
+		t.Error("a.txt should survive an incomplete full run")
+	}
+}
+
+func TestRestore_ForwardSlashPathsUseHostSeparator(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	// Paths are stored in canonical forward-slash form regardless of the
+	// OS that produced the backup
+	chunk := Chunk{
+		Entries: []*FileEntry{
+			{Path: "dir/sub/file.txt", Mode: 0644, Content: []byte("nested")},
+			{Path: "top.txt", Mode: 0644, Content: []byte("top")},
+		},
+	}
+	if err := writeChunk(tmpBackup, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(tmpRestore, "dir", "sub", "file.txt"))
+	if err != nil {
+		t.Fatalf("nested file not restored at host path: %v", err)
+	}
+	if string(content) != "nested" {
+		t.Errorf("expected 'nested', got %s", string(content))
+	}
+}
+
+func TestRestore_IgnoresFileTypeBitsInMode(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	chunk := Chunk{
+		Entries: []*FileEntry{
+			{Path: "file.txt", Mode: os.ModeIrregular | 0640, Content: []byte("data")},
+		},
+	}
+	if err := writeChunk(tmpBackup, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(tmpRestore, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Errorf("expected a regular file, got mode %v", info.Mode())
+	}
+}
+
+func TestRestore_DirectoryModTimes(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	dirTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	chunk := Chunk{
+		Entries: []*FileEntry{
+			{Path: "docs", Mode: os.ModeDir | 0750, ModTime: dirTime},
+			{Path: "docs/a.txt", Mode: 0644, ModTime: time.Now(), Content: []byte("a")},
+			{Path: "empty", Mode: os.ModeDir | 0755, ModTime: dirTime},
+		},
+	}
+	if err := writeChunk(tmpBackup, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	for _, dir := range []string{"docs", "empty"} {
+		info, err := os.Stat(filepath.Join(tmpRestore, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(dirTime) {
+			t.Errorf("%s: expected modtime %v, got %v", dir, dirTime, info.ModTime())
+		}
+	}
+	if runtime.GOOS != "windows" {
+		if info, _ := os.Stat(filepath.Join(tmpRestore, "docs")); info.Mode().Perm() != 0750 {
+			t.Errorf("expected directory mode 0750, got %v", info.Mode().Perm())
+		}
+	}
+}
+
+func TestRestore_DeletedDirectoryNotRestored(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "old", Mode: os.ModeDir | 0755, ModTime: time.Now()},
+	}})
+	writeChunk(tmpBackup, 2000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "old", Mode: os.ModeDir, Deleted: true},
+	}})
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "old")); !os.IsNotExist(err) {
+		t.Errorf("expected deleted directory not to be restored, got %v", err)
+	}
+}
+
+func TestRestore_MergesMultipleBackups(t *testing.T) {
+	backupA := t.TempDir()
+	backupB := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	file := func(path, content string) *FileEntry {
+		return &FileEntry{Path: path, Mode: 0644, Content: []byte(content)}
+	}
+	// Runs interleave across the two backups: 1000 (A), 2000 (B), 3000 (A),
+	// with a tie at 4000 broken by the order the backups are given
+	writeChunk(backupA, 1000, 0, Chunk{Entries: []*FileEntry{file("shared.txt", "A1"), file("a.txt", "a"), file("gone.txt", "x")}})
+	writeChunk(backupB, 2000, 0, Chunk{Entries: []*FileEntry{file("shared.txt", "B2"), file("b.txt", "b")}})
+	writeChunk(backupA, 3000, 0, Chunk{Entries: []*FileEntry{file("shared.txt", "A3"), {Path: "gone.txt", Deleted: true}}})
+	writeChunk(backupA, 4000, 0, Chunk{Entries: []*FileEntry{file("tie.txt", "A4")}})
+	writeChunk(backupB, 4000, 0, Chunk{Entries: []*FileEntry{file("tie.txt", "B4")}})
+
+	if err := restore(backupA, tmpRestore, restoreOptions{mergeFrom: []string{backupB}}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	want := map[string]string{"shared.txt": "A3", "a.txt": "a", "b.txt": "b", "tie.txt": "B4"}
+	for path, content := range want {
+		got, err := os.ReadFile(filepath.Join(tmpRestore, path))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: got %q (%v), want %q", path, got, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "gone.txt")); !os.IsNotExist(err) {
+		t.Error("expected gone.txt, deleted in a later run, not to be restored")
+	}
+}
+
+func TestRestore_MergeRequiresChunksInEveryBackup(t *testing.T) {
+	backupA := t.TempDir()
+	writeChunk(backupA, 1000, 0, Chunk{Entries: []*FileEntry{{Path: "a.txt", Content: []byte("a")}}})
+
+	err := restore(backupA, t.TempDir(), restoreOptions{mergeFrom: []string{t.TempDir()}})
+	if err == nil {
+		t.Error("expected an error for a merged backup without chunks")
+	}
+}
+
+func TestRestore_ResumesInterruptedRestore(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	var entries []*FileEntry
+	for i := range 10 {
+		entries = append(entries, &FileEntry{
+			Path:    fmt.Sprintf("dir/file%d.txt", i),
+			Mode:    0644,
+			ModTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Content: []byte(fmt.Sprintf("content %d", i)),
+		})
+	}
+	if err := createBackup(tmpBackup, entries, backupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt the first restore after a few files
+	interrupted := errors.New("interrupted")
+	written := 0
+	opts := restoreOptions{onFile: func(string, *FileEntry) error {
+		if written == 4 {
+			return interrupted
+		}
+		written++
+		return nil
+	}}
+	if err := restore(tmpBackup, tmpRestore, opts); !errors.Is(err, interrupted) {
+		t.Fatalf("expected the restore to be interrupted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, restoreJournalName)); err != nil {
+		t.Fatalf("expected a journal after an interrupted restore: %v", err)
+	}
+
+	first := make(map[string]os.FileInfo)
+	for _, entry := range entries {
+		if info, err := os.Stat(filepath.Join(tmpRestore, entry.Path)); err == nil {
+			first[entry.Path] = info
+		}
+	}
+	if len(first) != 4 {
+		t.Fatalf("expected 4 files from the interrupted restore, got %d", len(first))
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("resumed restore() error = %v", err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(tmpRestore, entry.Path)
+		content, err := os.ReadFile(path)
+		if err != nil || !bytes.Equal(content, entry.Content) {
+			t.Errorf("%s: got %q (%v)", entry.Path, content, err)
+			continue
+		}
+		if before, ok := first[entry.Path]; ok {
+			if after, _ := os.Stat(path); !os.SameFile(before, after) {
+				t.Errorf("%s was rewritten by the resumed restore", entry.Path)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, restoreJournalName)); !os.IsNotExist(err) {
+		t.Errorf("expected the journal to be removed after a clean restore, got %v", err)
+	}
+}
+
+func TestRestore_JournalIgnoresChangedFiles(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{{Path: "a.txt", Mode: 0644, ModTime: modTime, Content: []byte("backed up")}}})
+
+	// A journal from an interrupted run whose file was since edited, keeping
+	// its size
+	target := filepath.Join(tmpRestore, "a.txt")
+	if err := os.WriteFile(target, []byte("edited!!!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	journal := fmt.Sprintf("%s %q\n", hashContent([]byte("backed up")), "a.txt")
+	if err := os.WriteFile(filepath.Join(tmpRestore, restoreJournalName), []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(target); string(content) != "backed up" {
+		t.Errorf("expected a.txt to be restored, got %q", content)
+	}
+}
+
+// backupDirState records everything about a directory that a read-only
+// operation must leave untouched.
+func backupDirState(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	state := make(map[string]string)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state[entry.Name()] = fmt.Sprintf("%v %d %s %x", info.Mode(), info.Size(), info.ModTime(), content)
+	}
+	return state
+}
+
+func TestRestore_ReadOnlyBackupDir(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	chunks := []Chunk{
+		{Entries: []*FileEntry{
+			{Path: "keep.txt", Mode: 0644, Content: []byte("keep")},
+			{Path: "gone.txt", Mode: 0644, Content: []byte("gone")},
+		}, Final: true},
+		{Entries: []*FileEntry{{Path: "gone.txt", Deleted: true}}, Final: true},
+	}
+	for i, chunk := range chunks {
+		if err := writeChunk(tmpBackup, int64(1000*(i+1)), 0, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpBackup, "*"))
+	for _, file := range files {
+		if err := os.Chmod(file, 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(tmpBackup, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(tmpBackup, 0755) })
+
+	// Permissions are not enforced for root, so compare the directory too
+	before := backupDirState(t, tmpBackup)
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() from read-only backup error = %v", err)
+	}
+	if err := listBackup(io.Discard, tmpBackup, false); err != nil {
+		t.Fatalf("listBackup() error = %v", err)
+	}
+	if err := printStats(io.Discard, tmpBackup, false, 0); err != nil {
+		t.Fatalf("printStats() error = %v", err)
+	}
+
+	if after := backupDirState(t, tmpBackup); !reflect.DeepEqual(before, after) {
+		t.Errorf("backup directory changed:\nbefore: %v\nafter:  %v", before, after)
+	}
+
+	content, err := os.ReadFile(filepath.Join(tmpRestore, "keep.txt"))
+	if err != nil || string(content) != "keep" {
+		t.Errorf("expected keep.txt to be restored, got %q (%v)", content, err)
+	}
+}
+
+func TestRestore_TempDirSameFilesystem(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	tmpScratch := t.TempDir()
+	writeRemapChunk(t, tmpBackup)
+
+	var renames []string
+	renameFile = func(oldpath, newpath string) error {
+		renames = append(renames, oldpath)
+		return os.Rename(oldpath, newpath)
+	}
+	t.Cleanup(func() { renameFile = os.Rename })
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{tempDir: tmpScratch}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	if len(renames) == 0 {
+		t.Fatal("expected files to be renamed into place")
+	}
+	for _, oldpath := range renames {
+		if filepath.Dir(oldpath) != tmpScratch {
+			t.Errorf("expected temp file in %s, got %s", tmpScratch, oldpath)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "etc", "nginx", "nginx.conf")); err != nil {
+		t.Errorf("expected restored file: %v", err)
+	}
+	if leftovers, _ := os.ReadDir(tmpScratch); len(leftovers) != 0 {
+		t.Errorf("expected temp dir to be empty, found %d entries", len(leftovers))
+	}
+}
+
+func TestRestore_TempDirCrossDeviceFallback(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	tmpScratch := t.TempDir()
+	writeRemapChunk(t, tmpBackup)
+
+	// Pretend the scratch directory is on another filesystem
+	renameFile = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) == tmpScratch {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	t.Cleanup(func() { renameFile = os.Rename })
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{tempDir: tmpScratch}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	target := filepath.Join(tmpRestore, "etc", "nginx", "nginx.conf")
+	content, err := os.ReadFile(target)
+	if err != nil || string(content) != "conf" {
+		t.Errorf("expected restored nginx.conf, got %q (%v)", content, err)
+	}
+	if leftovers, _ := os.ReadDir(tmpScratch); len(leftovers) != 0 {
+		t.Errorf("expected failed temp files to be cleaned up, found %d", len(leftovers))
+	}
+	siblings, _ := os.ReadDir(filepath.Dir(target))
+	for _, sibling := range siblings {
+		if strings.HasPrefix(sibling.Name(), ".aikido-restore-") {
+			t.Errorf("temp file %s left in target directory", sibling.Name())
+		}
+	}
+}
+
+type modeOverride struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (m modeOverride) Mode() os.FileMode { return m.mode }
+
+// stripModes makes statFile report mode for the next n calls (all calls if
+// n is negative), as a filesystem that cannot store Unix permissions would.
+func stripModes(t *testing.T, mode os.FileMode, n int) {
+	t.Helper()
+	statFile = func(name string) (os.FileInfo, error) {
+		info, err := os.Stat(name)
+		if err != nil || n == 0 {
+			return info, err
+		}
+		n--
+		return modeOverride{info, mode}, nil
+	}
+	t.Cleanup(func() { statFile = os.Stat })
+}
+
+func captureLog(t *testing.T) *strings.Builder {
+	t.Helper()
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func writeScriptChunk(t *testing.T, backupPath string) {
+	t.Helper()
+	chunk := Chunk{Entries: []*FileEntry{{Path: "run.sh", Mode: 0755, Content: []byte("#!/bin/sh\n")}}}
+	if err := writeChunk(backupPath, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestore_WarnsWhenModeNotKept(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix modes are not checked on Windows")
+	}
+	tmpBackup := t.TempDir()
+	writeScriptChunk(t, tmpBackup)
+	stripModes(t, 0644, -1)
+	logs := captureLog(t)
+
+	if err := restore(tmpBackup, t.TempDir(), restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "did not keep mode -rwxr-xr-x for run.sh") {
+		t.Errorf("expected a mode warning, got:\n%s", logs.String())
+	}
+}
+
+func TestRestore_ExecBitOnlyFixesExecutableBit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix modes are not checked on Windows")
+	}
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	writeScriptChunk(t, tmpBackup)
+	// The first stat sees the executable bit dropped; the chmod then sticks
+	stripModes(t, 0644, 1)
+	logs := captureLog(t)
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{execBitOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "Warning") {
+		t.Errorf("expected no warning once the executable bit was fixed, got:\n%s", logs.String())
+	}
+	info, err := os.Stat(filepath.Join(tmpRestore, "run.sh"))
+	if err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("expected run.sh to be executable, got %v (%v)", info.Mode(), err)
+	}
+}
+
+func TestRestore_ExecBitOnlyWarnsWhenBitCannotBeSet(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix modes are not checked on Windows")
+	}
+	tmpBackup := t.TempDir()
+	writeScriptChunk(t, tmpBackup)
+	stripModes(t, 0644, -1)
+	logs := captureLog(t)
+
+	if err := restore(tmpBackup, t.TempDir(), restoreOptions{execBitOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "did not keep the executable bit for run.sh") {
+		t.Errorf("expected an executable bit warning, got:\n%s", logs.String())
+	}
+}
+
+func TestRestore_SetuidBit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("setuid restore is tested on Linux")
+	}
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	binary := filepath.Join(tmpWatch, "helper")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(binary, 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}); err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLog(t)
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(tmpRestore, "helper"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := info.Mode()&os.ModeSetuid != 0 && info.Mode().Perm() == 0755
+	warned := strings.Contains(logs.String(), "helper lost its setuid bit")
+	if os.Geteuid() == 0 && !kept {
+		t.Errorf("expected the setuid bit restored as root, got %v\n%s", info.Mode(), logs.String())
+	}
+	if !kept && !warned {
+		t.Errorf("expected the setuid bit restored or a warning, got %v\n%s", info.Mode(), logs.String())
+	}
+}
+
+func TestRestore_WarnsWhenSpecialBitsNotKept(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix modes are not checked on Windows")
+	}
+	tmpBackup := t.TempDir()
+	chunk := Chunk{Entries: []*FileEntry{{Path: "helper", Mode: 0755 | os.ModeSetuid | os.ModeSetgid, Content: []byte("#!/bin/sh\n")}}}
+	if err := writeChunk(tmpBackup, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+	// As without the privilege to set them, the bits do not stick
+	stripModes(t, 0755, -1)
+	logs := captureLog(t)
+
+	if err := restore(tmpBackup, t.TempDir(), restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "helper lost its setuid and setgid bits") {
+		t.Errorf("expected a special bits warning, got:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "did not keep mode") {
+		t.Errorf("expected no permission warning when only special bits were lost, got:\n%s", logs.String())
+	}
+}
+
+func TestRestore_OverlayOntoBase(t *testing.T) {
+	for _, removeExtras := range []bool{false, true} {
+		t.Run(fmt.Sprintf("removeExtras=%v", removeExtras), func(t *testing.T) {
+			tmpBackup := t.TempDir()
+			base := t.TempDir()
+			writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+				{Path: "same.txt", Mode: 0644, Content: []byte("same")},
+				{Path: "differs.txt", Mode: 0644, Content: []byte("new content")},
+				{Path: "missing.txt", Mode: 0644, Content: []byte("missing")},
+				{Path: "gone.txt", Mode: 0644, Content: []byte("gone")},
+			}, Full: true, Final: true})
+			writeChunk(tmpBackup, 2000, 0, Chunk{Entries: []*FileEntry{{Path: "gone.txt", Deleted: true}}, Final: true})
+
+			for name, content := range map[string]string{
+				"same.txt":    "same",
+				"differs.txt": "old content",
+				"gone.txt":    "gone",
+				"extra.txt":   "extra",
+			} {
+				if err := os.WriteFile(filepath.Join(base, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before, err := os.Stat(filepath.Join(base, "same.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			logs := captureLog(t)
+
+			if err := restore(tmpBackup, base, restoreOptions{overlay: true, removeExtras: removeExtras}); err != nil {
+				t.Fatalf("restore() error = %v", err)
+			}
+
+			after, err := os.Stat(filepath.Join(base, "same.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(before, after) {
+				t.Error("expected a file matching the base not to be rewritten")
+			}
+			for name, want := range map[string]string{"differs.txt": "new content", "missing.txt": "missing"} {
+				if got, err := os.ReadFile(filepath.Join(base, name)); err != nil || string(got) != want {
+					t.Errorf("%s = %q (%v), want %q", name, got, err, want)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(base, "gone.txt")); !os.IsNotExist(err) {
+				t.Errorf("expected the file deleted in the backup removed from the base, got %v", err)
+			}
+			_, err = os.Stat(filepath.Join(base, "extra.txt"))
+			if removeExtras && !os.IsNotExist(err) {
+				t.Errorf("expected the extra file removed, got %v", err)
+			}
+			if !removeExtras && err != nil {
+				t.Errorf("expected the extra file kept, got %v", err)
+			}
+			if !strings.Contains(logs.String(), "1 of them already matched the base") {
+				t.Errorf("expected the unchanged file counted, got:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestRestore_OnFileCallback(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	writeRemapChunk(t, tmpBackup)
+
+	opts := restoreOptions{
+		onFile: func(relPath string, entry *FileEntry) error {
+			if filepath.Base(relPath) == "hosts" {
+				return ErrSkipFile
+			}
+			entry.Content = bytes.ToUpper(entry.Content)
+			return nil
+		},
+	}
+	if err := restore(tmpBackup, tmpRestore, opts); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpRestore, "etc", "hosts")); !os.IsNotExist(err) {
+		t.Error("expected the skipped file not to be written")
+	}
+	content, err := os.ReadFile(filepath.Join(tmpRestore, "etc", "nginx", "nginx.conf"))
+	if err != nil || string(content) != "CONF" {
+		t.Errorf("expected the transformed content, got %q (%v)", content, err)
+	}
+
+	failure := errors.New("storage unavailable")
+	opts.onFile = func(string, *FileEntry) error { return failure }
+	if err := restore(tmpBackup, t.TempDir(), opts); !errors.Is(err, failure) {
+		t.Errorf("expected the callback error to abort the restore, got %v", err)
+	}
+}
+
+// Restoring into memory instead of the filesystem: the callback keeps each
+// file's content and skips writing it.
+func Example_restoreIntoMap() {
+	backupPath, _ := os.MkdirTemp("", "example-backup")
+	defer os.RemoveAll(backupPath)
+	writeChunk(backupPath, 1000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "etc/hosts", Mode: 0644, Content: []byte("127.0.0.1 localhost")},
+		{Path: "etc/motd", Mode: 0644, Content: []byte("welcome")},
+	}})
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	files := make(map[string][]byte)
+	opts := restoreOptions{
+		onFile: func(relPath string, entry *FileEntry) error {
+			files[entry.Path] = entry.Content
+			return ErrSkipFile
+		},
+	}
+	if err := restore(backupPath, os.TempDir(), opts); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Printf("%s: %s\n", path, files[path])
+	}
+	// Output:
+	// etc/hosts: 127.0.0.1 localhost
+	// etc/motd: welcome
+}
+
+func TestRestore_ModifiedAfter(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	cutoff := time.Unix(5000, 0)
+	file := func(path, content string, modTime int64) *FileEntry {
+		return &FileEntry{Path: path, Mode: 0644, Content: []byte(content), ModTime: time.Unix(modTime, 0)}
+	}
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		file("old.txt", "old", 1000),
+		file("at-cutoff.txt", "edge", 5000),
+		file("gone-early.txt", "x", 1000),
+		file("gone-late.txt", "y", 1000),
+	}})
+	writeChunk(tmpBackup, 2000, 0, Chunk{Entries: []*FileEntry{{Path: "gone-early.txt", Deleted: true}}})
+	writeChunk(tmpBackup, 6000, 0, Chunk{Entries: []*FileEntry{
+		file("recent.txt", "new", 6000),
+		{Path: "gone-late.txt", Deleted: true},
+	}})
+
+	// The target holds an older copy of the tree
+	for _, name := range []string{"old.txt", "at-cutoff.txt", "gone-early.txt", "gone-late.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpRestore, name), []byte("stale"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{modifiedAfter: cutoff}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	want := map[string]string{
+		"recent.txt":     "new",
+		"old.txt":        "stale",
+		"at-cutoff.txt":  "stale",
+		"gone-early.txt": "stale",
+	}
+	for path, content := range want {
+		got, err := os.ReadFile(filepath.Join(tmpRestore, path))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: got %q (%v), want %q", path, got, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "gone-late.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected file deleted after the cutoff to be removed, got %v", err)
+	}
+}
+
+func TestRestore_ModifiedAfterWithPrefix(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "etc/old.conf", Mode: 0644, Content: []byte("old"), ModTime: time.Unix(1000, 0)},
+		{Path: "etc/new.conf", Mode: 0644, Content: []byte("new"), ModTime: time.Unix(9000, 0)},
+	}})
+
+	opts := restoreOptions{stripPrefix: "etc", addPrefix: "recovered", modifiedAfter: time.Unix(5000, 0)}
+	if err := restore(tmpBackup, tmpRestore, opts); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	if got, err := os.ReadFile(filepath.Join(tmpRestore, "recovered", "new.conf")); err != nil || string(got) != "new" {
+		t.Errorf("new.conf: got %q (%v), want %q", got, err, "new")
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "recovered", "old.conf")); !os.IsNotExist(err) {
+		t.Errorf("expected old.conf not to be restored, got %v", err)
+	}
+}
+
+func TestRestore_ContinuesPastUnwritableFiles(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	entries := []*FileEntry{{Path: "blocker/inner.txt", Mode: 0644, Content: []byte("blocked")}}
+	for i := range 20 {
+		entries = append(entries, &FileEntry{Path: fmt.Sprintf("dir%d/file%d.txt", i%4, i), Mode: 0644, Content: []byte(fmt.Sprint(i))})
+	}
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: entries})
+
+	// A file where the backup has a directory makes one path unwritable
+	if err := os.WriteFile(filepath.Join(tmpRestore, "blocker"), []byte("in the way"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	err := restore(tmpBackup, tmpRestore, restoreOptions{})
+	var partial *partialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected a partial error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "could not restore 1 paths") {
+		t.Errorf("expected the failure counted in %q", err)
+	}
+	if !strings.Contains(logs.String(), "    blocker/inner.txt") {
+		t.Errorf("expected the failed path listed in the log:\n%s", logs.String())
+	}
+
+	for _, entry := range entries[1:] {
+		got, err := os.ReadFile(filepath.Join(tmpRestore, entry.Path))
+		if err != nil || !bytes.Equal(got, entry.Content) {
+			t.Errorf("%s: got %q (%v), want %q", entry.Path, got, err, entry.Content)
+		}
+	}
+}
+
+func TestRestore_MissingBackupStillAborts(t *testing.T) {
+	tmpRestore := t.TempDir()
+
+	err := restore(filepath.Join(t.TempDir(), "gone"), tmpRestore, restoreOptions{})
+	var partial *partialError
+	if err == nil || errors.As(err, &partial) {
+		t.Fatalf("expected a hard error for a missing backup, got %v", err)
+	}
+}
+
+func TestRestore_MetadataOnlyCreatesPlaceholders(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	modTime := time.Unix(1700000000, 0)
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "notes.txt", Mode: 0644, ModTime: modTime, Size: 5, Content: []byte("notes")},
+		{Path: "media/movie.mkv", Mode: 0600, ModTime: modTime, Size: 4096, ContentHash: "abc123", MetadataOnly: true},
+	}})
+	logs := captureLog(t)
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(tmpRestore, "media", "movie.mkv"))
+	if err != nil {
+		t.Fatalf("expected a placeholder for movie.mkv: %v", err)
+	}
+	if info.Size() != 0 || !info.ModTime().Equal(modTime) {
+		t.Errorf("expected an empty placeholder with the backed-up modtime, got %d bytes at %v", info.Size(), info.ModTime())
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+	if got, err := os.ReadFile(filepath.Join(tmpRestore, "notes.txt")); err != nil || string(got) != "notes" {
+		t.Errorf("expected notes.txt restored with content, got %q (%v)", got, err)
+	}
+	if !strings.Contains(logs.String(), "1 files were backed up without content") ||
+		!strings.Contains(logs.String(), "media/movie.mkv (4096 bytes, sha256 abc123)") {
+		t.Errorf("expected the placeholder reported:\n%s", logs.String())
+	}
+}
+
+func TestRestore_ReadOnlyTarget(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "locked.txt", Mode: 0644, ModTime: time.Unix(1000, 0), Content: []byte("backed up")},
+		{Path: "open.txt", Mode: 0644, ModTime: time.Unix(1000, 0), Content: []byte("backed up")},
+	}})
+	readOnlyTree := func(t *testing.T) string {
+		dir := t.TempDir()
+		for _, name := range []string{"locked.txt", "open.txt"} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte("local"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Chmod(filepath.Join(dir, "locked.txt"), 0444); err != nil {
+			t.Fatal(err)
+		}
+		// Let TempDir's cleanup remove it on Windows
+		t.Cleanup(func() { os.Chmod(filepath.Join(dir, "locked.txt"), 0644) })
+		return dir
+	}
+
+	t.Run("skipped by default", func(t *testing.T) {
+		tmpRestore := readOnlyTree(t)
+		logs := captureLog(t)
+
+		err := restore(tmpBackup, tmpRestore, restoreOptions{})
+		var partial *partialError
+		if !errors.As(err, &partial) {
+			t.Fatalf("expected a partial restore, got %v", err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(tmpRestore, "locked.txt")); string(got) != "local" {
+			t.Errorf("expected the read-only file left alone, got %q", got)
+		}
+		if got, _ := os.ReadFile(filepath.Join(tmpRestore, "open.txt")); string(got) != "backed up" {
+			t.Errorf("expected the writable file restored, got %q", got)
+		}
+		if !strings.Contains(logs.String(), "locked.txt: the existing file is read-only") {
+			t.Errorf("expected the skip reported:\n%s", logs.String())
+		}
+	})
+
+	t.Run("replaced with force-overwrite", func(t *testing.T) {
+		tmpRestore := readOnlyTree(t)
+
+		if err := restore(tmpBackup, tmpRestore, restoreOptions{forceOverwrite: true}); err != nil {
+			t.Fatalf("restore() error = %v", err)
+		}
+		path := filepath.Join(tmpRestore, "locked.txt")
+		if got, _ := os.ReadFile(path); string(got) != "backed up" {
+			t.Errorf("expected the read-only file replaced, got %q", got)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm()&0200 == 0 {
+			t.Errorf("expected the backed-up mode applied, got %v", info.Mode().Perm())
+		}
+	})
+}
+
+func TestRestore_MoreThanAThousandChunksInOneRun(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	const chunks = 1002
+	for seq := range chunks {
+		chunk := Chunk{Entries: []*FileEntry{{Path: "counter.txt", Mode: 0644, Content: []byte(strconv.Itoa(seq))}}}
+		chunk.Final = seq == chunks-1
+		if err := writeChunk(tmpBackup, 1700000000, seq, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// chunk_1700000000_1000.dat sorts before chunk_1700000000_999.dat by name
+	files, err := chunkFiles(tmpBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, file := range files {
+		if _, seq, _ := parseChunkName(filepath.Base(file)); seq != i {
+			t.Fatalf("chunk %d of the listing is %s", i, filepath.Base(file))
+		}
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(tmpRestore, "counter.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(chunks - 1); string(got) != want {
+		t.Errorf("expected the last chunk's version %q, got %q", want, got)
+	}
+}
+
+func TestRestore_TracePath(t *testing.T) {
+	tmpBackup := t.TempDir()
+	runs := []Chunk{
+		{Entries: []*FileEntry{{Path: "a.txt", Mode: 0644, Size: 3, Content: []byte("one")}, {Path: "b.txt", Mode: 0644, Size: 1, Content: []byte("b")}}, Final: true},
+		{Entries: []*FileEntry{{Path: "a.txt", Deleted: true}}, Final: true},
+		{Entries: []*FileEntry{{Path: "a.txt", Mode: 0644, Size: 5, Content: []byte("three")}}, Final: true},
+		{Entries: []*FileEntry{{Path: "b.txt", Mode: 0644, Size: 2, Content: []byte("bb")}}, Final: true},
+	}
+	for i, chunk := range runs {
+		if err := writeChunk(tmpBackup, int64(1000*(i+1)), 0, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logs := captureLog(t)
+	if err := restore(tmpBackup, t.TempDir(), restoreOptions{tracePaths: []string{"./a.txt"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var traces []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if _, trace, ok := strings.Cut(line, "Trace "); ok {
+			traces = append(traces, trace)
+		}
+	}
+	want := []string{
+		"a.txt: write of 3 bytes, modified 0001-01-01T00:00:00Z in run 1970-01-01T00:16:40Z (chunk_1000_000.dat)",
+		"a.txt: delete in run 1970-01-01T00:33:20Z (chunk_2000_000.dat)",
+		"a.txt: write of 5 bytes, modified 0001-01-01T00:00:00Z in run 1970-01-01T00:50:00Z (chunk_3000_000.dat)",
+		"a.txt: restored from chunk_3000_000.dat",
+	}
+	if len(traces) != len(want) {
+		t.Fatalf("got trace %q, want %d lines", traces, len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(traces[i], want[i]) {
+			t.Errorf("trace line %d = %q, want prefix %q", i, traces[i], want[i])
+		}
+	}
+}
+
+func TestRestore_ZeroModeGetsDefault(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix permissions")
+	}
+	tmpBackup := t.TempDir()
+	chunk := Chunk{Entries: []*FileEntry{
+		{Path: "dir", Mode: os.ModeDir},
+		{Path: "dir/a.txt", Content: []byte("a")},
+	}, Final: true}
+	if err := writeChunk(tmpBackup, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := captureLog(t)
+	tmpRestore := t.TempDir()
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]os.FileMode{"dir": 0755, "dir/a.txt": 0644} {
+		info, err := os.Stat(filepath.Join(tmpRestore, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s restored with mode %v, want %v", path, got, want)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(tmpRestore, "dir/a.txt")); err != nil || string(data) != "a" {
+		t.Errorf("restored file unreadable: %q, %v", data, err)
+	}
+	if !strings.Contains(logs.String(), "dir/a.txt has no permissions in the backup, restoring it with -rw-r--r--") {
+		t.Errorf("expected a warning about the zero mode, got %q", logs.String())
+	}
+}
+
+func TestRestore_EmptyContentAsDelete(t *testing.T) {
+	tmpBackup := t.TempDir()
+	first := Chunk{Entries: []*FileEntry{
+		{Path: "gone.txt", Mode: 0644, Content: []byte("old")},
+		{Path: "kept.txt", Mode: 0644, Content: []byte("kept")},
+	}, Final: true}
+	// A broken import wrote an empty entry where it meant a deletion
+	second := Chunk{Entries: []*FileEntry{
+		{Path: "gone.txt", Mode: 0644},
+		{Path: "new-empty.txt", Mode: 0644},
+	}, Final: true}
+	for i, chunk := range []Chunk{first, second} {
+		if err := writeChunk(tmpBackup, int64(1000*(i+1)), 0, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		emptyAsDelete bool
+		want          map[string]string
+	}{
+		{"default keeps empty files", false, map[string]string{"gone.txt": "", "kept.txt": "kept", "new-empty.txt": ""}},
+		{"flag deletes them", true, map[string]string{"kept.txt": "kept"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpRestore := t.TempDir()
+			if err := restore(tmpBackup, tmpRestore, restoreOptions{emptyAsDelete: tt.emptyAsDelete}); err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			entries, err := os.ReadDir(tmpRestore)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if entry.Name() == restoreJournalName {
+					continue
+				}
+				data, err := os.ReadFile(filepath.Join(tmpRestore, entry.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[entry.Name()] = string(data)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("restored %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestore_LeavesExistingGitAlone(t *testing.T) {
+	tmpBackup := t.TempDir()
+	chunk := Chunk{Entries: []*FileEntry{
+		{Path: ".git", Mode: os.ModeDir | 0755},
+		{Path: ".git/HEAD", Mode: 0644, Content: []byte("ref: refs/heads/old\n")},
+		{Path: "sub/.git", Mode: 0644, Content: []byte("gitdir: elsewhere\n")},
+		{Path: "config.yml", Mode: 0644, Content: []byte("restored")},
+		{Path: "local/secret.env", Mode: 0644, Content: []byte("restored")},
+	}, Final: true}
+	if err := writeChunk(tmpBackup, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	// The target is a working tree with its own repository and local files
+	tmpRestore := t.TempDir()
+	for path, content := range map[string]string{".git/HEAD": "ref: refs/heads/main\n", "local/secret.env": "mine"} {
+		target := filepath.Join(tmpRestore, path)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exclude, err := newExcludeMatcher([]string{"local/"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{exclude: exclude}); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		".git/HEAD":        "ref: refs/heads/main\n",
+		"local/secret.env": "mine",
+		"config.yml":       "restored",
+		// The target had no .git here, so the backed-up one is restored
+		"sub/.git": "gitdir: elsewhere\n",
+	} {
+		if data, err := os.ReadFile(filepath.Join(tmpRestore, path)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v; want %q", path, data, err, want)
+		}
+	}
+}
+
+func TestRestore_PreserveTargetNewer(t *testing.T) {
+	tmpBackup := t.TempDir()
+	backedUp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	chunk := Chunk{Entries: []*FileEntry{
+		{Path: "edited.txt", Mode: 0644, ModTime: backedUp, Content: []byte("backup")},
+		{Path: "stale.txt", Mode: 0644, ModTime: backedUp, Content: []byte("backup")},
+	}, Final: true}
+	if err := writeChunk(tmpBackup, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	setup := func(t *testing.T) string {
+		tmpRestore := t.TempDir()
+		for name, modTime := range map[string]time.Time{"edited.txt": backedUp.Add(time.Hour), "stale.txt": backedUp.Add(-time.Hour)} {
+			path := filepath.Join(tmpRestore, name)
+			if err := os.WriteFile(path, []byte("target"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tmpRestore
+	}
+
+	tests := []struct {
+		preserveNewer bool
+		want          map[string]string
+	}{
+		{false, map[string]string{"edited.txt": "backup", "stale.txt": "backup"}},
+		{true, map[string]string{"edited.txt": "target", "stale.txt": "backup"}},
+	}
+	for _, tt := range tests {
+		tmpRestore := setup(t)
+		if err := restore(tmpBackup, tmpRestore, restoreOptions{preserveNewer: tt.preserveNewer}); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range tt.want {
+			if data, _ := os.ReadFile(filepath.Join(tmpRestore, name)); string(data) != want {
+				t.Errorf("preserveNewer=%t: %s = %q, want %q", tt.preserveNewer, name, data, want)
+			}
+		}
+	}
+}
+
+func TestRestore_Transform(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("transform test uses a POSIX shell")
+	}
+	tmpBackup := t.TempDir()
+	binary := []byte{0x00, 0xff, 'a', '\n', 'z'}
+	chunk := Chunk{Entries: []*FileEntry{
+		{Path: "etc/app.conf", Mode: 0600, Content: []byte("password = {{secret}}\n")},
+		{Path: "etc/other.conf", Mode: 0644, Content: []byte("user = me\n")},
+		{Path: "data/blob.bin", Mode: 0644, Content: binary},
+	}, Final: true}
+	if err := writeChunk(tmpBackup, 1000, 0, chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	match, err := newExcludeMatcher([]string{"etc/app.conf"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpRestore := t.TempDir()
+	transform := &contentTransform{command: `tr a-z A-Z; echo "# $1"`, match: match}
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{transform: transform}); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string][]byte{
+		"etc/app.conf":   []byte("PASSWORD = {{SECRET}}\n# etc/app.conf\n"),
+		"etc/other.conf": []byte("user = me\n"),
+		"data/blob.bin":  binary,
+	} {
+		if got, err := os.ReadFile(filepath.Join(tmpRestore, path)); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(tmpRestore, "etc/app.conf")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the transformed file to keep its mode, got %v, %v", info.Mode(), err)
+	}
+
+	// A failing transform leaves the file unwritten rather than writing
+	// the unfilled template
+	tmpRestore = t.TempDir()
+	transform.command = "exit 1"
+	var partial *partialError
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{transform: transform}); !errors.As(err, &partial) {
+		t.Fatalf("expected a partial restore, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "etc/app.conf")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected etc/app.conf not to be written, got %v", err)
+	}
+}
+
+func TestRestore_ExpectSource(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := chunkFiles(tmpBackup)
+	if err != nil || len(files) == 0 {
+		t.Fatalf("expected chunks, got %v, %v", files, err)
+	}
+	chunk, err := readChunk(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk.Source != tmpWatch {
+		t.Fatalf("expected the run labelled with the watch path %s, got %q", tmpWatch, chunk.Source)
+	}
+
+	wrongTarget := filepath.Join(t.TempDir(), "out")
+	err = restore(tmpBackup, wrongTarget, restoreOptions{expectSource: "/srv/other"})
+	if err == nil || !strings.Contains(err.Error(), tmpWatch) {
+		t.Fatalf("expected a mismatched --expect-source to refuse the restore, got %v", err)
+	}
+	if _, err := os.Stat(wrongTarget); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("refused restore should not create the target, stat error = %v", err)
+	}
+
+	tmpRestore := t.TempDir()
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{expectSource: tmpWatch}); err != nil {
+		t.Fatalf("restore with the matching source error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "a.txt")); err != nil {
+		t.Error(err)
+	}
+
+	// An explicit label replaces the path, and is what the latest run is
+	// checked against
+	if err := os.WriteFile(filepath.Join(tmpWatch, "b.txt"), []byte("more"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, source: "alice-project"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(tmpBackup, t.TempDir(), restoreOptions{expectSource: tmpWatch}); err == nil {
+		t.Error("expected the relabelled backup to no longer match the old label")
+	}
+	if err := restore(tmpBackup, t.TempDir(), restoreOptions{expectSource: "alice-project"}); err != nil {
+		t.Errorf("restore with the new label error = %v", err)
+	}
+
+	unlabelled := t.TempDir()
+	legacy := Chunk{Entries: []*FileEntry{{Path: "a.txt", Mode: 0644, Content: []byte("x")}}, Final: true}
+	if err := writeChunk(unlabelled, 1000, 0, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := simulateRestore(unlabelled, t.TempDir(), restoreOptions{expectSource: "alice-project"}); err == nil {
+		t.Error("expected a backup without a source label to be refused")
+	}
+}
+
+func TestRestore_JournalAfterPartialRestore(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "a.txt", Mode: 0644, ModTime: time.Unix(1000, 0), Content: []byte("a")},
+		{Path: "b.txt", Mode: 0644, ModTime: time.Unix(1000, 0), Content: []byte("b")},
+	}})
+	// A second run whose chunk is damaged
+	writeChunk(tmpBackup, 2000, 0, Chunk{Entries: []*FileEntry{{Path: "c.txt", Mode: 0644, Content: []byte("c")}}})
+	corruptChunk(t, filepath.Join(tmpBackup, "chunk_2000_000.dat"))
+
+	t.Run("unreadable chunk", func(t *testing.T) {
+		tmpRestore := t.TempDir()
+		var partial *partialError
+		if err := restore(tmpBackup, tmpRestore, restoreOptions{}); !errors.As(err, &partial) {
+			t.Fatalf("expected a partial restore, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(tmpRestore, restoreJournalName)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the journal removed when a rerun cannot help, stat error = %v", err)
+		}
+	})
+
+	t.Run("failed write", func(t *testing.T) {
+		tmpRestore := t.TempDir()
+		renameFile = func(oldpath, newpath string) error {
+			if filepath.Base(newpath) == "b.txt" {
+				return errors.New("disk full")
+			}
+			return os.Rename(oldpath, newpath)
+		}
+		t.Cleanup(func() { renameFile = os.Rename })
+
+		var partial *partialError
+		if err := restore(tmpBackup, tmpRestore, restoreOptions{}); !errors.As(err, &partial) {
+			t.Fatalf("expected a partial restore, got %v", err)
+		}
+		journal, err := os.ReadFile(filepath.Join(tmpRestore, restoreJournalName))
+		if err != nil || !strings.Contains(string(journal), `"a.txt"`) {
+			t.Fatalf("expected the journal kept for a retry, got %q (%v)", journal, err)
+		}
+
+		// The retry writes the failed file; the damaged chunk still makes it
+		// partial, so the journal goes with it
+		renameFile = os.Rename
+		if err := restore(tmpBackup, tmpRestore, restoreOptions{}); !errors.As(err, &partial) {
+			t.Fatalf("expected the rerun to be partial, got %v", err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(tmpRestore, "b.txt")); string(got) != "b" {
+			t.Errorf("expected the rerun to restore b.txt, got %q", got)
+		}
+		if _, err := os.Stat(filepath.Join(tmpRestore, restoreJournalName)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the journal removed after the rerun, stat error = %v", err)
+		}
+	})
+}
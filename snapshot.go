@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const defaultSnapshotName = "snapshot.json"
+
+type snapshotState struct {
+	WatchPath string
+	Files     *fileSnapshot
+	// Dirs holds directory modtimes (UnixNano) recorded by --fast-scan.
+	Dirs map[string]int64 `json:",omitempty"`
+	// Runs counts completed backup runs, used to schedule full runs.
+	Runs int
+	// Lagging maps a backup destination dropped from a run to the runs it
+	// missed, which the next run copies to it before writing its own.
+	Lagging map[string][]int64 `json:",omitempty"`
+}
+
+// fileSnapshot maps each backed-up path to its content hash, or for a
+// directory its dirSnapshotValue. It is safe for concurrent use, so changes
+// can be recorded while a scan or backup reads it.
+type fileSnapshot struct {
+	mu    sync.RWMutex
+	files map[string]string
+}
+
+// newFileSnapshot returns a snapshot holding a copy of files.
+func newFileSnapshot(files map[string]string) *fileSnapshot {
+	s := &fileSnapshot{files: maps.Clone(files)}
+	if s.files == nil {
+		s.files = make(map[string]string)
+	}
+	return s
+}
+
+func (s *fileSnapshot) set(path, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = value
+}
+
+func (s *fileSnapshot) delete(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, path)
+}
+
+func (s *fileSnapshot) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.files)
+}
+
+// clone returns a copy of the snapshot's entries that later changes to the
+// snapshot do not affect.
+func (s *fileSnapshot) clone() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.files)
+}
+
+// replace swaps the snapshot's entries for a copy of files.
+func (s *fileSnapshot) replace(files map[string]string) {
+	files = maps.Clone(files)
+	if files == nil {
+		files = make(map[string]string)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = files
+}
+
+// The snapshot persists as a plain JSON object of path to hash.
+func (s *fileSnapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.clone())
+}
+
+func (s *fileSnapshot) UnmarshalJSON(data []byte) error {
+	var files map[string]string
+	if err := json.Unmarshal(data, &files); err != nil {
+		return err
+	}
+	s.replace(files)
+	return nil
+}
+
+func loadSnapshot(path, watchPath string) (*snapshotState, error) {
+	absWatch, err := filepath.Abs(watchPath)
+	if err != nil {
+		return nil, err
+	}
+	fresh := &snapshotState{WatchPath: absWatch, Files: newFileSnapshot(nil)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fresh, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state snapshotState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	if state.WatchPath != absWatch {
+		log.Printf("Snapshot %s was taken of %q, not %q; discarding it", path, state.WatchPath, absWatch)
+		return fresh, nil
+	}
+
+	if state.Files == nil {
+		state.Files = newFileSnapshot(nil)
+	}
+	return &state, nil
+}
+
+func saveSnapshot(path string, state *snapshotState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// reconcileSnapshot compares state with what the chunks in backupPath
+// actually hold, found by replaying them as restore does. If chunks were
+// pruned or deleted out of band the two disagree, and state is rebuilt from
+// the backup so the next run stores whatever the backup is missing.
+func reconcileSnapshot(state *snapshotState, backupPath string) error {
+	backedUp := make(map[string]string)
+	if files, _ := chunkFiles(backupPath); len(files) > 0 {
+		resolved, err := resolveBackup(backupPath)
+		if err != nil {
+			return err
+		}
+		for path, entry := range resolved.files {
+			hash := entry.ContentHash
+			if hash == "" {
+				hash = hashContent(entry.Content)
+			}
+			backedUp[path] = hash
+		}
+		for path, entry := range resolved.dirs {
+			backedUp[path] = dirSnapshotValue(entry.Mode, entry.ModTime)
+		}
+	}
+
+	known := state.Files.clone()
+	stale := 0
+	for path, value := range known {
+		if backedUp[path] != value {
+			stale++
+		}
+	}
+	for path := range backedUp {
+		if _, ok := known[path]; !ok {
+			stale++
+		}
+	}
+	if stale == 0 {
+		return nil
+	}
+
+	log.Printf("Warning: snapshot disagrees with the backup on %d paths; rebuilding it from the backup", stale)
+	state.Files.replace(backedUp)
+	// Directory modtimes vouch for files that are no longer known to be
+	// backed up, so --fast-scan walks everything once
+	state.Dirs = nil
+	return nil
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type runInfo struct {
+	Timestamp int64
+	Chunks    int
+	Files     int
+	Deleted   []string
+	// Bytes is the space the run takes: its own chunk files, ChunkBytes,
+	// plus the content-addressed objects no earlier run names. Objects maps
+	// every object the run's index names to its size, since removing the
+	// run only frees those no remaining run names.
+	Bytes      int64
+	ChunkBytes int64
+	Objects    map[string]int64
+	Full       bool
+	// Complete marks a full run whose chunks were all read, which makes
+	// every earlier run redundant.
+	Complete bool
+	// Finished marks a run whose final chunk has been written, with every
+	// chunk before it.
+	Finished bool
+	// Changed lists the files whose content differs from the state before
+	// the run, and the paths it deleted. Unlike Files, a full run only
+	// counts what really changed. ChangedBytes is the size of the changed
+	// files.
+	Changed      []string
+	ChangedBytes int64
+	// Source is the run's source label, empty for runs that predate them.
+	Source string
+}
+
+// collectRuns reads every chunk once, returning per-run summaries alongside
+// the resolved final state.
+func collectRuns(backupPath string) ([]runInfo, *resolver, error) {
+	files, err := listChunks(backupPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	runs, r := collectRunsFrom(files)
+	return runs, r, nil
+}
+
+// collectRunsFrom summarizes the runs in files, which must be in replay order.
+func collectRunsFrom(files []string) ([]runInfo, *resolver) {
+	var runs []runInfo
+	r := newResolver()
+	// Content hash of each path as of the runs replayed so far
+	hashes := make(map[string]string)
+	// Objects already counted in an earlier run's Bytes
+	counted := make(map[string]bool)
+	for _, chunkFile := range files {
+		chunk, err := readChunk(chunkFile)
+		if err != nil {
+			log.Printf("Error reading %s: %v", chunkFile, err)
+			continue
+		}
+		r.apply(chunkFile, chunk)
+
+		timestamp, seq, _ := parseChunkName(filepath.Base(chunkFile))
+		if len(runs) == 0 || runs[len(runs)-1].Timestamp != timestamp {
+			runs = append(runs, runInfo{Timestamp: timestamp})
+		}
+		run := &runs[len(runs)-1]
+		run.Chunks++
+		run.Full = run.Full || chunk.Full
+		run.Source = chunk.Source
+		run.Finished = chunk.Final && run.Chunks == seq+1
+		run.Complete = chunk.Full && run.Finished
+		if path := chunkPath(chunkFile); path != chunkFile {
+			if info, err := os.Stat(path); err == nil {
+				if run.Objects == nil {
+					run.Objects = make(map[string]int64)
+				}
+				run.Objects[path] = info.Size()
+				if !counted[path] {
+					counted[path] = true
+					run.Bytes += info.Size()
+				}
+			}
+		} else if info, err := os.Stat(chunkFile); err == nil {
+			run.ChunkBytes += info.Size()
+			run.Bytes += info.Size()
+		}
+		for _, entry := range chunk.Entries {
+			switch {
+			case entry.Mode.IsDir():
+			case entry.Deleted:
+				run.Deleted = append(run.Deleted, entry.Path)
+				if _, ok := hashes[entry.Path]; ok {
+					delete(hashes, entry.Path)
+					run.Changed = append(run.Changed, entry.Path)
+				}
+			case entry.Part == 0:
+				run.Files++
+				hash := cmp.Or(entry.ContentHash, entry.ContentRef)
+				if hash == "" {
+					hash = hashContent(entry.Content)
+				}
+				if old, ok := hashes[entry.Path]; !ok || old != hash {
+					hashes[entry.Path] = hash
+					run.Changed = append(run.Changed, entry.Path)
+					run.ChangedBytes += cmp.Or(entry.Size, int64(len(entry.Content)))
+				}
+			}
+		}
+	}
+	return runs, r
+}
+
+func listBackup(w io.Writer, backupPath string, filterDeleted bool) error {
+	runs, _, err := collectRuns(backupPath)
+	if err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		printRun(w, run, filterDeleted)
+	}
+	return nil
+}
+
+func printRun(w io.Writer, run runInfo, filterDeleted bool) {
+	if filterDeleted && len(run.Deleted) == 0 {
+		return
+	}
+	kind := "incremental"
+	if run.Full {
+		kind = "full"
+	}
+	fmt.Fprintf(w, "%s  %-11s  chunks=%d files=%d deleted=%d bytes=%d",
+		time.Unix(run.Timestamp, 0).UTC().Format(time.RFC3339), kind,
+		run.Chunks, run.Files, len(run.Deleted), run.Bytes)
+	if run.Source != "" {
+		fmt.Fprintf(w, " source=%s", run.Source)
+	}
+	fmt.Fprintln(w)
+	if filterDeleted {
+		for _, path := range run.Deleted {
+			fmt.Fprintf(w, "    %s\n", path)
+		}
+	}
+}
+
+// liveEntry is one path of the resolved state, as printed by printLiveState.
+type liveEntry struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+// printLiveState writes the files and directories a restore of backupPath
+// would produce, sorted by path, as a JSON array. Nothing is written to disk.
+func printLiveState(w io.Writer, backupPath string) error {
+	state, err := resolveBackup(backupPath)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]liveEntry, 0, len(state.files)+len(state.dirs))
+	for path, entry := range state.dirs {
+		entries = append(entries, liveEntry{
+			Path:    path,
+			Type:    "dir",
+			Mode:    fmt.Sprintf("%04o", entry.Mode.Perm()),
+			ModTime: entry.ModTime.UTC(),
+		})
+	}
+	for path, entry := range state.files {
+		hash := entry.ContentHash
+		if hash == "" {
+			hash = hashContent(entry.Content)
+		}
+		entries = append(entries, liveEntry{
+			Path:    path,
+			Type:    "file",
+			Size:    cmp.Or(entry.Size, int64(len(entry.Content))),
+			Mode:    fmt.Sprintf("%04o", entry.Mode.Perm()),
+			ModTime: entry.ModTime.UTC(),
+			SHA256:  hash,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+// followInterval is how often followBackup polls; tests shorten it.
+var followInterval = time.Second
+
+// followBackup prints each run that finishes in backupPath from now on,
+// like tail -f, until ctx is done. Runs already finished when it starts are
+// not printed, and only chunks of runs not yet seen finished are read.
+func followBackup(ctx context.Context, w io.Writer, backupPath string, filterDeleted bool) error {
+	finished := make(map[int64]bool)
+	first := true
+	for {
+		files, err := chunkFiles(backupPath)
+		if err != nil {
+			return err
+		}
+
+		var pending []string
+		for _, file := range files {
+			if timestamp, _, _ := parseChunkName(filepath.Base(file)); !finished[timestamp] {
+				pending = append(pending, file)
+			}
+		}
+		runs, _ := collectRunsFrom(pending)
+		for _, run := range runs {
+			if !run.Finished {
+				continue
+			}
+			finished[run.Timestamp] = true
+			if !first {
+				printRun(w, run, filterDeleted)
+			}
+		}
+		first = false
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(followInterval):
+		}
+	}
+}
+
+// printStats prints totals for the backup and its churn over history. top,
+// when positive, also lists that many of the most frequently changed files.
+func printStats(w io.Writer, backupPath string, filterDeleted bool, top int) error {
+	runs, state, err := collectRuns(backupPath)
+	if err != nil {
+		return err
+	}
+
+	chunks, tombstones, changed := 0, 0, 0
+	var chunkBytes, liveBytes, changedBytes int64
+	changes := make(map[string]int)
+	for _, run := range runs {
+		chunks += run.Chunks
+		chunkBytes += run.Bytes
+		tombstones += len(run.Deleted)
+		changed += len(run.Changed)
+		changedBytes += run.ChangedBytes
+		for _, path := range run.Changed {
+			changes[path]++
+		}
+	}
+	for _, entry := range state.files {
+		liveBytes += entry.Size
+	}
+
+	fmt.Fprintf(w, "Runs:         %d\n", len(runs))
+	fmt.Fprintf(w, "Chunks:       %d (%d bytes)\n", chunks, chunkBytes)
+	fmt.Fprintf(w, "Live files:   %d (%d bytes)\n", len(state.files), liveBytes)
+	fmt.Fprintf(w, "Tombstones:   %d entries for %d deleted paths\n", tombstones, len(state.deleted))
+	if len(runs) > 0 {
+		n := int64(len(runs))
+		fmt.Fprintf(w, "Churn:        %d changed paths per run, %d bytes of changed content and %d chunk bytes per run\n",
+			int64(changed)/n, changedBytes/n, chunkBytes/n)
+	}
+	// The first run seeds the store, so growth is measured from the ones after
+	if len(runs) > 1 {
+		span := time.Duration(runs[len(runs)-1].Timestamp-runs[0].Timestamp) * time.Second
+		days := span.Hours() / 24
+		growth := chunkBytes - runs[0].Bytes
+		fmt.Fprintf(w, "Growth:       %d bytes/day over %.1f days\n", int64(float64(growth)/days), days)
+	}
+
+	if top > 0 && len(changes) > 0 {
+		paths := make([]string, 0, len(changes))
+		for path := range changes {
+			paths = append(paths, path)
+		}
+		sort.Slice(paths, func(i, j int) bool {
+			if changes[paths[i]] != changes[paths[j]] {
+				return changes[paths[i]] > changes[paths[j]]
+			}
+			return paths[i] < paths[j]
+		})
+		fmt.Fprintln(w, "Most changed:")
+		for _, path := range paths[:min(top, len(paths))] {
+			fmt.Fprintf(w, "  %5d  %s\n", changes[path], path)
+		}
+	}
+
+	if filterDeleted {
+		paths := make([]string, 0, len(state.deleted))
+		for path := range state.deleted {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			deletedAt := time.Unix(state.deleted[path], 0).UTC().Format(time.RFC3339)
+			fmt.Fprintf(w, "  deleted %s  %s\n", deletedAt, path)
+		}
+	}
+	return nil
+}
+
+// purgeTombstones permanently removes every entry for paths that have been
+// deleted, and not recreated, for longer than retention. Dropping the old
+// content along with the tombstone keeps the resolved live state unchanged.
+func purgeTombstones(backupPath string, retention time.Duration, now time.Time) (int, error) {
+	state, err := resolveBackup(backupPath)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := now.Add(-retention).Unix()
+	dead := make(map[string]bool)
+	for path, deletedAt := range state.deleted {
+		if deletedAt < cutoff {
+			dead[path] = true
+		}
+	}
+	if len(dead) == 0 {
+		return 0, nil
+	}
+
+	files, err := listChunks(backupPath)
+	if err != nil {
+		return 0, err
+	}
+	// Content dropped with a dead path may still be referenced by a live
+	// duplicate later in the same run; the first such duplicate takes it over.
+	var orphaned map[string][]byte
+	var runTimestamp int64
+	for _, chunkFile := range files {
+		chunk, err := readChunk(chunkFile)
+		if err != nil {
+			log.Printf("Error reading %s, leaving it untouched: %v", chunkFile, err)
+			continue
+		}
+		if timestamp, _, _ := parseChunkName(filepath.Base(chunkFile)); timestamp != runTimestamp || orphaned == nil {
+			orphaned = make(map[string][]byte)
+			runTimestamp = timestamp
+		}
+
+		changed := false
+		kept := chunk.Entries[:0]
+		for _, entry := range chunk.Entries {
+			if dead[entry.Path] {
+				if entry.ContentHash != "" {
+					orphaned[entry.ContentHash] = append(orphaned[entry.ContentHash], entry.Content...)
+				}
+				changed = true
+				continue
+			}
+			if content, ok := orphaned[entry.ContentRef]; ok && entry.ContentRef != "" {
+				entry.Content = content
+				entry.ContentHash, entry.ContentRef = entry.ContentRef, ""
+				delete(orphaned, entry.ContentHash)
+				changed = true
+			}
+			kept = append(kept, entry)
+		}
+		if !changed {
+			continue
+		}
+
+		// Empty chunks are kept so run boundaries and full-run markers survive
+		chunk.Entries = kept
+		if err := rewriteChunk(chunkFile, chunk); err != nil {
+			return 0, fmt.Errorf("rewriting %s: %w", chunkFile, err)
+		}
+	}
+
+	log.Printf("Purged tombstones for %d deleted paths", len(dead))
+	return len(dead), nil
+}
+
+// pruneToSize removes whole runs, oldest first, until the backup's chunks
+// total at most maxBytes. Only runs followed by a complete full run are
+// removed, since incremental runs depend on everything before them, so a
+// backup without recent full runs may stay over the cap. It returns the
+// removed runs and the new total.
+func pruneToSize(backupPath string, maxBytes int64) ([]runInfo, int64, error) {
+	planned, total, planErr := planPrune(backupPath, maxBytes)
+	if planned == nil && planErr != nil {
+		return nil, total, planErr
+	}
+
+	for i, run := range planned {
+		if err := removeRun(backupPath, run.Timestamp); err != nil {
+			for _, kept := range planned[i:] {
+				total += kept.Bytes
+			}
+			return planned[:i], total, fmt.Errorf("removing run %d: %w", run.Timestamp, err)
+		}
+	}
+	return planned, total, planErr
+}
+
+// planPrune picks the oldest runs to remove to bring backupPath down to
+// maxBytes, returning them and the total left after removing them. Only runs
+// before the last complete full run are picked; if that is not enough, the
+// error is a partialError.
+func planPrune(backupPath string, maxBytes int64) ([]runInfo, int64, error) {
+	runs, _, err := collectRuns(backupPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int64
+	lastComplete := -1
+	for i, run := range runs {
+		total += run.Bytes
+		if run.Complete {
+			lastComplete = i
+		}
+	}
+
+	// Removing a run frees its own chunks and the objects no remaining run
+	// names; its Bytes in the plan is what it frees
+	refs := make(map[string]int)
+	for _, run := range runs {
+		for object := range run.Objects {
+			refs[object]++
+		}
+	}
+	var pruned []runInfo
+	for i := 0; i < lastComplete && total > maxBytes; i++ {
+		run := runs[i]
+		run.Bytes = run.ChunkBytes
+		for object, size := range run.Objects {
+			if refs[object]--; refs[object] == 0 {
+				run.Bytes += size
+			}
+		}
+		pruned = append(pruned, run)
+		total -= run.Bytes
+	}
+
+	if total > maxBytes {
+		return pruned, total, &partialError{fmt.Sprintf(
+			"backup is still %d bytes, over the %d byte cap; the remaining runs are needed until a newer full run (see --full-every)",
+			total, maxBytes)}
+	}
+	return pruned, total, nil
+}
+
+// pruneDryRun prints the runs and chunk files pruneToSize would remove and
+// the space it would reclaim, without touching the backup. It also replays
+// the chunks that would remain and fails if they would not restore the
+// same files and directories as the whole backup does now.
+func pruneDryRun(w io.Writer, backupPath string, maxBytes int64) error {
+	pruned, total, planErr := planPrune(backupPath, maxBytes)
+	if pruned == nil && planErr != nil {
+		var partial *partialError
+		if !errors.As(planErr, &partial) {
+			return planErr
+		}
+	}
+
+	files, err := listChunks(backupPath)
+	if err != nil {
+		return err
+	}
+	removed := make(map[int64][]string)
+	for _, run := range pruned {
+		removed[run.Timestamp] = []string{}
+	}
+	var kept []string
+	for _, chunkFile := range files {
+		timestamp, _, _ := parseChunkName(filepath.Base(chunkFile))
+		if chunks, ok := removed[timestamp]; ok {
+			removed[timestamp] = append(chunks, filepath.Base(chunkFile))
+		} else {
+			kept = append(kept, chunkFile)
+		}
+	}
+
+	var reclaimed int64
+	for _, run := range pruned {
+		fmt.Fprintf(w, "would prune %s  chunks=%d bytes=%d\n",
+			time.Unix(run.Timestamp, 0).UTC().Format(time.RFC3339), run.Chunks, run.Bytes)
+		for _, chunk := range removed[run.Timestamp] {
+			fmt.Fprintf(w, "    %s\n", chunk)
+		}
+		reclaimed += run.Bytes
+	}
+	fmt.Fprintf(w, "Total: %d bytes after pruning %d runs, reclaiming %d bytes (dry run, nothing removed)\n",
+		total, len(pruned), reclaimed)
+
+	after := replayChunks(kept)
+	if !sameLiveState(replayChunks(files), after) {
+		return fmt.Errorf("pruning %d runs would change what a restore produces", len(pruned))
+	}
+	fmt.Fprintf(w, "Restore check: the remaining runs restore the same %d files and %d directories\n",
+		len(after.files), len(after.dirs))
+	return planErr
+}
+
+// sameLiveState reports whether a and b would restore identical files and
+// directories.
+func sameLiveState(a, b *resolver) bool {
+	same := func(x, y map[string]*FileEntry) bool {
+		if len(x) != len(y) {
+			return false
+		}
+		for path, ex := range x {
+			ey, ok := y[path]
+			if !ok || ex.Mode != ey.Mode || !ex.ModTime.Equal(ey.ModTime) ||
+				!bytes.Equal(ex.Content, ey.Content) || !bytes.Equal(ex.ACL, ey.ACL) ||
+				!bytes.Equal(ex.Capability, ey.Capability) {
+				return false
+			}
+		}
+		return true
+	}
+	return same(a.files, b.files) && same(a.dirs, b.dirs)
+}
+
+// removeRun deletes every chunk of the run with the given timestamp,
+// including unreadable ones, and its index if it has one, along with the
+// objects of that index no other run's index names.
+func removeRun(backupPath string, timestamp int64) error {
+	files, err := listChunks(backupPath)
+	if err != nil {
+		return err
+	}
+	for _, chunkFile := range files {
+		if ts, _, _ := parseChunkName(filepath.Base(chunkFile)); ts == timestamp {
+			if err := os.Remove(chunkFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	index := filepath.Join(backupPath, fmt.Sprintf("%s%d%s", indexPrefix, timestamp, indexSuffix))
+	objects, err := readRunIndex(index)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(index); err != nil {
+		return err
+	}
+
+	referenced, err := indexedObjects(backupPath)
+	if err != nil {
+		return err
+	}
+	for _, hash := range objects {
+		if referenced[hash] {
+			continue
+		}
+		object := filepath.Join(backupPath, objectsDir, hash+".dat")
+		if err := os.Remove(object); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func printPruned(w io.Writer, pruned []runInfo, total int64) {
+	for _, run := range pruned {
+		fmt.Fprintf(w, "pruned %s  chunks=%d bytes=%d\n",
+			time.Unix(run.Timestamp, 0).UTC().Format(time.RFC3339), run.Chunks, run.Bytes)
+	}
+	fmt.Fprintf(w, "Total: %d bytes after pruning %d runs\n", total, len(pruned))
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeTombstoneHistory(t *testing.T, backupPath string) {
+	t.Helper()
+	runs := []Chunk{
+		{Entries: []*FileEntry{
+			{Path: "live.txt", Mode: 0644, Content: []byte("live")},
+			{Path: "gone.txt", Mode: 0644, Content: []byte("gone")},
+			{Path: "back.txt", Mode: 0644, Content: []byte("v1")},
+		}},
+		{Entries: []*FileEntry{
+			{Path: "gone.txt", Deleted: true},
+			{Path: "back.txt", Deleted: true},
+		}},
+		{Entries: []*FileEntry{
+			{Path: "back.txt", Mode: 0644, Content: []byte("v2")},
+		}},
+	}
+	for i, chunk := range runs {
+		chunk.Final = true
+		if err := writeChunk(backupPath, int64(1000*(i+1)), 0, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPurgeTombstones_KeepsLiveFiles(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	writeTombstoneHistory(t, tmpBackup)
+
+	purged, err := purgeTombstones(tmpBackup, time.Hour, time.Unix(100000, 0))
+	if err != nil {
+		t.Fatalf("purgeTombstones() error = %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("expected 1 purged path, got %d", purged)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	for _, file := range files {
+		chunk, err := readChunk(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range chunk.Entries {
+			if entry.Path == "gone.txt" {
+				t.Errorf("%s still holds an entry for the purged path", filepath.Base(file))
+			}
+		}
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"live.txt": "live", "back.txt": "v2"} {
+		content, err := os.ReadFile(filepath.Join(tmpRestore, name))
+		if err != nil || string(content) != want {
+			t.Errorf("%s: expected %q after purge, got %q (%v)", name, want, content, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "gone.txt")); !os.IsNotExist(err) {
+		t.Error("purged path should still not be restored")
+	}
+}
+
+func TestPurgeTombstones_RespectsRetention(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeTombstoneHistory(t, tmpBackup)
+
+	// The deletion at t=2000 is only 500s old
+	purged, err := purgeTombstones(tmpBackup, time.Hour, time.Unix(2500, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 0 {
+		t.Errorf("expected nothing purged inside the retention window, got %d", purged)
+	}
+}
+
+func TestStats_ReportsTombstones(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeTombstoneHistory(t, tmpBackup)
+
+	var out bytes.Buffer
+	if err := printStats(&out, tmpBackup, true, 0); err != nil {
+		t.Fatalf("printStats() error = %v", err)
+	}
+
+	for _, want := range []string{
+		"Runs:         3",
+		"Live files:   2",
+		"Tombstones:   2 entries for 1 deleted paths",
+		"gone.txt",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("stats output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestList_FilterDeleted(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeTombstoneHistory(t, tmpBackup)
+
+	var out bytes.Buffer
+	if err := listBackup(&out, tmpBackup, false); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(out.String(), "chunks="); lines != 3 {
+		t.Errorf("expected 3 runs listed, got %d:\n%s", lines, out.String())
+	}
+
+	out.Reset()
+	if err := listBackup(&out, tmpBackup, true); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(out.String(), "chunks="); lines != 1 {
+		t.Errorf("expected only the run with deletions, got %d:\n%s", lines, out.String())
+	}
+	if !strings.Contains(out.String(), "deleted=2") || !strings.Contains(out.String(), "gone.txt") {
+		t.Errorf("expected deleted paths in filtered listing:\n%s", out.String())
+	}
+}
+
+func TestPurgeTombstones_KeepsContentSharedWithLiveDuplicate(t *testing.T) {
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	shared := []byte("shared content")
+	if err := writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "gone.txt", Mode: 0644, Content: shared, ContentHash: hashContent(shared)},
+		{Path: "copy.txt", Mode: 0644, ContentRef: hashContent(shared)},
+	}, Final: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeChunk(tmpBackup, 2000, 0, Chunk{Entries: []*FileEntry{
+		{Path: "gone.txt", Deleted: true},
+	}, Final: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := purgeTombstones(tmpBackup, time.Hour, time.Unix(100000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() after purge error = %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(tmpRestore, "copy.txt"))
+	if err != nil || string(content) != string(shared) {
+		t.Errorf("expected copy.txt to keep the shared content, got %q (%v)", content, err)
+	}
+}
+
+// writeSizedRuns writes five single-chunk runs of about 10KB each, with
+// complete full runs at 2000 and 4000.
+func writeSizedRuns(t *testing.T, backupPath string) {
+	t.Helper()
+	for i := range 5 {
+		timestamp := int64(1000 * (i + 1))
+		chunk := Chunk{
+			Entries: []*FileEntry{{Path: fmt.Sprintf("run%d.dat", i), Mode: 0644, Content: distinctContent(i, 10*1024)}},
+			Full:    i == 1 || i == 3,
+			Final:   true,
+		}
+		if chunk.Full {
+			// A full run carries the whole tree so far
+			for j := range i {
+				chunk.Entries = append(chunk.Entries, &FileEntry{Path: fmt.Sprintf("run%d.dat", j), Mode: 0644, Content: []byte("kept")})
+			}
+		}
+		if err := writeChunk(backupPath, timestamp, 0, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func chunkBytes(t *testing.T, backupPath string) (int64, []string) {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(backupPath, "chunk_*.dat"))
+	var total int64
+	var names []string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+		names = append(names, filepath.Base(file))
+	}
+	return total, names
+}
+
+func TestPruneToSize_RemovesOldestRuns(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeSizedRuns(t, tmpBackup)
+	before, err := resolveBackup(tmpBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, _ := chunkBytes(t, tmpBackup)
+
+	// Room for a little over three of the five runs
+	limit := total * 7 / 10
+	pruned, newTotal, err := pruneToSize(tmpBackup, limit)
+	if err != nil {
+		t.Fatalf("pruneToSize() error = %v", err)
+	}
+	if len(pruned) != 2 || pruned[0].Timestamp != 1000 || pruned[1].Timestamp != 2000 {
+		t.Fatalf("expected runs 1000 and 2000 pruned, got %+v", pruned)
+	}
+
+	onDisk, names := chunkBytes(t, tmpBackup)
+	if newTotal != onDisk || newTotal > limit {
+		t.Errorf("reported total %d, on disk %d, limit %d", newTotal, onDisk, limit)
+	}
+	want := []string{"chunk_3000_000.dat", "chunk_4000_000.dat", "chunk_5000_000.dat"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("expected remaining chunks %v, got %v", want, names)
+	}
+
+	after, err := resolveBackup(tmpBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.files) != len(before.files) {
+		t.Fatalf("expected %d live files after pruning, got %d", len(before.files), len(after.files))
+	}
+	for path, entry := range before.files {
+		if got, ok := after.files[path]; !ok || !bytes.Equal(got.Content, entry.Content) {
+			t.Errorf("%s changed by pruning", path)
+		}
+	}
+}
+
+func TestPruneToSize_KeepsRunsNeededByLaterIncrementals(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeSizedRuns(t, tmpBackup)
+
+	pruned, _, err := pruneToSize(tmpBackup, 1)
+	if exitCode(err) != exitPartial {
+		t.Fatalf("expected a partial error for a cap that cannot be met, got %v", err)
+	}
+	if len(pruned) != 3 {
+		t.Errorf("expected only the 3 runs before the last full run pruned, got %d", len(pruned))
+	}
+	if _, names := chunkBytes(t, tmpBackup); len(names) != 2 {
+		t.Errorf("expected the last full run and its incremental to remain, got %v", names)
+	}
+}
+
+func TestPruneDryRun_ReportsWithoutRemoving(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeSizedRuns(t, tmpBackup)
+	total, namesBefore := chunkBytes(t, tmpBackup)
+	info1, _ := os.Stat(filepath.Join(tmpBackup, "chunk_1000_000.dat"))
+	info2, _ := os.Stat(filepath.Join(tmpBackup, "chunk_2000_000.dat"))
+	reclaimed := info1.Size() + info2.Size()
+
+	var out bytes.Buffer
+	if err := pruneDryRun(&out, tmpBackup, total*7/10); err != nil {
+		t.Fatalf("pruneDryRun() error = %v", err)
+	}
+
+	if _, names := chunkBytes(t, tmpBackup); strings.Join(names, ",") != strings.Join(namesBefore, ",") {
+		t.Errorf("dry run removed chunks: had %v, now %v", namesBefore, names)
+	}
+	got := out.String()
+	for _, want := range []string{
+		"would prune " + time.Unix(1000, 0).UTC().Format(time.RFC3339),
+		"    chunk_1000_000.dat\n",
+		"would prune " + time.Unix(2000, 0).UTC().Format(time.RFC3339),
+		"    chunk_2000_000.dat\n",
+		fmt.Sprintf("Total: %d bytes after pruning 2 runs, reclaiming %d bytes", total-reclaimed, reclaimed),
+		"Restore check: the remaining runs restore the same 5 files",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "chunk_3000_000.dat") {
+		t.Errorf("output lists a run that is kept:\n%s", got)
+	}
+}
+
+func TestPruneDryRun_CapThatCannotBeMet(t *testing.T) {
+	tmpBackup := t.TempDir()
+	writeSizedRuns(t, tmpBackup)
+
+	var out bytes.Buffer
+	err := pruneDryRun(&out, tmpBackup, 1)
+	if exitCode(err) != exitPartial {
+		t.Fatalf("expected a partial error for a cap that cannot be met, got %v", err)
+	}
+	if _, names := chunkBytes(t, tmpBackup); len(names) != 5 {
+		t.Errorf("dry run removed chunks, %v remain", names)
+	}
+	if !strings.Contains(out.String(), "after pruning 3 runs") {
+		t.Errorf("expected the 3 removable runs reported:\n%s", out.String())
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to read while another goroutine writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFollowBackup_ReportsNewRuns(t *testing.T) {
+	tmpBackup := t.TempDir()
+	original := followInterval
+	followInterval = 5 * time.Millisecond
+	defer func() { followInterval = original }()
+
+	file := func(path string) *FileEntry {
+		return &FileEntry{Path: path, Mode: 0644, Content: []byte(path)}
+	}
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{file("old.txt")}, Full: true, Final: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var out syncBuffer
+	done := make(chan error)
+	go func() { done <- followBackup(ctx, &out, tmpBackup, false) }()
+	time.Sleep(20 * time.Millisecond)
+
+	// A run is not reported until its final chunk lands
+	writeChunk(tmpBackup, 2000, 0, Chunk{Entries: []*FileEntry{file("a.txt")}})
+	time.Sleep(20 * time.Millisecond)
+	if got := out.String(); got != "" {
+		t.Errorf("expected nothing reported for an unfinished run, got:\n%s", got)
+	}
+	writeChunk(tmpBackup, 2000, 1, Chunk{Entries: []*FileEntry{file("b.txt"), {Path: "old.txt", Deleted: true}}, Final: true})
+
+	want := time.Unix(2000, 0).UTC().Format(time.RFC3339) + "  incremental  chunks=2 files=2 deleted=1"
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(out.String(), want) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("followBackup() error = %v", err)
+	}
+
+	got := out.String()
+	if !strings.Contains(got, want) {
+		t.Errorf("expected the new run reported as %q, got:\n%s", want, got)
+	}
+	if strings.Contains(got, time.Unix(1000, 0).UTC().Format(time.RFC3339)) {
+		t.Errorf("expected the run that existed at startup not reported, got:\n%s", got)
+	}
+	if strings.Count(got, "\n") != 1 {
+		t.Errorf("expected the new run reported once, got:\n%s", got)
+	}
+}
+
+func TestStats_Churn(t *testing.T) {
+	tmpBackup := t.TempDir()
+	file := func(path, content string) *FileEntry {
+		return &FileEntry{Path: path, Mode: 0644, Content: []byte(content), Size: int64(len(content))}
+	}
+	const start, day = 1700000000, 24 * 60 * 60
+	runs := []Chunk{
+		{Entries: []*FileEntry{file("a.txt", "a1"), file("b.txt", "b1"), file("c.txt", "c1")}, Full: true, Final: true},
+		{Entries: []*FileEntry{file("a.txt", "a2"), file("b.txt", "b2")}, Final: true},
+		{Entries: []*FileEntry{file("a.txt", "a3"), {Path: "c.txt", Deleted: true}}, Final: true},
+		// A full run only counts the file that really changed
+		{Entries: []*FileEntry{file("a.txt", "a3"), file("b.txt", "b4")}, Full: true, Final: true},
+	}
+	for i, chunk := range runs {
+		if err := writeChunk(tmpBackup, int64(start+day*i), 0, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total, _ := chunkBytes(t, tmpBackup)
+	first, _ := os.Stat(filepath.Join(tmpBackup, fmt.Sprintf("chunk_%d_000.dat", start)))
+	growth := (total - first.Size()) / 3
+
+	var out bytes.Buffer
+	if err := printStats(&out, tmpBackup, false, 2); err != nil {
+		t.Fatalf("printStats() error = %v", err)
+	}
+
+	// 8 changed paths and 14 bytes of changed content over 4 runs
+	for _, want := range []string{
+		fmt.Sprintf("Churn:        2 changed paths per run, 3 bytes of changed content and %d chunk bytes per run", total/4),
+		fmt.Sprintf("Growth:       %d bytes/day over 3.0 days", growth),
+		"Most changed:\n      3  a.txt\n      3  b.txt\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("stats output missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "c.txt") {
+		t.Errorf("expected --top 2 to leave out c.txt:\n%s", out.String())
+	}
+}
+
+func TestPrintLiveState(t *testing.T) {
+	tmpBackup := t.TempDir()
+	modTime := time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC)
+	file := func(path, content string, mode os.FileMode) *FileEntry {
+		return &FileEntry{Path: path, Mode: mode, ModTime: modTime, Content: []byte(content), Size: int64(len(content))}
+	}
+	writeChunk(tmpBackup, 1000, 0, Chunk{Entries: []*FileEntry{
+		file("a.txt", "old", 0644),
+		{Path: "sub", Mode: os.ModeDir | 0750, ModTime: modTime},
+		file("sub/run.sh", "#!/bin/sh\n", 0755),
+		file("gone.txt", "x", 0644),
+		{Path: "big.iso", Mode: 0644, ModTime: modTime, Size: 4096, ContentHash: "abc123", MetadataOnly: true},
+	}, Final: true})
+	writeChunk(tmpBackup, 2000, 0, Chunk{Entries: []*FileEntry{
+		file("a.txt", "new content", 0600),
+		{Path: "gone.txt", Deleted: true},
+	}, Final: true})
+
+	var out bytes.Buffer
+	if err := printLiveState(&out, tmpBackup); err != nil {
+		t.Fatalf("printLiveState() error = %v", err)
+	}
+	var got []liveEntry
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("output is not a JSON array of entries: %v\n%s", err, out.String())
+	}
+
+	want := []liveEntry{
+		{Path: "a.txt", Type: "file", Size: 11, Mode: "0600", ModTime: modTime, SHA256: hashContent([]byte("new content"))},
+		{Path: "big.iso", Type: "file", Size: 4096, Mode: "0644", ModTime: modTime, SHA256: "abc123"},
+		{Path: "sub", Type: "dir", Mode: "0750", ModTime: modTime},
+		{Path: "sub/run.sh", Type: "file", Size: 10, Mode: "0755", ModTime: modTime, SHA256: hashContent([]byte("#!/bin/sh\n"))},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("live state:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestPruneToSize_ContentAddressedObjects(t *testing.T) {
+	tmpBackup := t.TempDir()
+	old := Chunk{Entries: []*FileEntry{{Path: "old.txt", Mode: 0644, Content: []byte("only in the first run")}}, Full: true, Final: true}
+	same := Chunk{Entries: []*FileEntry{{Path: "same.txt", Mode: 0644, Content: []byte("in both later runs")}}, Full: true, Final: true}
+	objectSize := func(hash string) int64 {
+		info, err := os.Stat(filepath.Join(tmpBackup, objectsDir, hash+".dat"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	var unshared, shared string
+	for _, run := range []struct {
+		timestamp int64
+		chunk     Chunk
+		hash      *string
+	}{{1000, old, &unshared}, {2000, same, &shared}, {3000, same, &shared}} {
+		hash, _, err := writeObject(tmpBackup, run.chunk, fsyncNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*run.hash = hash
+		if err := writeRunIndex(tmpBackup, run.timestamp, []string{hash}, fsyncNone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sharedSize, unsharedSize := objectSize(shared), objectSize(unshared)
+
+	// The shared object counts once towards the total
+	var out bytes.Buffer
+	if err := pruneDryRun(&out, tmpBackup, 0); err == nil {
+		t.Fatal("expected a cap of 0 to be unreachable")
+	}
+	wantTotal := fmt.Sprintf("Total: %d bytes after pruning 2 runs, reclaiming %d bytes", sharedSize, unsharedSize)
+	if !strings.Contains(out.String(), wantTotal) {
+		t.Errorf("expected %q in the dry run, got:\n%s", wantTotal, out.String())
+	}
+
+	pruned, total, err := pruneToSize(tmpBackup, 0)
+	var partial *partialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected a partial prune, got %v", err)
+	}
+	if len(pruned) != 2 || pruned[0].Bytes != unsharedSize || pruned[1].Bytes != 0 {
+		t.Errorf("expected the first run to free its object and the second nothing, got %+v", pruned)
+	}
+	if total != sharedSize {
+		t.Errorf("reported total %d, want the shared object's %d", total, sharedSize)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpBackup, objectsDir, unshared+".dat")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the unshared object removed, stat error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpBackup, objectsDir, shared+".dat")); err != nil {
+		t.Errorf("expected the object still named by run 3000 kept: %v", err)
+	}
+	state, err := resolveBackup(tmpBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.files["same.txt"]; !ok || len(state.files) != 1 {
+		t.Errorf("expected only same.txt left to restore, got %d files", len(state.files))
+	}
+}
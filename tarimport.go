@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// importTar seeds backupPath with a full run holding the contents of the
+// tar stream r, which may be gzip-compressed, so history can start from an
+// existing archive instead of a scan. Entries are streamed into chunks as
+// they are read. A hard link is imported as a file with the content of the
+// member it links to. Backups cannot store symbolic links, so an archive
+// holding one fails the import rather than being imported without it.
+// Special files are skipped with a warning. It returns how many entries
+// were imported.
+func importTar(r io.Reader, backupPath string, opts backupOptions) (int, error) {
+	reader := bufio.NewReader(r)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = reader
+	}
+
+	if err := os.MkdirAll(backupPath, 0755); err != nil {
+		return 0, err
+	}
+
+	entries := make(chan *FileEntry)
+	var imported, skipped int
+	var readErr error
+	go func() {
+		defer close(entries)
+		archive := tar.NewReader(r)
+		// Regular files imported so far, without their content, for hard
+		// links to refer to
+		files := make(map[string]*FileEntry)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				readErr = fmt.Errorf("reading tar: %w", err)
+				return
+			}
+			entry, err := tarEntry(header, archive, files, opts.budget)
+			if err != nil {
+				readErr = err
+				return
+			}
+			if entry == nil {
+				// The archive's root directory is not an entry of its own
+				if header.Typeflag != tar.TypeDir {
+					skipped++
+				}
+				continue
+			}
+			if header.Typeflag == tar.TypeReg {
+				files[entry.Path] = &FileEntry{Mode: entry.Mode, ModTime: entry.ModTime, Size: entry.Size, ContentHash: entry.ContentHash}
+			}
+			entries <- entry
+			imported++
+		}
+	}()
+
+	opts.full = true
+	opts.commit = func() error { return readErr }
+	if _, err := createBackupStream(backupPath, entries, opts); err != nil {
+		return 0, err
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d tar entries that are not files, hard links, or directories", skipped)
+	}
+	log.Printf("Imported %d tar entries into %s", imported, backupPath)
+	return imported, nil
+}
+
+// tarEntry converts a tar header, and for a regular file its content, into
+// a FileEntry. A hard link becomes a reference to the content of its
+// target in files, the regular files imported before it, which the run
+// stores once. It returns nil for entries that are skipped.
+func tarEntry(header *tar.Header, content io.Reader, files map[string]*FileEntry, budget *byteBudget) (*FileEntry, error) {
+	relPath, err := tarPath(header.Name)
+	if err != nil {
+		return nil, err
+	}
+	if relPath == "." {
+		return nil, nil
+	}
+	info := header.FileInfo()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return &FileEntry{Path: relPath, Mode: info.Mode(), ModTime: header.ModTime}, nil
+	case tar.TypeReg:
+		budget.acquire(header.Size)
+		data, err := io.ReadAll(content)
+		if err != nil {
+			budget.release(header.Size)
+			return nil, fmt.Errorf("reading %s from tar: %w", relPath, err)
+		}
+		return &FileEntry{
+			Path:        relPath,
+			Mode:        info.Mode(),
+			ModTime:     header.ModTime,
+			Size:        int64(len(data)),
+			Content:     data,
+			ContentHash: hashContent(data),
+		}, nil
+	case tar.TypeSymlink:
+		return nil, fmt.Errorf("tar entry %s is a symbolic link to %s, which backups cannot store; recreate the archive with links followed (tar --dereference) to import the files they point to", relPath, header.Linkname)
+	case tar.TypeLink:
+		// Tar stores a hard link's target as a member name, like any other
+		targetPath, err := tarPath(header.Linkname)
+		if err != nil {
+			return nil, err
+		}
+		target, ok := files[targetPath]
+		if !ok {
+			log.Printf("Warning: skipping %s: hard link target %s is not a file earlier in the archive", relPath, targetPath)
+			return nil, nil
+		}
+		// Both names are the same file, so the target's metadata applies
+		entry := &FileEntry{Path: relPath, Mode: target.Mode, ModTime: target.ModTime, Size: target.Size}
+		if target.Size > 0 {
+			// The stream releases budget for every entry's Size
+			budget.acquire(target.Size)
+			entry.ContentRef = target.ContentHash
+		}
+		return entry, nil
+	default:
+		log.Printf("Warning: skipping %s: tar entry type %q is not backed up", relPath, header.Typeflag)
+		return nil, nil
+	}
+}
+
+// tarPath turns a tar member name into a backup path, rejecting names that
+// would escape the archive root.
+func tarPath(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimLeft(name, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("tar entry %s is outside the archive root", name)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type tarMember struct {
+	header  tar.Header
+	content string
+}
+
+func writeTar(t *testing.T, members []tarMember) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range members {
+		header := m.header
+		header.Size = int64(len(m.content))
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(m.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportTar(t *testing.T) {
+	modTime := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	members := []tarMember{
+		{header: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime}},
+		{header: tar.Header{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: modTime}},
+		{header: tar.Header{Name: "./etc/app.conf", Typeflag: tar.TypeReg, Mode: 0600, ModTime: modTime}, content: "key=value\n"},
+		{header: tar.Header{Name: "./bin/run.sh", Typeflag: tar.TypeReg, Mode: 0755, ModTime: modTime}, content: "#!/bin/sh\n"},
+		{header: tar.Header{Name: "./empty/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime}},
+	}
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	n, err := importTar(bytes.NewReader(writeTar(t, members)), tmpBackup, backupOptions{})
+	if err != nil {
+		t.Fatalf("importTar() error = %v", err)
+	}
+	if n != 4 {
+		t.Errorf("imported %d entries, want 4", n)
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	for _, m := range members {
+		name := strings.TrimPrefix(m.header.Name, "./")
+		if name == "" {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(tmpRestore, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got := info.Mode().Perm(); got != os.FileMode(m.header.Mode) {
+			t.Errorf("%s: mode %o, want %o", name, got, m.header.Mode)
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("%s: modtime %v, want %v", name, info.ModTime(), modTime)
+		}
+		if m.header.Typeflag == tar.TypeReg {
+			got, _ := os.ReadFile(filepath.Join(tmpRestore, name))
+			if string(got) != m.content {
+				t.Errorf("%s: content %q, want %q", name, got, m.content)
+			}
+		}
+	}
+}
+
+func TestImportTar_Gzipped(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(writeTar(t, []tarMember{
+		{header: tar.Header{Name: "notes.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: "hello"},
+	}))
+	gz.Close()
+
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	if _, err := importTar(&buf, tmpBackup, backupOptions{}); err != nil {
+		t.Fatalf("importTar() error = %v", err)
+	}
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(tmpRestore, "notes.txt")); string(got) != "hello" {
+		t.Errorf("restored %q, want %q", got, "hello")
+	}
+}
+
+func TestImportTar_RejectsEscapingPaths(t *testing.T) {
+	tmpBackup := t.TempDir()
+	archive := writeTar(t, []tarMember{
+		{header: tar.Header{Name: "ok.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: "ok"},
+		{header: tar.Header{Name: "../evil.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: "evil"},
+	})
+
+	if _, err := importTar(bytes.NewReader(archive), tmpBackup, backupOptions{}); err == nil {
+		t.Fatal("expected an error for a path outside the archive root")
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat")); len(files) != 0 {
+		t.Errorf("expected the failed import to leave no chunks, got %v", files)
+	}
+}
+
+func TestImportTar_Links(t *testing.T) {
+	modTime := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	members := []tarMember{
+		{header: tar.Header{Name: "data/original.bin", Typeflag: tar.TypeReg, Mode: 0640, ModTime: modTime}, content: "linked content"},
+		{header: tar.Header{Name: "data/hardlink.bin", Typeflag: tar.TypeLink, Linkname: "data/original.bin"}},
+		{header: tar.Header{Name: "data/empty", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modTime}},
+		{header: tar.Header{Name: "data/empty-link", Typeflag: tar.TypeLink, Linkname: "./data/empty"}},
+		{header: tar.Header{Name: "data/dangling", Typeflag: tar.TypeLink, Linkname: "data/not-in-archive"}},
+	}
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	n, err := importTar(bytes.NewReader(writeTar(t, members)), tmpBackup, backupOptions{budget: newByteBudget(1 << 20)})
+	if err != nil {
+		t.Fatalf("importTar() error = %v", err)
+	}
+	if n != 4 {
+		t.Errorf("imported %d entries, want 4", n)
+	}
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+
+	links := []struct{ name, target, content string }{
+		{"hardlink.bin", "original.bin", "linked content"},
+		{"empty-link", "empty", ""},
+	}
+	for _, link := range links {
+		path := filepath.Join(tmpRestore, "data", link.name)
+		got, err := os.ReadFile(path)
+		if err != nil || string(got) != link.content {
+			t.Errorf("%s: content %q (%v), want the linked file's %q", link.name, got, err, link.content)
+			continue
+		}
+		info, _ := os.Stat(path)
+		target, _ := os.Stat(filepath.Join(tmpRestore, "data", link.target))
+		if info.Mode() != target.Mode() || !info.ModTime().Equal(modTime) {
+			t.Errorf("%s: mode %v modtime %v, want the linked file's %v %v", link.name, info.Mode(), info.ModTime(), target.Mode(), modTime)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(tmpRestore, "data", "dangling")); !os.IsNotExist(err) {
+		t.Errorf("expected the dangling hard link skipped, got %v", err)
+	}
+}
+
+func TestImportTar_RejectsSymlinks(t *testing.T) {
+	members := []tarMember{
+		{header: tar.Header{Name: "data/original.bin", Typeflag: tar.TypeReg, Mode: 0644}, content: "content"},
+		{header: tar.Header{Name: "data/symlink", Typeflag: tar.TypeSymlink, Linkname: "original.bin", Mode: 0777}},
+	}
+	tmpBackup := t.TempDir()
+
+	_, err := importTar(bytes.NewReader(writeTar(t, members)), tmpBackup, backupOptions{})
+	if err == nil || !strings.Contains(err.Error(), "data/symlink is a symbolic link") {
+		t.Fatalf("expected the import to fail on the symlink, got %v", err)
+	}
+	if files, _ := chunkFiles(tmpBackup); len(files) != 0 {
+		t.Errorf("expected a failed import to leave no chunks, found %v", files)
+	}
+}
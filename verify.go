@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+)
+
+type verifyResult struct {
+	checked       int
+	repaired      []string
+	unrecoverable []string
+}
+
+// verifyBackup reads every chunk in backupPath, checking its checksum. When
+// mirrorPath is set, a corrupt chunk is replaced by the mirror's copy of the
+// same chunk if that copy is valid. Without a mirror nothing is written.
+func verifyBackup(backupPath, mirrorPath string) (verifyResult, error) {
+	files, err := listChunks(backupPath)
+	if err != nil {
+		return verifyResult{}, err
+	}
+	return verifyChunks(files, mirrorPath)
+}
+
+// verifySample checks n chunks of backupPath picked at random, or all of
+// them if there are fewer, so a long-running watch can spread the cost of
+// a full verify over many intervals. A backup with no chunks yet passes.
+func verifySample(backupPath, mirrorPath string, n int) (verifyResult, error) {
+	files, err := chunkFiles(backupPath)
+	if err != nil {
+		return verifyResult{}, err
+	}
+	if len(files) > n {
+		rand.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+		files = files[:n]
+	}
+	return verifyChunks(files, mirrorPath)
+}
+
+func verifyChunks(files []string, mirrorPath string) (verifyResult, error) {
+	var result verifyResult
+	for _, chunkFile := range files {
+		result.checked++
+		_, err := readChunk(chunkFile)
+		if err == nil {
+			continue
+		}
+		name := filepath.Base(chunkFile)
+		log.Printf("Chunk %s is corrupt: %v", name, err)
+
+		if mirrorPath == "" {
+			result.unrecoverable = append(result.unrecoverable, name)
+			continue
+		}
+		if err := repairChunk(chunkFile, filepath.Join(mirrorPath, name)); err != nil {
+			log.Printf("Could not repair %s from mirror: %v", name, err)
+			result.unrecoverable = append(result.unrecoverable, name)
+			continue
+		}
+		result.repaired = append(result.repaired, name)
+	}
+
+	if len(result.unrecoverable) > 0 {
+		return result, fmt.Errorf("%d of %d chunks are corrupt and could not be repaired",
+			len(result.unrecoverable), result.checked)
+	}
+	return result, nil
+}
+
+// repairChunk replaces chunkFile with mirrorFile, which must itself be a
+// valid chunk.
+func repairChunk(chunkFile, mirrorFile string) error {
+	if _, err := readChunk(mirrorFile); err != nil {
+		return fmt.Errorf("mirror copy is also unreadable: %w", err)
+	}
+
+	src, err := os.Open(chunkPath(mirrorFile))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := chunkFile + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, chunkFile)
+}
+
+func printVerify(w io.Writer, result verifyResult) {
+	for _, name := range result.repaired {
+		fmt.Fprintf(w, "repaired       %s\n", name)
+	}
+	for _, name := range result.unrecoverable {
+		fmt.Fprintf(w, "unrecoverable  %s\n", name)
+	}
+	fmt.Fprintf(w, "%d chunks checked, %d repaired, %d unrecoverable\n",
+		result.checked, len(result.repaired), len(result.unrecoverable))
+}
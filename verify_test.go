@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeMirroredBackup(t *testing.T) (primary, mirror string) {
+	t.Helper()
+	primary, mirror = t.TempDir(), t.TempDir()
+	for i, content := range []string{"one", "two"} {
+		chunk := Chunk{Entries: []*FileEntry{{Path: "f.txt", Mode: 0644, Content: []byte(content)}}, Final: true}
+		for _, dir := range []string{primary, mirror} {
+			if err := writeChunk(dir, int64(1000*(i+1)), 0, chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return primary, mirror
+}
+
+// corruptChunk flips a byte in the middle of a chunk file.
+func corruptChunk(t *testing.T, filename string) {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyBackup_RepairsFromMirror(t *testing.T) {
+	primary, mirror := writeMirroredBackup(t)
+	corruptChunk(t, filepath.Join(primary, "chunk_2000_000.dat"))
+
+	result, err := verifyBackup(primary, mirror)
+	if err != nil {
+		t.Fatalf("verifyBackup() error = %v", err)
+	}
+	if !reflect.DeepEqual(result.repaired, []string{"chunk_2000_000.dat"}) {
+		t.Errorf("expected chunk_2000_000.dat to be repaired, got %v", result.repaired)
+	}
+
+	repaired, _ := os.ReadFile(filepath.Join(primary, "chunk_2000_000.dat"))
+	original, _ := os.ReadFile(filepath.Join(mirror, "chunk_2000_000.dat"))
+	if !bytes.Equal(repaired, original) {
+		t.Error("repaired chunk does not match the mirror copy")
+	}
+
+	tmpRestore := t.TempDir()
+	if err := restore(primary, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(tmpRestore, "f.txt")); string(content) != "two" {
+		t.Errorf("expected restore to see the repaired run, got %q", content)
+	}
+}
+
+func TestVerifyBackup_CorruptInBoth(t *testing.T) {
+	primary, mirror := writeMirroredBackup(t)
+	corruptChunk(t, filepath.Join(primary, "chunk_1000_000.dat"))
+	corruptChunk(t, filepath.Join(mirror, "chunk_1000_000.dat"))
+
+	result, err := verifyBackup(primary, mirror)
+	if err == nil {
+		t.Fatal("expected an error when a chunk cannot be repaired")
+	}
+	if !reflect.DeepEqual(result.unrecoverable, []string{"chunk_1000_000.dat"}) || len(result.repaired) != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	var out bytes.Buffer
+	printVerify(&out, result)
+	if want := "2 chunks checked, 0 repaired, 1 unrecoverable\n"; !bytes.HasSuffix(out.Bytes(), []byte(want)) {
+		t.Errorf("unexpected summary:\n%s", out.String())
+	}
+}
+
+func TestVerifyBackup_WithoutMirrorDoesNotWrite(t *testing.T) {
+	primary, _ := writeMirroredBackup(t)
+	corruptChunk(t, filepath.Join(primary, "chunk_1000_000.dat"))
+	before := backupDirState(t, primary)
+
+	result, err := verifyBackup(primary, "")
+	if err == nil || len(result.unrecoverable) != 1 {
+		t.Errorf("expected one unrecoverable chunk, got %+v (%v)", result, err)
+	}
+	if after := backupDirState(t, primary); !reflect.DeepEqual(before, after) {
+		t.Error("verify without a mirror changed the backup directory")
+	}
+}
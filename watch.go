@@ -1,126 +1,1048 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"maps"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
-func watch(watchPath string, backupPath string, refresh int) error {
-	if err := os.MkdirAll(backupPath, 0755); err != nil {
+type watchOptions struct {
+	watchPath    string
+	backupPath   string
+	refresh      time.Duration
+	snapshotFile string
+	fullEvery    int
+	maxChunks    int
+	// preHook runs before each scan and aborts the run if it fails; postHook
+	// runs after every run the pre-hook allowed, even a failed one.
+	preHook     string
+	postHook    string
+	hookTimeout time.Duration
+	scan        scanOptions
+	budget      *byteBudget
+	format      chunkFormat
+	// manifestDir, when set, receives a checksum manifest of the files
+	// stored by each run.
+	manifestDir string
+	// idleFor defers a run while anything in the tree was modified more
+	// recently than this. 0 always backs up.
+	idleFor time.Duration
+	// verifySnapshot checks the loaded snapshot against the backup's chunks
+	// at startup and rebuilds it if they disagree.
+	verifySnapshot bool
+	// contentAddressed names chunks by their hash; see index.go.
+	contentAddressed bool
+	// hashCacheFile, when set, persists hashes between processes so the
+	// first scan after a restart does not reread unchanged files.
+	hashCacheFile string
+	// health, when set, is told the outcome of every watch run.
+	health *healthState
+	// replicas receive a copy of every chunk; writePolicy decides how many
+	// destinations must take each one.
+	replicas    []string
+	writePolicy writePolicy
+	// jitter shifts each wait between runs by a random amount of up to
+	// this much either way. 0 keeps the exact interval.
+	jitter time.Duration
+	// deletionLog, when set, is appended a line for every deletion each
+	// run records.
+	deletionLog string
+	// maxBackoff caps how far the wait after consecutive failed runs grows
+	// from refresh.
+	maxBackoff time.Duration
+	// fsync is how chunk writes are flushed to disk.
+	fsync fsyncMode
+	// verifySample, when above 0, checks that many random chunks of the
+	// backup after every run; corrupt ones are repaired from verifyMirror
+	// if it is set.
+	verifySample int
+	verifyMirror string
+	// entriesPerChunk caps the entries in each chunk; 0 is unlimited.
+	entriesPerChunk int
+	// source labels the runs; empty uses the absolute watchPath.
+	source string
+}
+
+// sourceLabel is the label recorded with each run: opts.source, or the
+// absolute watch path. Backups of one tree from different mount points
+// need an explicit label to match.
+func (opts watchOptions) sourceLabel() string {
+	if opts.source != "" {
+		return opts.source
+	}
+	if abs, err := filepath.Abs(opts.watchPath); err == nil {
+		return abs
+	}
+	return opts.watchPath
+}
+
+// errBackupDeferred is returned by runBackup when --backup-if-idle finds the
+// tree still changing. It is not a failure.
+var errBackupDeferred = errors.New("tree is still changing, backup deferred")
+
+func watch(ctx context.Context, opts watchOptions) error {
+	snapshot, err := prepareBackup(&opts)
+	if err != nil {
 		return err
 	}
-	log.Printf("Watching %s, backing up to %s every %d seconds\n",
-		watchPath, backupPath, refresh)
 
-	snapshot := make(map[string]string)
+	log.Printf("Watching %s, backing up to %s every %s\n",
+		opts.watchPath, opts.backupPath, opts.refresh)
 
+	runs, failed, consecutive := 0, 0, 0
 	for {
-		changes, err := detectChanges(watchPath, snapshot)
-		if err != nil {
-			log.Printf("Error detecting changes: %v", err)
+		runs++
+		if _, err := runBackup(opts, snapshot); errors.Is(err, errBackupDeferred) {
+			log.Println("Tree is still changing, deferring backup to the next interval")
+			// The daemon is working, only waiting for the tree to settle
+			opts.health.record(nil)
+			consecutive = 0
+		} else if err != nil {
+			log.Printf("Backup error: %v", err)
+			failed++
+			consecutive++
+			opts.health.record(err)
+		} else {
+			consecutive = 0
+			opts.health.record(nil)
+			// A confirmation covers the run it was given for, not every
+			// mass deletion after it
+			opts.scan.confirmMassDelete = false
 		}
 
-		if len(changes) > 0 {
-			log.Printf("Detected %d changes, creating backup...", len(changes))
-			if err := createBackup(backupPath, changes); err != nil {
-				log.Printf("Backup error: %v", err)
-			} else {
-				log.Println("Backup completed")
+		if opts.verifySample > 0 {
+			sampleBackup(opts)
+		}
+
+		wait := errorBackoff(opts.refresh, consecutive, opts.maxBackoff)
+		if wait > opts.refresh {
+			log.Printf("%d consecutive backups failed, waiting %s before the next scan", consecutive, wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			switch {
+			case failed == 0:
+				return nil
+			case failed == runs:
+				return fmt.Errorf("all %d backup runs failed", runs)
+			default:
+				return &partialError{fmt.Sprintf("%d of %d backup runs failed", failed, runs)}
 			}
+		case <-waitFor(jitteredInterval(wait, opts.jitter)):
 		}
+	}
+}
+
+// sampleBackup verifies a random sample of the backup's chunks. Corruption
+// is only logged: the run that found it did nothing wrong, and a later
+// sample or a full verify will find it again until it is repaired.
+func sampleBackup(opts watchOptions) {
+	result, err := verifySample(opts.backupPath, opts.verifyMirror, opts.verifySample)
+	for _, name := range result.repaired {
+		log.Printf("Repaired corrupt chunk %s from %s", name, opts.verifyMirror)
+	}
+	if err != nil {
+		log.Printf("ERROR: backup integrity check failed: %v; run --verify on %s", err, opts.backupPath)
+	}
+}
 
-		time.Sleep(time.Duration(refresh) * time.Second)
+// waitFor is swapped out by tests to record the watch loop's waits.
+var waitFor = time.After
+
+// errorBackoff returns how long the watch loop waits after failures
+// consecutive failed runs: the refresh interval, doubled for each failure
+// up to maxBackoff. A maxBackoff no longer than refresh disables it.
+func errorBackoff(refresh time.Duration, failures int, maxBackoff time.Duration) time.Duration {
+	wait := refresh
+	for range failures {
+		if wait >= maxBackoff {
+			break
+		}
+		wait *= 2
 	}
+	return max(min(wait, maxBackoff), refresh)
+}
 
+// jitteredInterval shifts base by a random offset of up to jitter either
+// way, never below zero, so daemons started together drift apart.
+func jitteredInterval(base, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return base
+	}
+	offset := time.Duration(rand.Int64N(int64(2*jitter)+1)) - jitter
+	return max(base+offset, 0)
 }
 
-func detectChanges(watchPath string, snapshot map[string]string) ([]*FileEntry, error) {
-	current := make(map[string]string)
-	var changes []*FileEntry
+func backupOnce(opts watchOptions) error {
+	snapshot, err := prepareBackup(&opts)
+	if err != nil {
+		return err
+	}
+
+	n, err := runBackup(opts, snapshot)
+	if errors.Is(err, errBackupDeferred) {
+		log.Println("Tree is still changing, skipping this backup")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		log.Println("No changes detected")
+	}
+	return nil
+}
+
+func prepareBackup(opts *watchOptions) (*snapshotState, error) {
+	if err := validateWatchPath(opts.watchPath); err != nil {
+		return nil, err
+	}
+	if opts.scan.skipped == nil {
+		opts.scan.skipped = make(map[string]bool)
+	}
+	if err := os.MkdirAll(opts.backupPath, 0755); err != nil {
+		return nil, err
+	}
+	if same, err := sameDevice(opts.watchPath, opts.backupPath); err == nil && same {
+		log.Printf("Note: %s is on the same device as %s, so a failure of that disk loses both", opts.backupPath, opts.watchPath)
+	}
+	for _, replica := range opts.replicas {
+		// The write policy decides whether a replica that is unavailable
+		// fails the run
+		if err := os.MkdirAll(replica, 0755); err != nil {
+			log.Printf("Warning: creating backup replica %s: %v", replica, err)
+		}
+	}
+	if opts.snapshotFile == "" {
+		opts.snapshotFile = filepath.Join(opts.backupPath, defaultSnapshotName)
+	}
+
+	snapshot, err := loadSnapshot(opts.snapshotFile, opts.watchPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading snapshot %s: %w", opts.snapshotFile, err)
+	}
+	if opts.verifySnapshot {
+		if err := reconcileSnapshot(snapshot, opts.backupPath); err != nil {
+			return nil, fmt.Errorf("verifying snapshot %s: %w", opts.snapshotFile, err)
+		}
+	}
+	if opts.hashCacheFile != "" {
+		opts.scan.hashCache = loadHashCache(opts.hashCacheFile)
+	}
+	return snapshot, nil
+}
 
-	err := filepath.WalkDir(watchPath, func(path string, d os.DirEntry, err error) error {
+// modifiedWithin reports whether any file or directory under watchPath was
+// modified in the last d. Creating, deleting, or renaming a file bumps its
+// directory's modtime, so every kind of change is seen.
+func modifiedWithin(watchPath string, exclude *excludeMatcher, d time.Duration) (bool, error) {
+	cutoff := time.Now().Add(-d)
+	errBusy := errors.New("busy")
+	err := filepath.WalkDir(watchPath, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return vanished(path, err)
+		}
+		relPath, err := filepath.Rel(watchPath, path)
 		if err != nil {
 			return err
 		}
-		if d.IsDir() {
+		if relPath = filepath.ToSlash(relPath); relPath != "." && exclude.excluded(relPath, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
+		info, err := entry.Info()
+		if err != nil {
+			return vanished(path, err)
+		}
+		if info.ModTime().After(cutoff) {
+			return errBusy
+		}
+		return nil
+	})
+	if err == errBusy {
+		return true, nil
+	}
+	return false, err
+}
 
-		relPath, err := filepath.Rel(watchPath, path)
+// validateWatchPath checks up front that watchPath is a readable directory,
+// so a typo fails with a clear message instead of midway through a scan.
+func validateWatchPath(watchPath string) error {
+	info, err := os.Stat(watchPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("watch path %s does not exist", watchPath)
+	}
+	if err != nil {
+		return fmt.Errorf("watch path %s: %w", watchPath, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("watch path %s is not a directory", watchPath)
+	}
+
+	dir, err := os.Open(watchPath)
+	if err == nil {
+		_, err = dir.ReadDir(1)
+		dir.Close()
+	}
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("watch path %s is not readable: %w", watchPath, err)
+	}
+	return nil
+}
+
+func runBackup(opts watchOptions, state *snapshotState) (int, error) {
+	if opts.idleFor > 0 {
+		busy, err := modifiedWithin(opts.watchPath, opts.scan.exclude, opts.idleFor)
 		if err != nil {
-			return err
+			return 0, fmt.Errorf("checking for activity: %w", err)
+		}
+		if busy {
+			return 0, errBackupDeferred
 		}
+	}
+
+	env := []string{
+		"AIKIDO_WATCH_PATH=" + opts.watchPath,
+		"AIKIDO_BACKUP_PATH=" + opts.backupPath,
+	}
+	if err := runHook(opts.preHook, opts.hookTimeout, env); err != nil {
+		return 0, fmt.Errorf("pre-backup hook failed, skipping backup: %w", err)
+	}
 
-		hash, err := hashFile(path)
+	changed, err := scanAndBackup(opts, state)
+
+	status := "ok"
+	if err != nil {
+		status = "failed"
+	}
+	if hookErr := runHook(opts.postHook, opts.hookTimeout, append(env, "AIKIDO_BACKUP_STATUS="+status)); hookErr != nil {
 		if err != nil {
-			return err
+			log.Printf("Post-backup hook failed: %v", hookErr)
+		} else {
+			err = fmt.Errorf("post-backup hook failed: %w", hookErr)
 		}
+	}
+	return changed, err
+}
 
-		current[relPath] = hash
+func scanAndBackup(opts watchOptions, state *snapshotState) (int, error) {
+	// A full run scans against an empty snapshot so every file is captured.
+	// The new snapshot only replaces the old one once the run has succeeded.
+	full := opts.fullEvery > 0 && (state.Runs+1)%opts.fullEvery == 0
+	snapshot := state.Files
+	if full {
+		snapshot = newFileSnapshot(nil)
+	}
 
-		if oldHash, exists := snapshot[relPath]; !exists || oldHash != hash {
-			info, err := d.Info()
-			if err != nil {
-				return err
+	scan := opts.scan
+	scan.budget = opts.budget
+	scan.captureDirs = true
+	if full {
+		// The empty snapshot holds nothing to count deletions against
+		scan.deletionBaseline = state.Files
+	}
+	if scan.fastScan {
+		scan.dirs = maps.Clone(state.Dirs)
+		if scan.dirs == nil {
+			scan.dirs = make(map[string]int64)
+		}
+	}
+
+	lagging := maps.Clone(state.Lagging)
+	if lagging == nil {
+		lagging = make(map[string][]int64)
+	}
+
+	entries := make(chan *FileEntry)
+	var changed int
+	var scanErr error
+	go func() {
+		changed, scanErr = scanTree(opts.watchPath, snapshot, scan, entries)
+		close(entries)
+	}()
+
+	// The manifest and deletion log are collected as entries pass to the
+	// chunk writer, before they are split or deduplicated
+	var manifest []manifestEntry
+	var deletions []string
+	stream := entries
+	if opts.manifestDir != "" || opts.deletionLog != "" {
+		stream = make(chan *FileEntry)
+		go func(out chan<- *FileEntry) {
+			for entry := range entries {
+				if record, ok := manifestRecord(entry); ok && opts.manifestDir != "" {
+					manifest = append(manifest, record)
+				}
+				if path, ok := deletionPath(entry); ok && opts.deletionLog != "" {
+					deletions = append(deletions, path)
+				}
+				out <- entry
 			}
+			close(out)
+		}(stream)
+	}
 
-			content, err := os.ReadFile(path)
-			if err != nil {
-				return err
+	timestamp, err := createBackupStream(opts.backupPath, stream, backupOptions{
+		full:             full,
+		budget:           opts.budget,
+		commit:           func() error { return scanErr },
+		maxChunks:        opts.maxChunks,
+		maxEntries:       opts.entriesPerChunk,
+		source:           opts.sourceLabel(),
+		format:           opts.format,
+		contentAddressed: opts.contentAddressed,
+		replicas:         opts.replicas,
+		policy:           opts.writePolicy,
+		fsync:            opts.fsync,
+		lagging:          lagging,
+	})
+	if scanErr != nil {
+		return 0, fmt.Errorf("detecting changes: %w", scanErr)
+	}
+	if err := scan.hashCache.save(); err != nil {
+		log.Printf("Warning: could not save hash cache: %v", err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if changed == 0 && !full {
+		// A catch-up still has to be recorded, or the next run repeats it
+		if !maps.EqualFunc(lagging, state.Lagging, slices.Equal[[]int64]) {
+			state.Lagging = lagging
+			if err := saveSnapshot(opts.snapshotFile, state); err != nil {
+				return 0, fmt.Errorf("saving snapshot: %w", err)
 			}
-			changes = append(changes, &FileEntry{
-				Path:    relPath,
-				Mode:    info.Mode(),
-				ModTime: info.ModTime(),
-				Size:    info.Size(),
-				Content: content,
-				Deleted: false,
-			})
 		}
+		return 0, nil
+	}
+
+	if opts.manifestDir != "" && timestamp != 0 {
+		if _, err := writeManifest(opts.manifestDir, timestamp, manifest); err != nil {
+			return 0, fmt.Errorf("writing checksum manifest: %w", err)
+		}
+	}
+
+	// The log is only for auditing, so failing to write it does not fail
+	// the run
+	if err := appendDeletionLog(opts.deletionLog, timestamp, deletions); err != nil {
+		log.Printf("Warning: could not append %d deletions to %s: %v", len(deletions), opts.deletionLog, err)
+	}
+
+	if full {
+		log.Printf("Full backup of %d files completed", changed)
+	} else {
+		log.Printf("Backup of %d changes completed", changed)
+	}
 
+	state.Files = snapshot
+	state.Dirs = scan.dirs
+	state.Runs++
+	state.Lagging = lagging
+	if err := saveSnapshot(opts.snapshotFile, state); err != nil {
+		return changed, fmt.Errorf("saving snapshot: %w", err)
+	}
+	return changed, nil
+}
+
+type scanOptions struct {
+	exclude *excludeMatcher
+	// budget, when set, is acquired for each file's size before its content
+	// is read, bounding how much content the scan holds at once.
+	budget *byteBudget
+	// fastScan trusts directory modtimes: files in a directory whose modtime
+	// matches dirs are taken from the snapshot without being read. In-place
+	// edits do not bump a directory's modtime, so this can miss them.
+	fastScan bool
+	dirs     map[string]int64
+	// captureDirs also reports directories whose mode or modtime changed,
+	// so restore can reapply them.
+	captureDirs bool
+	// Unreadable files and directories are skipped, keeping their last
+	// backed-up state, unless failOnSkip is set. skipped carries the set
+	// between scans so each is only logged when it first becomes unreadable.
+	failOnSkip bool
+	skipped    map[string]bool
+	// growing picks how a file whose size changed while it was read is
+	// stored: growingPrefix or growingRetry. Empty stores the read as is.
+	growing string
+	// Files modified longer ago than excludeOlderThan, or more recently than
+	// excludeNewerThan, are skipped but keep their last backed-up state.
+	// 0 disables either bound.
+	excludeOlderThan time.Duration
+	excludeNewerThan time.Duration
+	// metadataOnly hashes files without storing their content, recording
+	// only what describes them.
+	metadataOnly bool
+	// hashCache, when set, supplies hashes of files unchanged in size and
+	// modtime since they were last hashed, across restarts.
+	hashCache *hashCache
+	// maxDuration aborts a scan that runs longer than this, discarding what
+	// it found so far. 0 lets scans run to completion.
+	maxDuration time.Duration
+	// noDelete never records deletions: paths that vanish stay in the
+	// snapshot, and so in the backup's live set, as they were last seen.
+	noDelete bool
+	// maxDeleteRatio fails a scan that would record more than this
+	// fraction of the tracked files as deleted, unless confirmMassDelete
+	// is set. 0 disables the check. deletionBaseline is what deletions are
+	// counted against when it is not the snapshot scanned against, as for
+	// a full run.
+	maxDeleteRatio    float64
+	confirmMassDelete bool
+	deletionBaseline  *fileSnapshot
+	// walkers, when above 1, walks that many top-level directories of the
+	// tree at once.
+	walkers int
+	// hashBufferSize is the read size for hashing files. 0 uses
+	// defaultHashBufferSize.
+	hashBufferSize int
+}
+
+// errMassDeletion is returned by a scan blocked by --max-delete-ratio.
+var errMassDeletion = errors.New("mass deletion blocked")
+
+// checkMassDeletion returns errMassDeletion if more than
+// opts.maxDeleteRatio of the files in previous are missing from current.
+func checkMassDeletion(previous, current map[string]string, opts scanOptions) error {
+	if opts.maxDeleteRatio <= 0 || opts.confirmMassDelete || opts.noDelete {
 		return nil
-	})
+	}
+	tracked, deleted := 0, 0
+	for path, hash := range previous {
+		if strings.HasPrefix(hash, dirSnapshotPrefix) {
+			continue
+		}
+		tracked++
+		if _, ok := current[path]; !ok {
+			deleted++
+		}
+	}
+	if tracked == 0 || float64(deleted)/float64(tracked) <= opts.maxDeleteRatio {
+		return nil
+	}
+	return fmt.Errorf("%w: %d of %d tracked files (%.0f%%) are gone, over --max-delete-ratio %g; nothing was backed up. "+
+		"Check the watched tree, and rerun with --confirm-mass-delete if the deletions are intended",
+		errMassDeletion, deleted, tracked, 100*float64(deleted)/float64(tracked), opts.maxDeleteRatio)
+}
+
+// scanTree is swapped out by tests to simulate failing scans.
+var scanTree = scanChanges
+
+// errScanTimeout is returned by a scan that ran past scanOptions.maxDuration.
+var errScanTimeout = errors.New("scan exceeded --max-scan-duration")
+
+// outsideAgeWindow reports whether a file last modified at modTime is
+// skipped by excludeOlderThan or excludeNewerThan.
+func (o scanOptions) outsideAgeWindow(modTime time.Time) bool {
+	age := time.Since(modTime)
+	return (o.excludeOlderThan > 0 && age > o.excludeOlderThan) ||
+		(o.excludeNewerThan > 0 && age < o.excludeNewerThan)
+}
+
+const (
+	growingPrefix = "prefix"
+	growingRetry  = "retry"
+	// growingRetries bounds how often growingRetry rereads a file before
+	// settling for a prefix.
+	growingRetries = 3
+)
+
+// Directories modified this recently are not trusted by the fast scan, since
+// a file added within the filesystem's timestamp granularity could leave the
+// modtime unchanged.
+const fastScanSettle = 2 * time.Second
+
+func detectChanges(watchPath string, snapshot *fileSnapshot, opts scanOptions) ([]*FileEntry, error) {
+	entries := make(chan *FileEntry)
+	var changes []*FileEntry
+	done := make(chan struct{})
+	go func() {
+		for entry := range entries {
+			changes = append(changes, entry)
+		}
+		close(done)
+	}()
+
+	_, err := scanChanges(watchPath, snapshot, opts, entries)
+	close(entries)
+	<-done
 
 	if err != nil {
 		return nil, err
 	}
+	return changes, nil
+}
+
+// scanChanges walks watchPath and sends each new, modified, or deleted file
+// to out as it is found, returning how many changes were sent. snapshot is
+// only updated once the walk has completed successfully, as is opts.dirs.
+// The scan compares against a copy of snapshot taken when it starts, and its
+// result replaces the snapshot's entries when it ends.
+func scanChanges(watchPath string, files *fileSnapshot, opts scanOptions, out chan<- *FileEntry) (int, error) {
+	snapshot := files.clone()
+	ctx := context.Background()
+	if opts.maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.maxDuration,
+			fmt.Errorf("%w of %s; discarding the partial scan", errScanTimeout, opts.maxDuration))
+		defer cancel()
+	}
+	w := newTreeWalk(ctx, watchPath, snapshot, opts, out, newIgnoreFiles(opts.exclude != nil && opts.exclude.ignoreCase))
+	if err := w.walk(); err != nil {
+		return 0, err
+	}
+	current, changed, dirs, skipped := w.current, w.changed, w.dirs, w.skipped
 
-	for oldPath := range snapshot {
+	// Files under an unreadable directory keep their last backed-up state
+	for _, dir := range w.skippedDirs {
+		for oldPath, hash := range snapshot {
+			if strings.HasPrefix(oldPath, dir) {
+				current[oldPath] = hash
+			}
+		}
+	}
+	if len(skipped) > 0 {
+		log.Printf("Skipped %d unreadable paths", len(skipped))
+	}
+	if opts.skipped != nil {
+		clear(opts.skipped)
+		maps.Copy(opts.skipped, skipped)
+	}
+
+	// Checked before any deletion is sent, so a blocked run leaves the
+	// snapshot as it was and the next scan sees the same deletions
+	baseline := snapshot
+	if opts.deletionBaseline != nil {
+		baseline = opts.deletionBaseline.clone()
+	}
+	if err := checkMassDeletion(baseline, current, opts); err != nil {
+		return 0, err
+	}
+
+	// Deletions are sent in path order, after the walk's own lexical order,
+	// so identical trees always produce identical runs
+	for _, oldPath := range slices.Sorted(maps.Keys(snapshot)) {
 		if _, exists := current[oldPath]; !exists {
-			changes = append(changes, &FileEntry{
+			if opts.noDelete {
+				current[oldPath] = snapshot[oldPath]
+				continue
+			}
+			entry := &FileEntry{
 				Path:    oldPath,
 				Deleted: true,
-			})
+			}
+			if strings.HasPrefix(snapshot[oldPath], dirSnapshotPrefix) {
+				entry.Mode = os.ModeDir
+			}
+			out <- entry
+			changed++
 		}
 	}
 
-	maps.Copy(snapshot, current)
-	for oldPath := range snapshot {
-		if _, exists := current[oldPath]; !exists {
-			delete(snapshot, oldPath)
+	files.replace(current)
+	opts.hashCache.retain(current)
+	if opts.dirs != nil {
+		clear(opts.dirs)
+		maps.Copy(opts.dirs, dirs)
+	}
+
+	return changed, nil
+}
+
+// treeWalk holds the state of a walk over the tree, or over one top-level
+// directory of it when the walk is parallel.
+type treeWalk struct {
+	ctx       context.Context
+	watchPath string
+	snapshot  map[string]string
+	opts      scanOptions
+	out       chan<- *FileEntry
+
+	current       map[string]string
+	changed       int
+	dirs          map[string]int64
+	unchangedDirs map[string]bool
+	hashBuf       []byte
+	skipped       map[string]bool
+	skippedDirs   []string
+	ignores       *ignoreFiles
+}
+
+func newTreeWalk(ctx context.Context, watchPath string, snapshot map[string]string, opts scanOptions, out chan<- *FileEntry, ignores *ignoreFiles) *treeWalk {
+	return &treeWalk{
+		ctx:           ctx,
+		watchPath:     watchPath,
+		snapshot:      snapshot,
+		opts:          opts,
+		out:           out,
+		current:       make(map[string]string),
+		dirs:          make(map[string]int64),
+		unchangedDirs: make(map[string]bool),
+		hashBuf:       make([]byte, cmp.Or(opts.hashBufferSize, defaultHashBufferSize)),
+		skipped:       make(map[string]bool),
+		ignores:       ignores,
+	}
+}
+
+// walk visits the whole tree. With opts.walkers above 1, each top-level
+// directory is handed to one of that many goroutines, each with a walk of
+// its own, and their results are merged into w once all are done. The
+// first error stops every walk.
+func (w *treeWalk) walk() error {
+	if w.opts.walkers <= 1 {
+		return filepath.WalkDir(w.watchPath, w.visit)
+	}
+
+	ctx, cancel := context.WithCancelCause(w.ctx)
+	defer cancel(nil)
+	w.ctx = ctx
+
+	type subtree struct {
+		path    string
+		ignores *ignoreFiles
+	}
+	subtrees := make(chan subtree)
+	walks := make([]*treeWalk, w.opts.walkers)
+	var wg sync.WaitGroup
+	for i := range walks {
+		walks[i] = newTreeWalk(ctx, w.watchPath, w.snapshot, w.opts, w.out, nil)
+		wg.Go(func() {
+			sub := walks[i]
+			for tree := range subtrees {
+				if ctx.Err() != nil {
+					continue
+				}
+				sub.ignores = tree.ignores
+				if err := filepath.WalkDir(tree.path, sub.visit); err != nil {
+					cancel(err)
+				}
+			}
+		})
+	}
+
+	root := filepath.Clean(w.watchPath)
+	err := filepath.WalkDir(w.watchPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == w.watchPath || filepath.Dir(path) != root {
+			return w.visit(path, d, err)
+		}
+		// The root's rules are loaded by now, since the root is visited
+		// before anything in it
+		select {
+		case subtrees <- subtree{path, w.ignores.clone()}:
+		case <-ctx.Done():
+			return context.Cause(ctx)
 		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		cancel(err)
+	}
+	close(subtrees)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
 	}
 
-	return changes, nil
+	for _, sub := range walks {
+		maps.Copy(w.current, sub.current)
+		maps.Copy(w.dirs, sub.dirs)
+		maps.Copy(w.skipped, sub.skipped)
+		w.skippedDirs = append(w.skippedDirs, sub.skippedDirs...)
+		w.changed += sub.changed
+	}
+	return nil
+}
+
+// unreadable skips a path the scan may not read, keeping whatever the
+// snapshot had for it so it is not recorded as deleted.
+func (w *treeWalk) unreadable(relPath string, isDir bool, err error) error {
+	if !errors.Is(err, fs.ErrPermission) || w.opts.failOnSkip {
+		return vanished(relPath, err)
+	}
+	if !w.opts.skipped[relPath] {
+		log.Printf("Warning: skipping unreadable %s: %v", relPath, err)
+	}
+	w.skipped[relPath] = true
+	if isDir {
+		w.skippedDirs = append(w.skippedDirs, relPath+"/")
+	}
+	if hash, ok := w.snapshot[relPath]; ok {
+		w.current[relPath] = hash
+	}
+	return nil
+}
+
+func (w *treeWalk) visit(path string, d os.DirEntry, err error) error {
+	// A truncated walk would look like deletions of everything it did
+	// not reach, so the whole scan is abandoned
+	if w.ctx.Err() != nil {
+		return context.Cause(w.ctx)
+	}
+	// Stored paths always use forward slashes so backups restore on any OS
+	relPath, relErr := filepath.Rel(w.watchPath, path)
+	if relErr != nil {
+		return relErr
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	if err != nil {
+		if path == w.watchPath {
+			return err
+		}
+		// WalkDir only reports errors for directories it cannot read
+		return w.unreadable(relPath, true, err)
+	}
+	if relPath != "." && w.ignores.excluded(w.opts.exclude, relPath, d.IsDir()) {
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	if d.IsDir() {
+		// A directory whose ignore rules cannot be read is skipped
+		// rather than backed up without them
+		if err := w.ignores.load(path, relPath); errors.Is(err, fs.ErrPermission) && relPath != "." {
+			if err := w.unreadable(relPath, true, err); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if !w.opts.fastScan && (!w.opts.captureDirs || relPath == ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return vanished(relPath, err)
+		}
+		if w.opts.captureDirs && relPath != "." {
+			// Directories are tracked in the snapshot by mode and modtime
+			value := dirSnapshotValue(info.Mode(), info.ModTime())
+			w.current[relPath] = value
+			if w.snapshot[relPath] != value {
+				w.out <- &FileEntry{Path: relPath, Mode: info.Mode(), ModTime: info.ModTime()}
+				w.changed++
+			}
+		}
+		if w.opts.fastScan && time.Since(info.ModTime()) >= fastScanSettle {
+			modTime := info.ModTime().UnixNano()
+			w.dirs[relPath] = modTime
+			if prev, ok := w.opts.dirs[relPath]; ok && prev == modTime {
+				w.unchangedDirs[path] = true
+			}
+		}
+		return nil
+	}
+
+	if w.unchangedDirs[filepath.Dir(path)] {
+		if hash, ok := w.snapshot[relPath]; ok {
+			w.current[relPath] = hash
+			return nil
+		}
+	}
+
+	// Files outside the age window are left as they were backed up
+	// rather than recorded as deleted
+	if w.opts.excludeOlderThan > 0 || w.opts.excludeNewerThan > 0 {
+		info, err := d.Info()
+		if err != nil {
+			return vanished(relPath, err)
+		}
+		if w.opts.outsideAgeWindow(info.ModTime()) {
+			if hash, ok := w.snapshot[relPath]; ok {
+				w.current[relPath] = hash
+			}
+			return nil
+		}
+	}
+
+	// Files already in the snapshot are stream-hashed first, since most
+	// are unchanged and their content is not needed. New files are read
+	// once and hashed from memory, unless only metadata is backed up.
+	oldHash, exists := w.snapshot[relPath]
+	var streamed string
+	if exists || w.opts.metadataOnly {
+		hash, err := w.opts.hashCache.hashFile(path, relPath, d, w.hashBuf)
+		if err != nil {
+			return w.unreadable(relPath, false, err)
+		}
+		if exists && hash == oldHash {
+			w.current[relPath] = hash
+			return nil
+		}
+		streamed = hash
+	}
+
+	info, err := d.Info()
+	if err != nil {
+		return vanished(relPath, err)
+	}
+
+	if w.opts.metadataOnly {
+		w.current[relPath] = streamed
+		w.out <- &FileEntry{
+			Path:         relPath,
+			Mode:         info.Mode(),
+			ModTime:      info.ModTime(),
+			Size:         info.Size(),
+			BirthTime:    fileBirthTime(info),
+			ContentHash:  streamed,
+			MetadataOnly: true,
+		}
+		w.changed++
+		return nil
+	}
+
+	acquired := info.Size()
+	w.opts.budget.acquire(acquired)
+	content, err := readFile(path)
+	if err == nil && int64(len(content)) != info.Size() && w.opts.growing != "" {
+		content, info, err = settleRead(path, content, info, w.opts.growing)
+	}
+	if err != nil {
+		w.opts.budget.release(acquired)
+		return w.unreadable(relPath, false, err)
+	}
+	// The chunk writer releases what the entry holds, which differs from
+	// the stat'd size if the file changed while it was read
+	if size := int64(len(content)); size != acquired {
+		w.opts.budget.release(acquired)
+		w.opts.budget.acquire(size)
+	}
+
+	// Hashing the bytes that are stored keeps the snapshot consistent with
+	// the backup even if the file changed after it was first hashed
+	hash := hashContent(content)
+	w.current[relPath] = hash
+	w.opts.hashCache.store(relPath, info, hash)
+	if exists && hash == oldHash {
+		w.opts.budget.release(int64(len(content)))
+		return nil
+	}
+
+	acl, err := readACL(path)
+	if err != nil {
+		log.Printf("Warning: could not read ACL for %s: %v", relPath, err)
+	}
+	capability, err := readCapability(path)
+	if err != nil {
+		log.Printf("Warning: could not read file capabilities for %s: %v", relPath, err)
+	}
+	w.out <- &FileEntry{
+		Path:        relPath,
+		Mode:        info.Mode(),
+		ModTime:     info.ModTime(),
+		Size:        int64(len(content)),
+		Content:     content,
+		Deleted:     false,
+		ACL:         acl,
+		Capability:  capability,
+		BirthTime:   fileBirthTime(info),
+		ContentHash: hash,
+	}
+	w.changed++
+
+	return nil
+}
+
+// settleRead turns a read that disagrees with the file's size into a
+// consistent capture. growingPrefix keeps the first info.Size() bytes, the
+// file's length at the point in time it was stat'd, which is exact for
+// append-only files such as logs. growingRetry stats and reads again until
+// both agree, then falls back to a prefix. A file that shrank cannot be cut
+// to a prefix and is kept as read.
+func settleRead(path string, content []byte, info os.FileInfo, mode string) ([]byte, os.FileInfo, error) {
+	for attempt := 0; mode == growingRetry && attempt < growingRetries; attempt++ {
+		var err error
+		if info, err = os.Stat(path); err != nil {
+			return nil, nil, err
+		}
+		if content, err = readFile(path); err != nil {
+			return nil, nil, err
+		}
+		if int64(len(content)) == info.Size() {
+			return content, info, nil
+		}
+	}
+
+	if int64(len(content)) > info.Size() {
+		log.Printf("Warning: %s grew while being read, keeping its first %d bytes", path, info.Size())
+		return content[:info.Size()], info, nil
+	}
+	log.Printf("Warning: %s shrank while being read", path)
+	return content, info, nil
+}
+
+// vanished returns nil for an error caused by a path being removed after its
+// directory was listed, so a busy tree does not abort the scan. The path is
+// left out of the new snapshot, recording a known file as deleted.
+// Permission and other errors are returned unchanged.
+func vanished(path string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Warning: %s vanished during scan", path)
+		return nil
+	}
+	return err
+}
+
+// openFile and readFile are swapped out by tests to remove files mid-scan.
+var (
+	openFile = os.Open
+	readFile = os.ReadFile
+)
+
+// Snapshot values for directories start with dirSnapshotPrefix, which
+// cannot collide with a hex content hash.
+const dirSnapshotPrefix = "dir:"
+
+func dirSnapshotValue(mode os.FileMode, modTime time.Time) string {
+	return fmt.Sprintf("%s%o:%d", dirSnapshotPrefix, mode, modTime.UnixNano())
 }
 
 func hashFile(path string) (string, error) {
-	file, err := os.Open(path)
+	return hashFileBuffer(path, nil)
+}
+
+// defaultHashBufferSize is how much of a file each read takes while it is
+// hashed, large enough that big files are not hashed a syscall at a time.
+const defaultHashBufferSize = 1024 * 1024
+
+// hashFileBuffer streams path through sha256 using buf, so the content is
+// never held in memory. A nil buf allocates one.
+func hashFileBuffer(path string, buf []byte) (string, error) {
+	file, err := openFile(path)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
 	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	// Hiding the file's WriteTo makes the copy read through buf rather
+	// than a small buffer of its own
+	if _, err := io.CopyBuffer(hash, struct{ io.Reader }{file}, buf); err != nil {
 		return "", err
 	}
 
 	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
+
+func hashContent(content []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
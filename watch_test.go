@@ -1,9 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestHashFile(t *testing.T) {
@@ -82,7 +92,7 @@ func TestHashFile_NonExistentFile(t *testing.T) {
 
 func TestDetectChanges_NewFile(t *testing.T) {
 	tmpDir := t.TempDir()
-	snapshot := make(map[string]string)
+	snapshot := newFileSnapshot(nil)
 
 	testFile := filepath.Join(tmpDir, "new.txt")
 	content := []byte("new file content")
@@ -90,7 +100,7 @@ func TestDetectChanges_NewFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	changes, err := detectChanges(tmpDir, snapshot)
+	changes, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatalf("detectChanges() error = %v", err)
 	}
@@ -110,14 +120,14 @@ func TestDetectChanges_NewFile(t *testing.T) {
 		t.Error("content mismatch")
 	}
 
-	if len(snapshot) != 1 {
-		t.Errorf("expected snapshot size 1, got %d", len(snapshot))
+	if snapshot.len() != 1 {
+		t.Errorf("expected snapshot size 1, got %d", snapshot.len())
 	}
 }
 
 func TestDetectChanges_ModifiedFile(t *testing.T) {
 	tmpDir := t.TempDir()
-	snapshot := make(map[string]string)
+	snapshot := newFileSnapshot(nil)
 
 	testFile := filepath.Join(tmpDir, "file.txt")
 
@@ -125,7 +135,7 @@ func TestDetectChanges_ModifiedFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err := detectChanges(tmpDir, snapshot)
+	_, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -135,7 +145,7 @@ func TestDetectChanges_ModifiedFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	changes, err := detectChanges(tmpDir, snapshot)
+	changes, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatalf("detectChanges() error = %v", err)
 	}
@@ -158,7 +168,7 @@ func TestDetectChanges_ModifiedFile(t *testing.T) {
 
 func TestDetectChanges_DeletedFile(t *testing.T) {
 	tmpDir := t.TempDir()
-	snapshot := make(map[string]string)
+	snapshot := newFileSnapshot(nil)
 
 	testFile := filepath.Join(tmpDir, "file.txt")
 
@@ -166,7 +176,7 @@ func TestDetectChanges_DeletedFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err := detectChanges(tmpDir, snapshot)
+	_, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -175,7 +185,7 @@ func TestDetectChanges_DeletedFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	changes, err := detectChanges(tmpDir, snapshot)
+	changes, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatalf("detectChanges() error = %v", err)
 	}
@@ -192,26 +202,26 @@ func TestDetectChanges_DeletedFile(t *testing.T) {
 		t.Error("expected Deleted = true for deleted file")
 	}
 
-	if len(snapshot) != 0 {
-		t.Errorf("expected empty snapshot after deletion, got size %d", len(snapshot))
+	if snapshot.len() != 0 {
+		t.Errorf("expected empty snapshot after deletion, got size %d", snapshot.len())
 	}
 }
 
 func TestDetectChanges_NoChanges(t *testing.T) {
 	tmpDir := t.TempDir()
-	snapshot := make(map[string]string)
+	snapshot := newFileSnapshot(nil)
 
 	testFile := filepath.Join(tmpDir, "file.txt")
 	if err := os.WriteFile(testFile, []byte("content"), 0644); err != nil {
 		t.Fatal(err)
 	}
 
-	_, err := detectChanges(tmpDir, snapshot)
+	_, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	changes, err := detectChanges(tmpDir, snapshot)
+	changes, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatalf("detectChanges() error = %v", err)
 	}
@@ -223,7 +233,7 @@ func TestDetectChanges_NoChanges(t *testing.T) {
 
 func TestDetectChanges_MultipleChanges(t *testing.T) {
 	tmpDir := t.TempDir()
-	snapshot := make(map[string]string)
+	snapshot := newFileSnapshot(nil)
 
 	file1 := filepath.Join(tmpDir, "file1.txt")
 	file2 := filepath.Join(tmpDir, "file2.txt")
@@ -236,7 +246,7 @@ func TestDetectChanges_MultipleChanges(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err := detectChanges(tmpDir, snapshot)
+	_, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -245,7 +255,7 @@ func TestDetectChanges_MultipleChanges(t *testing.T) {
 	os.Remove(file2)
 	os.WriteFile(file3, []byte("new"), 0644)
 
-	changes, err := detectChanges(tmpDir, snapshot)
+	changes, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatalf("detectChanges() error = %v", err)
 	}
@@ -274,7 +284,7 @@ func TestDetectChanges_MultipleChanges(t *testing.T) {
 
 func TestDetectChanges_NestedDirectories(t *testing.T) {
 	tmpDir := t.TempDir()
-	snapshot := make(map[string]string)
+	snapshot := newFileSnapshot(nil)
 
 	subDir := filepath.Join(tmpDir, "subdir")
 	if err := os.MkdirAll(subDir, 0755); err != nil {
@@ -291,7 +301,7 @@ func TestDetectChanges_NestedDirectories(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	changes, err := detectChanges(tmpDir, snapshot)
+	changes, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatalf("detectChanges() error = %v", err)
 	}
@@ -302,7 +312,7 @@ func TestDetectChanges_NestedDirectories(t *testing.T) {
 
 	foundNested := false
 	for _, change := range changes {
-		if change.Path == filepath.Join("subdir", "nested.txt") {
+		if change.Path == "subdir/nested.txt" {
 			foundNested = true
 		}
 	}
@@ -314,9 +324,9 @@ func TestDetectChanges_NestedDirectories(t *testing.T) {
 
 func TestDetectChanges_EmptyDirectory(t *testing.T) {
 	tmpDir := t.TempDir()
-	snapshot := make(map[string]string)
+	snapshot := newFileSnapshot(nil)
 
-	changes, err := detectChanges(tmpDir, snapshot)
+	changes, err := detectChanges(tmpDir, snapshot, scanOptions{})
 	if err != nil {
 		t.Fatalf("detectChanges() error = %v", err)
 	}
@@ -325,3 +335,1650 @@ func TestDetectChanges_EmptyDirectory(t *testing.T) {
 		t.Errorf("expected no changes in empty directory, got %d", len(changes))
 	}
 }
+
+func TestBackupOnce_SecondRunIsIncremental(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpWatch, "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, snapshotFile: snapshotFile}); err != nil {
+		t.Fatalf("first backupOnce() error = %v", err)
+	}
+
+	first, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	if len(first) != 1 {
+		t.Fatalf("expected 1 chunk after first run, got %d", len(first))
+	}
+	if _, err := os.Stat(snapshotFile); err != nil {
+		t.Fatalf("snapshot file not written: %v", err)
+	}
+
+	// Chunk names carry a second-resolution timestamp
+	time.Sleep(1100 * time.Millisecond)
+
+	if err := os.WriteFile(filepath.Join(tmpWatch, "b.txt"), []byte("b2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, snapshotFile: snapshotFile}); err != nil {
+		t.Fatalf("second backupOnce() error = %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 chunks after second run, got %d", len(files))
+	}
+
+	chunk, err := readChunk(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunk.Entries) != 1 || chunk.Entries[0].Path != "b.txt" {
+		t.Fatalf("expected second run to contain only b.txt, got %d entries", len(chunk.Entries))
+	}
+	if string(chunk.Entries[0].Content) != "b2" {
+		t.Errorf("expected updated content 'b2', got %s", string(chunk.Entries[0].Content))
+	}
+}
+
+func TestBackupOnce_NoChangesWritesNoChunk(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	if len(files) != 1 {
+		t.Errorf("expected 1 chunk, got %d", len(files))
+	}
+	if _, err := os.Stat(filepath.Join(tmpBackup, defaultSnapshotName)); err != nil {
+		t.Errorf("default snapshot file not written: %v", err)
+	}
+}
+
+func TestBackupOnce_RestoresDirectoryModTime(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+
+	dir := filepath.Join(tmpWatch, "docs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dirTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(dir, dirTime, dirTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(tmpRestore, "docs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(dirTime) {
+		t.Errorf("expected restored directory modtime %v, got %v", dirTime, info.ModTime())
+	}
+}
+
+func TestBackupOnce_InvalidWatchPath(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	tests := []struct {
+		watchPath string
+		want      string
+	}{
+		{missing, "watch path " + missing + " does not exist"},
+		{file, "watch path " + file + " is not a directory"},
+	}
+	for _, tt := range tests {
+		backupPath := filepath.Join(t.TempDir(), "backup")
+		err := backupOnce(watchOptions{watchPath: tt.watchPath, backupPath: backupPath})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("backupOnce(%s) error = %v, want %q", tt.watchPath, err, tt.want)
+		}
+		if _, err := os.Stat(backupPath); !os.IsNotExist(err) {
+			t.Errorf("expected the backup directory not to be created for %s", tt.watchPath)
+		}
+	}
+}
+
+func TestWatch_RestartReusesSnapshot(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cancelled context makes watch run exactly one scan before returning
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts := watchOptions{
+		watchPath:    tmpWatch,
+		backupPath:   tmpBackup,
+		refresh:      time.Hour,
+		snapshotFile: snapshotFile,
+	}
+
+	if err := watch(ctx, opts); err != nil {
+		t.Fatalf("first watch() error = %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 chunk after first start, got %d", len(files))
+	}
+
+	if err := watch(ctx, opts); err != nil {
+		t.Fatalf("second watch() error = %v", err)
+	}
+	files, _ = filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	if len(files) != 1 {
+		t.Errorf("expected restart to detect no changes, got %d chunks", len(files))
+	}
+}
+
+func TestLoadSnapshot_DiscardsOtherWatchPath(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+
+	state, err := loadSnapshot(snapshotFile, "/data/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Files.set("a.txt", "hash")
+	state.Runs = 4
+	if err := saveSnapshot(snapshotFile, state); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadSnapshot(snapshotFile, "/data/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := loaded.Files.clone()["a.txt"]; hash != "hash" || loaded.Runs != 4 {
+		t.Errorf("expected snapshot to load for same watch path, got %+v", loaded)
+	}
+
+	loaded, err = loadSnapshot(snapshotFile, "/data/two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Files.len() != 0 || loaded.Runs != 0 {
+		t.Errorf("expected snapshot for different watch path to be discarded, got %+v", loaded)
+	}
+}
+
+func TestFileSnapshot_ConcurrentAccess(t *testing.T) {
+	snapshot := newFileSnapshot(nil)
+	const writers, paths = 8, 100
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range paths {
+				path := fmt.Sprintf("w%d/%d.txt", w, i)
+				snapshot.set(path, "v1")
+				snapshot.set(path, "v2")
+				// Odd paths are removed again, even ones are kept
+				if i%2 == 1 {
+					snapshot.delete(path)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range paths {
+				snapshot.len()
+				snapshot.clone()
+			}
+		}()
+	}
+	wg.Wait()
+
+	files := snapshot.clone()
+	if len(files) != writers*paths/2 {
+		t.Fatalf("expected %d paths, got %d", writers*paths/2, len(files))
+	}
+	for path, value := range files {
+		if value != "v2" {
+			t.Errorf("%s: expected the last value written, got %q", path, value)
+		}
+	}
+
+	// A copy is not affected by later changes
+	snapshot.set("w0/0.txt", "v3")
+	if files["w0/0.txt"] != "v2" {
+		t.Error("expected clone to return an independent copy")
+	}
+}
+
+func TestBackupOnce_FullEveryNthRun(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, fullEvery: 3}
+
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpWatch, "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 1; run <= 3; run++ {
+		if run == 2 {
+			if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a2"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := backupOnce(opts); err != nil {
+			t.Fatalf("run %d: backupOnce() error = %v", run, err)
+		}
+		// Chunk names carry a second-resolution timestamp
+		time.Sleep(1100 * time.Millisecond)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	if len(files) != 3 {
+		t.Fatalf("expected one chunk per run, got %d", len(files))
+	}
+
+	for i, file := range files {
+		chunk, err := readChunk(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantFull := i == 2
+		if chunk.Full != wantFull {
+			t.Errorf("run %d: Full = %v, want %v", i+1, chunk.Full, wantFull)
+		}
+		if !chunk.Final {
+			t.Errorf("run %d: last chunk of run should be marked Final", i+1)
+		}
+		if wantFull && len(chunk.Entries) != 2 {
+			t.Errorf("full run should capture all 2 files, got %d", len(chunk.Entries))
+		}
+	}
+}
+
+func TestBackupOnce_WithInFlightBudget(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+
+	for i := range 20 {
+		name := filepath.Join(tmpWatch, "file_"+string(rune('a'+i))+".dat")
+		if err := os.WriteFile(name, make([]byte, 256*1024), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	budget := newByteBudget(512 * 1024)
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, budget: budget}
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("backupOnce() error = %v", err)
+	}
+
+	if budget.peak > 512*1024 {
+		t.Errorf("peak in-flight bytes %d exceeded budget", budget.peak)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	total := 0
+	for _, file := range files {
+		chunk, err := readChunk(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += len(chunk.Entries)
+	}
+	if total != 20 {
+		t.Errorf("expected 20 entries backed up, got %d", total)
+	}
+}
+
+func TestDetectChanges_StoresForwardSlashPaths(t *testing.T) {
+	tmpDir := t.TempDir()
+	snapshot := newFileSnapshot(nil)
+
+	nested := filepath.Join(tmpDir, "a", "b")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(nested, "c.txt"), []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := detectChanges(tmpDir, snapshot, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Path != "a/b/c.txt" {
+		t.Fatalf("expected canonical path a/b/c.txt, got %v", changes[0].Path)
+	}
+	if _, ok := snapshot.clone()["a/b/c.txt"]; !ok {
+		t.Error("snapshot should be keyed by the canonical path")
+	}
+}
+
+// ageTree pushes the modtime of every directory under root into the past so
+// the fast scan trusts it.
+func ageTree(t testing.TB, root string) {
+	t.Helper()
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return os.Chtimes(path, old, old)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetectChanges_FastScanSkipsUnchangedDirs(t *testing.T) {
+	tmpWatch := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpWatch, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpWatch, "sub", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ageTree(t, tmpWatch)
+
+	snapshot := newFileSnapshot(nil)
+	opts := scanOptions{fastScan: true, dirs: make(map[string]int64)}
+	if _, err := detectChanges(tmpWatch, snapshot, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := opts.dirs["sub"]; !ok {
+		t.Fatalf("expected sub's modtime to be recorded, got %v", opts.dirs)
+	}
+
+	// An in-place edit leaves the directory modtime alone, so the fast scan
+	// does not see it while a normal scan does
+	if err := os.WriteFile(filepath.Join(tmpWatch, "sub", "a.txt"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ageTree(t, tmpWatch)
+
+	changes, err := detectChanges(tmpWatch, newFileSnapshot(snapshot.clone()), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected fast scan to skip the unchanged directory, got %d changes", len(changes))
+	}
+
+	changes, err = detectChanges(tmpWatch, newFileSnapshot(snapshot.clone()), scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Errorf("expected normal scan to see the edit, got %d changes", len(changes))
+	}
+}
+
+func TestDetectChanges_FastScanSeesNewFile(t *testing.T) {
+	tmpWatch := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpWatch, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpWatch, "sub", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ageTree(t, tmpWatch)
+
+	snapshot := newFileSnapshot(nil)
+	opts := scanOptions{fastScan: true, dirs: make(map[string]int64)}
+	if _, err := detectChanges(tmpWatch, snapshot, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding a file bumps the directory modtime
+	if err := os.WriteFile(filepath.Join(tmpWatch, "sub", "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(tmpWatch, "sub", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := detectChanges(tmpWatch, snapshot, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, change := range changes {
+		got[change.Path] = change.Deleted
+	}
+	if deleted, ok := got["sub/b.txt"]; !ok || deleted {
+		t.Errorf("expected sub/b.txt to be detected as new, got %v", got)
+	}
+	if deleted, ok := got["sub/a.txt"]; !ok || !deleted {
+		t.Errorf("expected sub/a.txt to be detected as deleted, got %v", got)
+	}
+}
+
+func TestBackupOnce_FastScanPersistsDirModtimes(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ageTree(t, tmpWatch)
+
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, scan: scanOptions{fastScan: true}}
+	if err := backupOnce(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := loadSnapshot(filepath.Join(tmpBackup, defaultSnapshotName), tmpWatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Dirs["."]; !ok {
+		t.Errorf("expected the watch root's modtime in the snapshot, got %v", state.Dirs)
+	}
+}
+
+func BenchmarkDetectChanges_UnchangedTree(b *testing.B) {
+	tmpWatch := b.TempDir()
+	for i := range 50 {
+		dir := filepath.Join(tmpWatch, fmt.Sprintf("dir%02d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for j := range 40 {
+			content := bytes.Repeat([]byte{byte(j)}, 4096)
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%02d", j)), content, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	ageTree(b, tmpWatch)
+
+	for _, fast := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fast=%t", fast), func(b *testing.B) {
+			snapshot := newFileSnapshot(nil)
+			opts := scanOptions{fastScan: fast, dirs: make(map[string]int64)}
+			if _, err := detectChanges(tmpWatch, snapshot, opts); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				changes, err := detectChanges(tmpWatch, snapshot, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(changes) != 0 {
+					b.Fatalf("expected no changes, got %d", len(changes))
+				}
+			}
+		})
+	}
+}
+
+func TestDetectChanges_SnapshotHashMatchesContent(t *testing.T) {
+	tmpWatch := t.TempDir()
+	for name, content := range map[string]string{"new.txt": "new", "kept.txt": "kept", "edited.txt": "v2"} {
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keptHash, err := hashFile(filepath.Join(tmpWatch, "kept.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := newFileSnapshot(map[string]string{
+		"kept.txt":   keptHash,
+		"edited.txt": hashContent([]byte("v1")),
+	})
+
+	changes, err := detectChanges(tmpWatch, snapshot, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(changes))
+	}
+
+	for _, change := range changes {
+		onDisk, err := os.ReadFile(filepath.Join(tmpWatch, change.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(change.Content, onDisk) {
+			t.Errorf("%s: content %q does not match disk %q", change.Path, change.Content, onDisk)
+		}
+	}
+	for path, hash := range snapshot.clone() {
+		want, err := hashFile(filepath.Join(tmpWatch, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != want {
+			t.Errorf("%s: snapshot hash %s, hashFile %s", path, hash, want)
+		}
+	}
+}
+
+func BenchmarkDetectChanges_NewTree(b *testing.B) {
+	tmpWatch := b.TempDir()
+	content := bytes.Repeat([]byte("x"), 256*1024)
+	for i := range 64 {
+		if err := os.WriteFile(filepath.Join(tmpWatch, fmt.Sprintf("file%02d", i)), content, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(64 * int64(len(content)))
+	for range b.N {
+		changes, err := detectChanges(tmpWatch, newFileSnapshot(nil), scanOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(changes) != 64 {
+			b.Fatalf("expected 64 new files, got %d", len(changes))
+		}
+	}
+}
+
+func TestDetectChanges_FilesVanishingMidScan(t *testing.T) {
+	tmpWatch := t.TempDir()
+	for _, name := range []string{"known.txt", "new.txt", "stays.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := newFileSnapshot(map[string]string{"known.txt": hashContent([]byte("old"))})
+
+	// Each file is removed just before the scan opens it
+	origOpen, origRead := openFile, readFile
+	defer func() { openFile, readFile = origOpen, origRead }()
+	openFile = func(name string) (*os.File, error) {
+		if filepath.Base(name) == "known.txt" {
+			os.Remove(name)
+		}
+		return origOpen(name)
+	}
+	readFile = func(name string) ([]byte, error) {
+		if filepath.Base(name) == "new.txt" {
+			os.Remove(name)
+		}
+		return origRead(name)
+	}
+
+	changes, err := detectChanges(tmpWatch, snapshot, scanOptions{})
+	if err != nil {
+		t.Fatalf("detectChanges() error = %v", err)
+	}
+
+	got := make(map[string]bool)
+	for _, change := range changes {
+		got[change.Path] = change.Deleted
+	}
+	if deleted, ok := got["known.txt"]; !ok || !deleted {
+		t.Errorf("expected known.txt to be recorded as deleted, got %v", got)
+	}
+	if _, ok := got["new.txt"]; ok {
+		t.Errorf("expected new.txt to be skipped, got %v", got)
+	}
+	if deleted, ok := got["stays.txt"]; !ok || deleted {
+		t.Errorf("expected stays.txt to be backed up, got %v", got)
+	}
+	if _, ok := snapshot.clone()["new.txt"]; ok {
+		t.Error("expected new.txt to be left out of the snapshot")
+	}
+}
+
+// denyRead makes the scan's reads of the named files fail with a
+// permission error, since tests running as root can read anything.
+func denyRead(t *testing.T, names ...string) {
+	t.Helper()
+	origOpen, origRead := openFile, readFile
+	t.Cleanup(func() { openFile, readFile = origOpen, origRead })
+	denied := func(name string) bool {
+		return slices.Contains(names, filepath.Base(name))
+	}
+	openFile = func(name string) (*os.File, error) {
+		if denied(name) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		return origOpen(name)
+	}
+	readFile = func(name string) ([]byte, error) {
+		if denied(name) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		return origRead(name)
+	}
+}
+
+func TestDetectChanges_FailOnSkip(t *testing.T) {
+	tmpWatch := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	denyRead(t, "a.txt")
+
+	_, err := detectChanges(tmpWatch, newFileSnapshot(nil), scanOptions{failOnSkip: true})
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected a permission error, got %v", err)
+	}
+}
+
+func TestDetectChanges_SkipsUnreadableFiles(t *testing.T) {
+	tmpWatch := t.TempDir()
+	for _, name := range []string{"readable.txt", "secret.txt", "known-secret.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	knownHash := hashContent([]byte("old"))
+	snapshot := newFileSnapshot(map[string]string{"known-secret.txt": knownHash})
+	denyRead(t, "secret.txt", "known-secret.txt")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	opts := scanOptions{skipped: make(map[string]bool)}
+	changes, err := detectChanges(tmpWatch, snapshot, opts)
+	if err != nil {
+		t.Fatalf("detectChanges() error = %v", err)
+	}
+	if len(changes) != 1 || changes[0].Path != "readable.txt" {
+		t.Fatalf("expected only readable.txt to be backed up, got %v", changes)
+	}
+	if hash := snapshot.clone()["known-secret.txt"]; hash != knownHash {
+		t.Error("expected an unreadable known file to keep its snapshot hash")
+	}
+	if !opts.skipped["secret.txt"] || !opts.skipped["known-secret.txt"] {
+		t.Errorf("expected both unreadable files in the skip set, got %v", opts.skipped)
+	}
+	if !strings.Contains(logs.String(), "Skipped 2 unreadable paths") {
+		t.Errorf("expected a skip summary, got:\n%s", logs.String())
+	}
+
+	// Files already in the skip set are not reported again
+	logs.Reset()
+	if _, err := detectChanges(tmpWatch, snapshot, opts); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "skipping unreadable") {
+		t.Errorf("expected no repeated per-file warnings, got:\n%s", logs.String())
+	}
+}
+
+func TestDetectChanges_DeletionsInPathOrder(t *testing.T) {
+	snapshot := newFileSnapshot(nil)
+	for _, name := range []string{"d.txt", "a/x.txt", "c.txt", "b.txt", "a/b.txt"} {
+		snapshot.set(name, hashContent([]byte(name)))
+	}
+
+	changes, err := detectChanges(t.TempDir(), snapshot, scanOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+	if want := []string{"a/b.txt", "a/x.txt", "b.txt", "c.txt", "d.txt"}; !slices.Equal(paths, want) {
+		t.Errorf("expected deletions %v, got %v", want, paths)
+	}
+}
+
+// growDuringRead makes the scan's first read of name see the file after
+// more lines were appended, as with an active log file.
+func growDuringRead(t *testing.T, name string) {
+	t.Helper()
+	origRead := readFile
+	t.Cleanup(func() { readFile = origRead })
+	grown := false
+	readFile = func(path string) ([]byte, error) {
+		if filepath.Base(path) == name && !grown {
+			grown = true
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				return nil, err
+			}
+			f.WriteString("line 3\n")
+			f.Close()
+		}
+		return origRead(path)
+	}
+}
+
+func TestDetectChanges_GrowingFilePrefix(t *testing.T) {
+	tmpWatch := t.TempDir()
+	path := filepath.Join(tmpWatch, "app.log")
+	if err := os.WriteFile(path, []byte("line 1\nline 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	growDuringRead(t, "app.log")
+
+	snapshot := newFileSnapshot(nil)
+	changes, err := detectChanges(tmpWatch, snapshot, scanOptions{growing: growingPrefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("expected 1 change, got %d", len(changes))
+	}
+	entry := changes[0]
+	if string(entry.Content) != "line 1\nline 2\n" || entry.Size != int64(len(entry.Content)) {
+		t.Errorf("expected the length stat'd before the read, got %q (size %d)", entry.Content, entry.Size)
+	}
+	if hash := snapshot.clone()["app.log"]; hash != hashContent(entry.Content) {
+		t.Error("expected the snapshot hash to match the stored prefix")
+	}
+}
+
+func TestDetectChanges_GrowingFileRetry(t *testing.T) {
+	tmpWatch := t.TempDir()
+	path := filepath.Join(tmpWatch, "app.log")
+	if err := os.WriteFile(path, []byte("line 1\nline 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	growDuringRead(t, "app.log")
+
+	changes, err := detectChanges(tmpWatch, newFileSnapshot(nil), scanOptions{growing: growingRetry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("expected 1 change, got %d", len(changes))
+	}
+	entry := changes[0]
+	if string(entry.Content) != "line 1\nline 2\nline 3\n" || entry.Size != int64(len(entry.Content)) {
+		t.Errorf("expected the settled file after a retry, got %q (size %d)", entry.Content, entry.Size)
+	}
+}
+
+// ageAll sets every file and directory under root to an old modtime.
+func ageAll(t *testing.T, root string) {
+	t.Helper()
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, old, old)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupOnce_IfIdle(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpWatch, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpWatch, "sub", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, idleFor: time.Hour}
+
+	// A file still being written defers the backup
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("backupOnce() error = %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat")); len(files) != 0 {
+		t.Fatalf("expected the backup to be deferred, got %d chunks", len(files))
+	}
+
+	// Once the tree has been quiet for the settle period it proceeds
+	ageAll(t, tmpWatch)
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("backupOnce() error = %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat")); len(files) != 1 {
+		t.Fatalf("expected the quiet tree to be backed up, got %d chunks", len(files))
+	}
+}
+
+func TestModifiedWithin_SeesDeletions(t *testing.T) {
+	tmpWatch := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpWatch, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpWatch, "sub", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ageAll(t, tmpWatch)
+	if busy, err := modifiedWithin(tmpWatch, nil, time.Hour); err != nil || busy {
+		t.Fatalf("expected an aged tree to be idle, got %v, %v", busy, err)
+	}
+
+	if err := os.Remove(filepath.Join(tmpWatch, "sub", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if busy, err := modifiedWithin(tmpWatch, nil, time.Hour); err != nil || !busy {
+		t.Errorf("expected a deletion to count as activity, got %v, %v", busy, err)
+	}
+}
+
+func TestWatch_IfIdleDefersWithoutFailing(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, refresh: time.Hour, idleFor: time.Hour}
+	if err := watch(ctx, opts); err != nil {
+		t.Errorf("expected a deferred run not to count as a failure, got %v", err)
+	}
+}
+
+func TestBackupOnce_VerifySnapshotAfterChunksRemoved(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(tmpWatch, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}
+
+	write("a.txt", "a")
+	write("sub/b.txt", "b1")
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("first backupOnce() error = %v", err)
+	}
+	first, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+
+	write("sub/b.txt", "b2")
+	if err := os.Remove(filepath.Join(tmpWatch, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("second backupOnce() error = %v", err)
+	}
+
+	// The second run's chunks disappear out of band
+	all, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	for _, file := range all[len(first):] {
+		os.Remove(file)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	opts.verifySnapshot = true
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("verifying backupOnce() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), "snapshot disagrees with the backup") {
+		t.Errorf("expected the stale snapshot reported:\n%s", logs.String())
+	}
+
+	tmpRestore := t.TempDir()
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(tmpRestore, "sub", "b.txt")); string(got) != "b2" {
+		t.Errorf("expected the lost change backed up again, restored %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(tmpRestore, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected the lost deletion recorded again, got %v", err)
+	}
+
+	// Once the snapshot matches the backup, the check changes nothing
+	logs.Reset()
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("backupOnce() error = %v", err)
+	}
+	if strings.Contains(logs.String(), "snapshot disagrees") || !strings.Contains(logs.String(), "No changes detected") {
+		t.Errorf("expected a consistent snapshot left alone:\n%s", logs.String())
+	}
+}
+
+func TestDetectChanges_ExcludeByAge(t *testing.T) {
+	tmpWatch := t.TempDir()
+	ages := map[string]time.Duration{
+		"fresh.txt":   time.Minute,
+		"hour.txt":    time.Hour,
+		"day.txt":     24 * time.Hour,
+		"month.txt":   30 * 24 * time.Hour,
+		"sub/old.txt": 365 * 24 * time.Hour,
+	}
+	for name, age := range ages {
+		path := filepath.Join(tmpWatch, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		olderThan time.Duration
+		newerThan time.Duration
+		wantPaths []string
+	}{
+		{"older than", 48 * time.Hour, 0, []string{"day.txt", "fresh.txt", "hour.txt"}},
+		{"newer than", 0, 10 * time.Minute, []string{"day.txt", "hour.txt", "month.txt", "sub/old.txt"}},
+		{"both", 48 * time.Hour, 10 * time.Minute, []string{"day.txt", "hour.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := scanOptions{excludeOlderThan: tt.olderThan, excludeNewerThan: tt.newerThan}
+			changes, err := detectChanges(tmpWatch, newFileSnapshot(nil), opts)
+			if err != nil {
+				t.Fatalf("detectChanges() error = %v", err)
+			}
+			var got []string
+			for _, change := range changes {
+				got = append(got, change.Path)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.wantPaths) {
+				t.Errorf("backed up %v, want %v", got, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestDetectChanges_ExcludeByAgeKeepsBackedUpFiles(t *testing.T) {
+	tmpWatch := t.TempDir()
+	path := filepath.Join(tmpWatch, "cache.bin")
+	if err := os.WriteFile(path, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := newFileSnapshot(nil)
+	if _, err := detectChanges(tmpWatch, snapshot, scanOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	backedUp := snapshot.clone()["cache.bin"]
+
+	// The file ages out of the window and is then edited without a modtime
+	// change; it is neither deleted nor rescanned
+	if err := os.WriteFile(path, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-90 * 24 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := detectChanges(tmpWatch, snapshot, scanOptions{excludeOlderThan: 30 * 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("detectChanges() error = %v", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected no changes for a file outside the window, got %+v", changes[0])
+	}
+	if hash := snapshot.clone()["cache.bin"]; hash != backedUp {
+		t.Errorf("expected the snapshot to keep the backed-up hash, got %q", hash)
+	}
+}
+
+func TestBackupOnce_MetadataOnly(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	content := map[string]string{"movie.mkv": "frames", "sub/song.flac": "samples"}
+	for name, data := range content {
+		path := filepath.Join(tmpWatch, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, scan: scanOptions{metadataOnly: true}}
+	if err := backupOnce(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := chunkFiles(tmpBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, file := range files {
+		chunk, err := readChunk(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range chunk.Entries {
+			data, ok := content[entry.Path]
+			if !ok {
+				continue
+			}
+			found++
+			if len(entry.Content) != 0 || !entry.MetadataOnly {
+				t.Errorf("%s: expected metadata without content, got %d bytes (metadata only %v)",
+					entry.Path, len(entry.Content), entry.MetadataOnly)
+			}
+			if entry.Size != int64(len(data)) || entry.ContentHash != hashContent([]byte(data)) {
+				t.Errorf("%s: expected size %d and the content's hash, got %d %s", entry.Path, len(data), entry.Size, entry.ContentHash)
+			}
+		}
+	}
+	if found != len(content) {
+		t.Fatalf("expected %d files in the chunks, found %d", len(content), found)
+	}
+
+	// Only changed files are recorded again
+	if err := os.WriteFile(filepath.Join(tmpWatch, "movie.mkv"), []byte("recut"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadSnapshot(filepath.Join(tmpBackup, defaultSnapshotName), tmpWatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := detectChanges(tmpWatch, state.Files, scanOptions{metadataOnly: true, captureDirs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Path != "movie.mkv" || !changes[0].MetadataOnly {
+		t.Errorf("expected only movie.mkv to change, got %v", changes)
+	}
+}
+
+func TestBackupOnce_MaxScanDurationDiscardsSlowScan(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, scan: scanOptions{maxDuration: 50 * time.Millisecond}}
+	if err := backupOnce(opts); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+
+	// New files are read slowly enough that the walk runs out of time
+	// before it gets back to a.txt and b.txt
+	for _, name := range []string{"0.txt", "1.txt", "2.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	origRead := readFile
+	readFile = func(path string) ([]byte, error) {
+		time.Sleep(40 * time.Millisecond)
+		return origRead(path)
+	}
+	defer func() { readFile = origRead }()
+
+	err := backupOnce(opts)
+	if !errors.Is(err, errScanTimeout) {
+		t.Fatalf("expected the scan to time out, got %v", err)
+	}
+	after, _ := filepath.Glob(filepath.Join(tmpBackup, "chunk_*.dat"))
+	if len(after) != len(before) {
+		t.Errorf("expected no chunks from the abandoned scan, had %d and now %d", len(before), len(after))
+	}
+	state, err := loadSnapshot(filepath.Join(tmpBackup, defaultSnapshotName), tmpWatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, ok := state.Files.clone()[name]; !ok {
+			t.Errorf("expected %s to stay in the snapshot", name)
+		}
+	}
+	if _, ok := state.Files.clone()["0.txt"]; ok {
+		t.Error("expected nothing from the abandoned scan in the snapshot")
+	}
+}
+
+func TestBackupOnce_HashCacheAvoidsRehashingAfterRestart(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ageAll(t, tmpWatch)
+
+	opened := 0
+	origOpen := openFile
+	openFile = func(name string) (*os.File, error) {
+		opened++
+		return origOpen(name)
+	}
+	defer func() { openFile = origOpen }()
+
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, hashCacheFile: filepath.Join(tmpBackup, "hashes.json")}
+	if err := backupOnce(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each backupOnce is a fresh start that loads the snapshot and cache
+	// from disk, so the known files are only hashed again without the cache
+	opened = 0
+	if err := backupOnce(watchOptions{watchPath: tmpWatch, backupPath: tmpBackup}); err != nil {
+		t.Fatal(err)
+	}
+	if opened != 3 {
+		t.Fatalf("expected 3 files hashed without the cache, got %d", opened)
+	}
+
+	opened = 0
+	if err := backupOnce(opts); err != nil {
+		t.Fatal(err)
+	}
+	if opened != 0 {
+		t.Errorf("expected a warm cache to avoid hashing, got %d files hashed", opened)
+	}
+
+	// A file whose size changed is hashed and backed up again
+	if err := os.WriteFile(filepath.Join(tmpWatch, "b.txt"), []byte("b, edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ageAll(t, tmpWatch)
+	opened = 0
+	if err := backupOnce(opts); err != nil {
+		t.Fatal(err)
+	}
+	if opened != 1 {
+		t.Errorf("expected only the edited file hashed, got %d", opened)
+	}
+	state, err := loadSnapshot(filepath.Join(tmpBackup, defaultSnapshotName), tmpWatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := state.Files.clone()["b.txt"]; hash != hashContent([]byte("b, edited")) {
+		t.Error("expected the edited file's new hash in the snapshot")
+	}
+}
+
+func TestBackupOnce_NoDeleteKeepsVanishedFiles(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	tmpRestore := t.TempDir()
+	for _, name := range []string{"keep.txt", "gone.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpWatch, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, scan: scanOptions{noDelete: true}}
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("first backupOnce() error = %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(tmpWatch, "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpWatch, "keep.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupOnce(opts); err != nil {
+		t.Fatalf("second backupOnce() error = %v", err)
+	}
+
+	files, err := chunkFiles(tmpBackup)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected 2 runs, got %d (%v)", len(files), err)
+	}
+	for _, file := range files {
+		chunk, err := readChunk(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range chunk.Entries {
+			if entry.Deleted {
+				t.Errorf("expected no tombstones, got one for %s in %s", entry.Path, filepath.Base(file))
+			}
+		}
+	}
+
+	if err := restore(tmpBackup, tmpRestore, restoreOptions{}); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(tmpRestore, "gone.txt")); err != nil || string(got) != "gone.txt" {
+		t.Errorf("expected the vanished file restored, got %q (%v)", got, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(tmpRestore, "keep.txt")); string(got) != "changed" {
+		t.Errorf("expected the latest keep.txt, got %q", got)
+	}
+}
+
+func TestJitteredInterval(t *testing.T) {
+	base, jitter := time.Minute, 10*time.Second
+
+	seen := make(map[time.Duration]bool)
+	for range 100 {
+		got := jitteredInterval(base, jitter)
+		if got < base-jitter || got > base+jitter {
+			t.Fatalf("jitteredInterval(%s, %s) = %s, outside %s±%s", base, jitter, got, base, jitter)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("expected the interval to vary between calls, got only %v", seen)
+	}
+
+	if got := jitteredInterval(base, 0); got != base {
+		t.Errorf("jitteredInterval(%s, 0) = %s, want the exact interval", base, got)
+	}
+	for range 100 {
+		if got := jitteredInterval(time.Second, time.Minute); got < 0 {
+			t.Fatalf("expected a jitter larger than the interval to never wait less than zero, got %s", got)
+		}
+	}
+}
+
+func TestBackupOnce_MaxDeleteRatio(t *testing.T) {
+	tests := []struct {
+		name      string
+		deleted   int
+		fullEvery int
+		blocked   bool
+	}{
+		{name: "normal deletion proceeds", deleted: 2},
+		{name: "mass deletion is blocked", deleted: 8, blocked: true},
+		{name: "mass deletion in a full run is blocked", deleted: 8, fullEvery: 2, blocked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpWatch := t.TempDir()
+			tmpBackup := t.TempDir()
+			for i := range 10 {
+				if err := os.WriteFile(filepath.Join(tmpWatch, fmt.Sprintf("%d.txt", i)), []byte("x"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := watchOptions{
+				watchPath:  tmpWatch,
+				backupPath: tmpBackup,
+				fullEvery:  tt.fullEvery,
+				scan:       scanOptions{maxDeleteRatio: 0.5},
+			}
+			if err := backupOnce(opts); err != nil {
+				t.Fatalf("first backupOnce() error = %v", err)
+			}
+			for i := range tt.deleted {
+				if err := os.Remove(filepath.Join(tmpWatch, fmt.Sprintf("%d.txt", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := backupOnce(opts)
+			files, _ := chunkFiles(tmpBackup)
+			if !tt.blocked {
+				if err != nil {
+					t.Fatalf("expected the deletion to be backed up, got %v", err)
+				}
+				if len(files) != 2 {
+					t.Errorf("expected a second run, got %d chunks", len(files))
+				}
+				return
+			}
+			if !errors.Is(err, errMassDeletion) || !strings.Contains(err.Error(), "--confirm-mass-delete") {
+				t.Fatalf("expected a blocked mass deletion naming --confirm-mass-delete, got %v", err)
+			}
+			if len(files) != 1 {
+				t.Fatalf("expected nothing written for the blocked run, got %d chunks", len(files))
+			}
+
+			// The snapshot was left alone, so the confirmed run still sees
+			// every deletion
+			opts.scan.confirmMassDelete = true
+			if err := backupOnce(opts); err != nil {
+				t.Fatalf("confirmed backupOnce() error = %v", err)
+			}
+			state, err := resolveBackup(tmpBackup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(state.files) != 10-tt.deleted {
+				t.Errorf("expected %d live files after the confirmed run, got %d", 10-tt.deleted, len(state.files))
+			}
+		})
+	}
+}
+
+func TestWatch_BacksOffAfterFailedScans(t *testing.T) {
+	tmpWatch := t.TempDir()
+	tmpBackup := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpWatch, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scans := 0
+	scanTree = func(watchPath string, files *fileSnapshot, opts scanOptions, out chan<- *FileEntry) (int, error) {
+		scans++
+		if scans <= 3 {
+			return 0, errors.New("mount is flapping")
+		}
+		return scanChanges(watchPath, files, opts, out)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var waits []time.Duration
+	waitFor = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		if len(waits) == 5 {
+			cancel()
+			return nil
+		}
+		ready := make(chan time.Time, 1)
+		ready <- time.Now()
+		return ready
+	}
+	t.Cleanup(func() {
+		scanTree = scanChanges
+		waitFor = time.After
+	})
+
+	refresh := time.Minute
+	opts := watchOptions{watchPath: tmpWatch, backupPath: tmpBackup, refresh: refresh, maxBackoff: 5 * time.Minute}
+	err := watch(ctx, opts)
+	var partial *partialError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected some runs to fail, got %v", err)
+	}
+
+	want := []time.Duration{2 * refresh, 4 * refresh, 5 * refresh, refresh, refresh}
+	if !slices.Equal(waits, want) {
+		t.Errorf("waits = %v, want %v", waits, want)
+	}
+}
+
+func TestErrorBackoff(t *testing.T) {
+	refresh := time.Minute
+	tests := []struct {
+		failures   int
+		maxBackoff time.Duration
+		want       time.Duration
+	}{
+		{0, time.Hour, refresh},
+		{1, time.Hour, 2 * refresh},
+		{3, time.Hour, 8 * refresh},
+		{10, time.Hour, time.Hour},
+		{1000, time.Hour, time.Hour},
+		{3, 0, refresh},
+		{3, time.Second, refresh},
+	}
+	for _, tt := range tests {
+		if got := errorBackoff(refresh, tt.failures, tt.maxBackoff); got != tt.want {
+			t.Errorf("errorBackoff(%s, %d, %s) = %s, want %s", refresh, tt.failures, tt.maxBackoff, got, tt.want)
+		}
+	}
+}
+
+func TestWatch_VerifySampleFindsCorruptChunk(t *testing.T) {
+	tmpWatch := t.TempDir()
+	primary, mirror := writeMirroredBackup(t)
+	for i := range 8 {
+		chunk := Chunk{Entries: []*FileEntry{{Path: fmt.Sprintf("%d.txt", i), Mode: 0644, Content: []byte("x")}}, Final: true}
+		if err := writeChunk(primary, int64(3000+i), 0, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corruptChunk(t, filepath.Join(primary, "chunk_2000_000.dat"))
+
+	// Sampling 2 of 10 chunks, 100 intervals miss the corrupt one with
+	// probability 0.8^100
+	logs := captureLog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	intervals := 0
+	waitFor = func(time.Duration) <-chan time.Time {
+		intervals++
+		if intervals == 100 || strings.Contains(logs.String(), "chunk_2000_000.dat") {
+			cancel()
+			return nil
+		}
+		ready := make(chan time.Time, 1)
+		ready <- time.Now()
+		return ready
+	}
+	t.Cleanup(func() { waitFor = time.After })
+
+	opts := watchOptions{watchPath: tmpWatch, backupPath: primary, refresh: time.Minute, verifySample: 2, verifyMirror: mirror}
+	if err := watch(ctx, opts); err != nil {
+		t.Fatalf("watch() error = %v", err)
+	}
+
+	if !strings.Contains(logs.String(), "Repaired corrupt chunk chunk_2000_000.dat") {
+		t.Fatalf("expected sampling to find and repair the corrupt chunk within %d intervals", intervals)
+	}
+	if _, err := readChunk(filepath.Join(primary, "chunk_2000_000.dat")); err != nil {
+		t.Errorf("chunk still corrupt after repair: %v", err)
+	}
+}
+
+func TestWatch_VerifySampleReportsUnrepairable(t *testing.T) {
+	primary, _ := writeMirroredBackup(t)
+	corruptChunk(t, filepath.Join(primary, "chunk_1000_000.dat"))
+
+	logs := captureLog(t)
+	sampleBackup(watchOptions{backupPath: primary, verifySample: 5})
+	if !strings.Contains(logs.String(), "ERROR: backup integrity check failed: 1 of 2 chunks are corrupt") {
+		t.Errorf("expected a prominent integrity error, got %q", logs.String())
+	}
+}
+
+// writeSubtrees fills root with n top-level directories, each holding a
+// nested directory and a few files.
+func writeSubtrees(tb testing.TB, root string, n, filesPer int) {
+	tb.Helper()
+	for i := range n {
+		dir := filepath.Join(root, fmt.Sprintf("dir%02d", i), "nested")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		for j := range filesPer {
+			name := filepath.Join(filepath.Dir(dir), fmt.Sprintf("file%02d", j))
+			if j%2 == 1 {
+				name = filepath.Join(dir, fmt.Sprintf("file%02d", j))
+			}
+			if err := os.WriteFile(name, []byte(fmt.Sprintf("%d/%d", i, j)), 0644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestDetectChanges_ParallelWalkMatchesSerial(t *testing.T) {
+	tmpWatch := t.TempDir()
+	writeSubtrees(t, tmpWatch, 12, 6)
+	if err := os.WriteFile(filepath.Join(tmpWatch, "top.txt"), []byte("top"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Rules from the root and from inside a subtree both apply
+	if err := os.WriteFile(filepath.Join(tmpWatch, ignoreFileName), []byte("file05\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpWatch, "dir03", ignoreFileName), []byte("nested/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The previous state has a modified file, and files in a subtree and at
+	// the root that are gone
+	previous, err := detectChanges(tmpWatch, newFileSnapshot(nil), scanOptions{captureDirs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := make(map[string]string)
+	for _, entry := range previous {
+		if entry.Mode.IsDir() {
+			state[entry.Path] = dirSnapshotValue(entry.Mode, entry.ModTime)
+		} else {
+			state[entry.Path] = entry.ContentHash
+		}
+	}
+	state["dir07/file00"] = hashContent([]byte("old"))
+	state["gone/file.txt"] = hashContent([]byte("gone"))
+	state["gone.txt"] = hashContent([]byte("gone"))
+
+	type change struct {
+		path    string
+		deleted bool
+		hash    string
+	}
+	scan := func(walkers int) ([]change, map[string]string) {
+		snapshot := newFileSnapshot(maps.Clone(state))
+		changes, err := detectChanges(tmpWatch, snapshot, scanOptions{captureDirs: true, walkers: walkers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []change
+		for _, entry := range changes {
+			got = append(got, change{entry.Path, entry.Deleted, entry.ContentHash})
+		}
+		slices.SortFunc(got, func(a, b change) int { return strings.Compare(a.path, b.path) })
+		return got, snapshot.clone()
+	}
+
+	serialChanges, serialState := scan(0)
+	parallelChanges, parallelState := scan(4)
+	if len(serialChanges) != 3 {
+		t.Fatalf("expected the serial walk to find 3 changes, got %v", serialChanges)
+	}
+	if !slices.Equal(parallelChanges, serialChanges) {
+		t.Errorf("parallel walk found %v, serial %v", parallelChanges, serialChanges)
+	}
+	if !maps.Equal(parallelState, serialState) {
+		t.Errorf("parallel walk left a different snapshot:\n%v\nserial:\n%v", parallelState, serialState)
+	}
+	if _, ok := parallelState["dir03/nested/file01"]; ok {
+		t.Error("expected the subtree's .backupignore to exclude dir03/nested")
+	}
+}
+
+func TestDetectChanges_ParallelWalkError(t *testing.T) {
+	tmpWatch := t.TempDir()
+	writeSubtrees(t, tmpWatch, 8, 2)
+
+	origRead := readFile
+	t.Cleanup(func() { readFile = origRead })
+	readFile = func(name string) ([]byte, error) {
+		if strings.Contains(name, "dir05") {
+			return nil, errors.New("disk on fire")
+		}
+		return origRead(name)
+	}
+
+	_, err := detectChanges(tmpWatch, newFileSnapshot(nil), scanOptions{walkers: 3})
+	if err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Errorf("expected the subtree's error, got %v", err)
+	}
+}
+
+func BenchmarkDetectChanges_ParallelWalk(b *testing.B) {
+	tmpWatch := b.TempDir()
+	writeSubtrees(b, tmpWatch, 64, 40)
+	ageTree(b, tmpWatch)
+
+	for _, walkers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("walkers=%d", walkers), func(b *testing.B) {
+			snapshot := newFileSnapshot(nil)
+			opts := scanOptions{walkers: walkers}
+			if _, err := detectChanges(tmpWatch, snapshot, opts); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				if _, err := detectChanges(tmpWatch, snapshot, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestHashFileBuffer_SizeDoesNotChangeHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.bin")
+	content := distinctContent(7, 3*1024*1024+17)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := hashContent(content)
+
+	for _, size := range []int{0, 1, 4096, 64 * 1024, defaultHashBufferSize, 8 * 1024 * 1024} {
+		var buf []byte
+		if size > 0 {
+			buf = make([]byte, size)
+		}
+		if got, err := hashFileBuffer(path, buf); err != nil || got != want {
+			t.Errorf("buffer of %d bytes: hash %s, %v; want %s", size, got, err, want)
+		}
+	}
+
+	// The scan's hash of an unchanged file matches whatever buffer it uses
+	snapshot := newFileSnapshot(map[string]string{"big.bin": want})
+	changes, err := detectChanges(filepath.Dir(path), snapshot, scanOptions{hashBufferSize: 4096})
+	if err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes, got %d, %v", len(changes), err)
+	}
+}
+
+func BenchmarkHashFileBuffer(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "big.bin")
+	content := distinctContent(1, 64*1024*1024)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	// 32K is what io.Copy uses on its own
+	for _, size := range []int{32 * 1024, defaultHashBufferSize} {
+		b.Run(fmt.Sprintf("buffer=%dK", size/1024), func(b *testing.B) {
+			buf := make([]byte, size)
+			b.SetBytes(int64(len(content)))
+			for range b.N {
+				if _, err := hashFileBuffer(path, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}